@@ -0,0 +1,355 @@
+package himitsu
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/pagedegeek/himitsu/data_access"
+	"time"
+)
+
+/*
+	Every audited operation appends an entry to the audit log, whether it
+	succeeds or not. Without an audit key, audited operations fail before
+	doing anything, and a change is saved in the same transaction as its
+	entry, so that no change is left unaudited.
+
+	Entries are hash-chained: the hash of an entry covers its content and the
+	hash of the previous entry, so removing or editing an entry breaks the
+	chain from there on. The hash is also signed with the audit key, so that
+	the chain cannot be recomputed by someone without it. The audit key never
+	reaches the data access, see SetAuditKey. Dropping the latest entries
+	leaves a valid chain, so the sequence of the last entry should be
+	checked against an external record when that matters.
+*/
+
+const (
+	AUDIT_OPERATION_CREATE_REPOSITORY          string = "CreateRepository"
+	AUDIT_OPERATION_READ_SECRET                string = "ReadSecret"
+	AUDIT_OPERATION_WRITE_SECRET               string = "WriteSecret"
+	AUDIT_OPERATION_DELETE_SECRET              string = "DeleteSecret"
+	AUDIT_OPERATION_RENAME_SECRET              string = "RenameSecret"
+	AUDIT_OPERATION_LIST_SECRET_NAMES          string = "ListSecretNames"
+	AUDIT_OPERATION_UPDATE                     string = "Update"
+	AUDIT_OPERATION_CHANGE_USER_PASSWORD       string = "ChangeUserPassword"
+	AUDIT_OPERATION_ADD_USER_ACCOUNT           string = "AddUserAccount"
+	AUDIT_OPERATION_REMOVE_USER_ACCOUNT        string = "RemoveUserAccount"
+	AUDIT_OPERATION_UPDATE_USER_ACCOUNT_RIGHTS string = "UpdateUserAccountRights"
+	AUDIT_OPERATION_LIST_USER_ACCOUNTS         string = "ListUserAccounts"
+
+	AUDIT_OUTCOME_SUCCESS string = "success"
+	AUDIT_OUTCOME_FAILURE string = "failure"
+)
+
+type AuditEntry struct {
+	Sequence     uint64    `json:"sequence"`
+	Time         time.Time `json:"time"`
+	Actor        string    `json:"actor"`
+	Repository   string    `json:"repository"`
+	Secret       string    `json:"secret,omitempty"`
+	Operation    string    `json:"operation"`
+	Outcome      string    `json:"outcome"`
+	Reason       string    `json:"reason,omitempty"`
+	PreviousHash []byte    `json:"previous_hash"`
+	Hash         []byte    `json:"hash"`
+	MAC          []byte    `json:"mac"`
+}
+
+type ErrAuditLogTampered struct {
+	sequence uint64
+}
+
+func (e *ErrAuditLogTampered) Error() string {
+	return fmt.Sprintf("Audit log tampered at entry %d", e.sequence)
+}
+
+type ErrNoAuditKey struct{}
+
+func (e *ErrNoAuditKey) Error() string {
+	return "No audit key set"
+}
+
+// SetAuditKey sets the key signing the audit log entries. It must be kept
+// apart from the data access, and stay the same across restarts for the log
+// to verify. Without it, every audited operation fails with ErrNoAuditKey.
+func (h *Himitsu) SetAuditKey(auditKey []byte) {
+	h.auditKey = auditKey
+}
+
+// digest hashes the entry, its hash and MAC excluded, chained to the
+// previous hash.
+func (ae *AuditEntry) digest() ([]byte, error) {
+	unsigned := *ae
+	unsigned.Hash = nil
+	unsigned.MAC = nil
+
+	content, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.New()
+	digest.Write(ae.PreviousHash)
+	digest.Write(content)
+	return digest.Sum(nil), nil
+}
+
+func (h *Himitsu) signAuditHash(hash []byte) []byte {
+	mac := hmac.New(sha256.New, h.auditKey)
+	mac.Write(hash)
+	return mac.Sum(nil)
+}
+
+// newAuditEntry returns the unchained entry of the operation, a failure
+// when opErr is not nil.
+func newAuditEntry(operation, actor, repoUUID, secretName string,
+	opErr error) *AuditEntry {
+
+	entry := &AuditEntry{
+		Time:       time.Now().UTC(),
+		Actor:      actor,
+		Repository: repoUUID,
+		Secret:     secretName,
+		Operation:  operation,
+		Outcome:    AUDIT_OUTCOME_SUCCESS}
+	if opErr != nil {
+		entry.Outcome = AUDIT_OUTCOME_FAILURE
+		entry.Reason = opErr.Error()
+	}
+	return entry
+}
+
+// audit appends an entry for the operation to the audit log and returns the
+// error of the operation. A successful operation that cannot be audited
+// fails with the audit error instead.
+func (h *Himitsu) audit(operation, actor, repoUUID, secretName string,
+	opErr error) error {
+
+	entry := newAuditEntry(operation, actor, repoUUID, secretName, opErr)
+	if err := h.appendAuditEntry(entry); err != nil && opErr == nil {
+		return err
+	}
+	return opErr
+}
+
+func (h *Himitsu) checkAuditKey() error {
+	if len(h.auditKey) == 0 {
+		return &ErrNoAuditKey{}
+	}
+	return nil
+}
+
+// auditRecord is the audit of an operation under way, see beginAudit.
+type auditRecord struct {
+	h          *Himitsu
+	operation  string
+	actor      string
+	repoUUID   string
+	secretName string
+	committed  bool
+}
+
+// beginAudit starts the audit of the operation. It fails with ErrNoAuditKey
+// before the operation does anything when there is no audit key. The
+// success of an operation is committed along with its changes, see commit,
+// anything else is appended once it returns, see end.
+func (h *Himitsu) beginAudit(operation, actor, repoUUID,
+	secretName string) (*auditRecord, error) {
+
+	if err := h.checkAuditKey(); err != nil {
+		return nil, err
+	}
+	return &auditRecord{h: h, operation: operation, actor: actor,
+		repoUUID: repoUUID, secretName: secretName}, nil
+}
+
+// commit commits the batch along with the success entry of the operation,
+// so that the changes are not saved without it.
+func (ar *auditRecord) commit(batch data_access.Batch) error {
+	if err := ar.h.commitAudited(batch, ar.repoUUID, newAuditEntry(
+		ar.operation, ar.actor, ar.repoUUID, ar.secretName,
+		nil)); err != nil {
+		return err
+	}
+	ar.committed = true
+	return nil
+}
+
+// saveRepository saves the repository, as Himitsu.saveRepository does,
+// along with the success entry of the operation.
+func (ar *auditRecord) saveRepository(
+	repository *Repository, repositoryKey []byte) error {
+
+	batch := ar.h.dataAccess.NewBatch()
+	if err := ar.h.batchSaveRepository(
+		batch, repository, repositoryKey); err != nil {
+		return err
+	}
+	return ar.commit(batch)
+}
+
+// end appends the entry of the operation, unless its success was committed
+// already, and returns opErr as audit does.
+func (ar *auditRecord) end(opErr error) error {
+	if ar.committed && opErr == nil {
+		return nil
+	}
+	return ar.h.audit(
+		ar.operation, ar.actor, ar.repoUUID, ar.secretName, opErr)
+}
+
+// commitAudited commits the batch along with the entries, chained after
+// the last entry of the audit log.
+func (h *Himitsu) commitAudited(batch data_access.Batch, repoUUID string,
+	entries ...*AuditEntry) error {
+
+	if err := h.checkAuditKey(); err != nil {
+		return err
+	}
+
+	h.auditMutex.Lock()
+	defer h.auditMutex.Unlock()
+
+	lastSequence, lastHash, err := h.readLastAuditHash()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		encodedEntry, err := h.chainAuditEntry(entry, lastSequence, lastHash)
+		if err != nil {
+			return err
+		}
+		batch.SaveAuditEntry(entry.Sequence, encodedEntry)
+		lastSequence, lastHash = entry.Sequence, entry.Hash
+	}
+
+	return h.commitBatch(batch, repoUUID)
+}
+
+func (h *Himitsu) appendAuditEntry(entry *AuditEntry) error {
+	if err := h.checkAuditKey(); err != nil {
+		return err
+	}
+
+	h.auditMutex.Lock()
+	defer h.auditMutex.Unlock()
+
+	lastSequence, lastHash, err := h.readLastAuditHash()
+	if err != nil {
+		return err
+	}
+	encodedEntry, err := h.chainAuditEntry(entry, lastSequence, lastHash)
+	if err != nil {
+		return err
+	}
+
+	return h.dataAccess.SaveAuditEntry(entry.Sequence, encodedEntry)
+}
+
+// readLastAuditHash returns the sequence and hash of the last entry of the
+// audit log, 0 and nil when it is empty.
+func (h *Himitsu) readLastAuditHash() (uint64, []byte, error) {
+	lastSequence, lastEntry, err := h.dataAccess.ReadLastAuditEntry()
+	if err != nil || lastEntry == nil {
+		return lastSequence, nil, err
+	}
+	previousEntry := &AuditEntry{}
+	if err := json.Unmarshal(lastEntry, previousEntry); err != nil {
+		return 0, nil, err
+	}
+	return lastSequence, previousEntry.Hash, nil
+}
+
+// chainAuditEntry chains the entry after the last one, signs it and returns
+// it encoded.
+func (h *Himitsu) chainAuditEntry(entry *AuditEntry,
+	lastSequence uint64, lastHash []byte) ([]byte, error) {
+
+	entry.Sequence = lastSequence + 1
+	entry.PreviousHash = lastHash
+
+	hash, err := entry.digest()
+	if err != nil {
+		return nil, err
+	}
+	entry.Hash = hash
+	entry.MAC = h.signAuditHash(hash)
+
+	return json.Marshal(entry)
+}
+
+// VerifyAuditLog checks the whole audit log chain and returns its entries.
+func (h *Himitsu) VerifyAuditLog() ([]*AuditEntry, error) {
+	if err := h.checkAuditKey(); err != nil {
+		return nil, err
+	}
+
+	encodedEntries, err := h.dataAccess.ListAuditEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*AuditEntry, 0, len(encodedEntries))
+	var previousHash []byte
+	for i, encodedEntry := range encodedEntries {
+		sequence := uint64(i + 1)
+
+		entry := &AuditEntry{}
+		if err := json.Unmarshal(encodedEntry, entry); err != nil {
+			return nil, &ErrAuditLogTampered{sequence: sequence}
+		}
+
+		if entry.Sequence != sequence ||
+			!bytes.Equal(entry.PreviousHash, previousHash) {
+			return nil, &ErrAuditLogTampered{sequence: sequence}
+		}
+
+		hash, err := entry.digest()
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(hash, entry.Hash) ||
+			!hmac.Equal(h.signAuditHash(hash), entry.MAC) {
+			return nil, &ErrAuditLogTampered{sequence: sequence}
+		}
+
+		entries = append(entries, entry)
+		previousHash = entry.Hash
+	}
+	return entries, nil
+}
+
+// ListAuditEntries verifies the audit log and returns the entries of the
+// repository, to its user account admins only.
+func (h *Himitsu) ListAuditEntries(
+	repoUUID, userUUID, userPwd string) ([]*AuditEntry, error) {
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if err := repository.checkAdminRight(userUUID); err != nil {
+		return nil, err
+	}
+
+	entries, err := h.VerifyAuditLog()
+	if err != nil {
+		return nil, err
+	}
+
+	repositoryEntries := make([]*AuditEntry, 0)
+	for _, entry := range entries {
+		if entry.Repository == repoUUID {
+			repositoryEntries = append(repositoryEntries, entry)
+		}
+	}
+	return repositoryEntries, nil
+}
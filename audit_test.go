@@ -0,0 +1,201 @@
+package himitsu
+
+import (
+	"testing"
+)
+
+func TestAuditedOperations(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+
+	_, err = h.ReadSecretVersion(repoUUID, adminUUID, "password", "hello", 1)
+	assert.Nil(err)
+	_, err = h.ReadSecretMetadata(repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+	assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", "hello",
+		[]byte("Bye"), nil))
+	assert.Nil(h.RollbackSecret(repoUUID, adminUUID, "password", "hello", 1))
+	assert.Nil(h.RenameSecret(
+		repoUUID, adminUUID, "password", "hello", "greeting"))
+	assert.Nil(h.DeleteSecret(repoUUID, adminUUID, "password", "greeting"))
+	err = h.DeleteSecret(repoUUID, adminUUID, "password", "greeting")
+	assert.IsType(&ErrUnknownSecret{}, err)
+
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{RIGHT_READ_SECRET})
+	assert.Nil(err)
+	assert.Nil(h.UpdateUserAccountRights(repoUUID, adminUUID, "password",
+		bobUUID, []string{RIGHT_LIST_SECRET}))
+	assert.Nil(h.SetPolicy(repoUUID, adminUUID, "password", &Policy{
+		Name: "readers",
+		Rules: []*PolicyRule{{Effect: POLICY_EFFECT_ALLOW, Path: "*",
+			Capabilities: []string{CAPABILITY_READ}}}}))
+	assert.Nil(h.SetUserAccountPolicies(repoUUID, adminUUID, "password",
+		bobUUID, []string{"readers"}))
+	assert.Nil(h.ChangeUserPassword(bobUUID, "bob password", "new bob password",
+		""))
+	assert.Nil(h.RemoveUserAccount(repoUUID, adminUUID, "password", bobUUID))
+	assert.Nil(h.DeletePolicy(repoUUID, adminUUID, "password", "readers"))
+	assert.Nil(h.RotateRepositoryKey(repoUUID, adminUUID, "password"))
+
+	entries, err := h.VerifyAuditLog()
+	assert.Nil(err)
+	operations := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		operations = append(operations, entry.Operation)
+	}
+	assert.Equal([]string{
+		AUDIT_OPERATION_CREATE_REPOSITORY,
+		AUDIT_OPERATION_READ_SECRET_VERSION,
+		AUDIT_OPERATION_READ_SECRET_METADATA,
+		AUDIT_OPERATION_WRITE_SECRET,
+		AUDIT_OPERATION_ROLLBACK_SECRET,
+		AUDIT_OPERATION_RENAME_SECRET,
+		AUDIT_OPERATION_DELETE_SECRET,
+		AUDIT_OPERATION_DELETE_SECRET,
+		AUDIT_OPERATION_ADD_USER_ACCOUNT,
+		AUDIT_OPERATION_UPDATE_USER_ACCOUNT_RIGHTS,
+		AUDIT_OPERATION_SET_POLICY,
+		AUDIT_OPERATION_SET_USER_ACCOUNT_POLICIES,
+		AUDIT_OPERATION_CHANGE_USER_PASSWORD,
+		AUDIT_OPERATION_REMOVE_USER_ACCOUNT,
+		AUDIT_OPERATION_DELETE_POLICY,
+		AUDIT_OPERATION_ROTATE_REPOSITORY_KEY}, operations)
+
+	assert.Equal(AUDIT_OUTCOME_FAILURE, entries[7].Outcome)
+	assert.Equal("greeting", entries[7].Secret)
+	assert.Equal(bobUUID, entries[8].Secret)
+	assert.Equal(bobUUID, entries[12].Actor)
+}
+
+func TestAuditedOperationsFailWithoutAuditKey(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	_, revision, err := h.ReadSecretWithRevision(
+		repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+	entries, err := h.VerifyAuditLog()
+	assert.Nil(err)
+	auditKey := h.auditKey
+	h.SetAuditKey(nil)
+
+	_, err = h.ReadSecret(repoUUID, adminUUID, "password", "hello")
+	assert.IsType(&ErrNoAuditKey{}, err)
+	err = h.DeleteSecret(repoUUID, adminUUID, "password", "hello")
+	assert.IsType(&ErrNoAuditKey{}, err)
+	err = h.WriteSecret(repoUUID, adminUUID, "password", "new", []byte("v"),
+		nil)
+	assert.IsType(&ErrNoAuditKey{}, err)
+	err = h.Update(repoUUID, adminUUID, "password", func(tx *RepositoryTx) error {
+		return tx.DeleteSecret("hello")
+	})
+	assert.IsType(&ErrNoAuditKey{}, err)
+	_, err = h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", nil)
+	assert.IsType(&ErrNoAuditKey{}, err)
+	_, err = h.VerifyAuditLog()
+	assert.IsType(&ErrNoAuditKey{}, err)
+
+	// nothing was changed
+	h.SetAuditKey(auditKey)
+	secretValue, newRevision, err := h.ReadSecretWithRevision(
+		repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+	assert.Equal([]byte("Hello World !"), secretValue)
+	assert.Equal(revision, newRevision)
+	newEntries, err := h.VerifyAuditLog()
+	assert.Nil(err)
+	assert.Equal(len(entries)+1, len(newEntries))
+}
+
+func TestAuditedChangeIsNotSavedWhenItsEntryIsNot(t *testing.T) {
+	assert, h, _, _, dataAccess, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	entries, err := h.VerifyAuditLog()
+	assert.Nil(err)
+
+	// no entry can be chained after a corrupted one
+	assert.Nil(dataAccess.SaveAuditEntry(
+		entries[len(entries)-1].Sequence+1, []byte("corrupted")))
+
+	err = h.DeleteSecret(repoUUID, adminUUID, "password", "hello")
+	assert.NotNil(err)
+	err = h.Update(repoUUID, adminUUID, "password", func(tx *RepositoryTx) error {
+		return tx.DeleteSecret("hello")
+	})
+	assert.NotNil(err)
+
+	// the log cannot be appended to anymore, so look at the repository itself
+	repository, repoKey, err := h.openRepository(
+		repoUUID, adminUUID, "password")
+	assert.Nil(err)
+	defer Zero(repoKey)
+	assert.Contains(repository.Secrets, "hello")
+	assert.Equal(uint64(1), repository.Revision)
+}
+
+func TestListOperationsAreAudited(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+
+	_, err = h.ListSecretVersions(repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+	_, err = h.ListExpiringSecrets(repoUUID, adminUUID, "password", 0)
+	assert.Nil(err)
+	_, err = h.ListUserAccounts(repoUUID, adminUUID, "password")
+	assert.Nil(err)
+	_, err = h.ListPolicies(repoUUID, adminUUID, "password")
+	assert.Nil(err)
+	_, err = h.ListRepositoriesForUser(adminUUID, "password", "")
+	assert.Nil(err)
+	_, err = h.ListAPIKeys(repoUUID, adminUUID, "password")
+	assert.Nil(err)
+	_, err = h.ListCertificateBindings(repoUUID, adminUUID, "password")
+	assert.Nil(err)
+	_, err = h.ListSessions(repoUUID, adminUUID, "password")
+	assert.Nil(err)
+	_, err = h.ListLockouts(repoUUID, adminUUID, "password")
+	assert.Nil(err)
+	_, err = h.ListClientLockouts()
+	assert.Nil(err)
+	_, err = h.ListUserAccounts(repoUUID, adminUUID, "wrong password")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+
+	entries, err := h.VerifyAuditLog()
+	assert.Nil(err)
+	operations := []string{}
+	for _, entry := range entries[1:] {
+		operations = append(operations, entry.Operation)
+	}
+	assert.Equal([]string{
+		AUDIT_OPERATION_LIST_SECRET_VERSIONS,
+		AUDIT_OPERATION_LIST_EXPIRING_SECRETS,
+		AUDIT_OPERATION_LIST_USER_ACCOUNTS,
+		AUDIT_OPERATION_LIST_POLICIES,
+		AUDIT_OPERATION_LIST_REPOSITORIES,
+		AUDIT_OPERATION_LIST_API_KEYS,
+		AUDIT_OPERATION_LIST_CERTIFICATE_BINDINGS,
+		AUDIT_OPERATION_LIST_SESSIONS,
+		AUDIT_OPERATION_LIST_LOCKOUTS,
+		AUDIT_OPERATION_LIST_LOCKOUTS,
+		AUDIT_OPERATION_LIST_USER_ACCOUNTS}, operations)
+
+	assert.Equal("hello", entries[1].Secret)
+	assert.Equal(adminUUID, entries[5].Actor)
+	assert.Equal("", entries[5].Repository)
+	assert.Equal(AUDIT_ACTOR_OPERATOR, entries[10].Actor)
+	assert.Equal(AUDIT_OUTCOME_SUCCESS, entries[10].Outcome)
+	assert.Equal(AUDIT_OUTCOME_FAILURE, entries[11].Outcome)
+}
@@ -0,0 +1,373 @@
+package himitsu
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/pagedegeek/himitsu/data_access"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Client certificates authenticate workloads without a password. The
+	server checks the certificate and maps its subject or a SAN, the
+	identity, to a user account. It then asks for a certificate credential,
+	see CertificateCredential, which it passes as userPwd.
+
+	A repository admin binds an identity to a user account of the
+	repository, which stores a copy of the repository key wrapped under a
+	key derived from the identity and the certificate key. The certificate
+	key never reaches the data access, see SetCertificateKey. As for API
+	keys, the wrapped copy is stored as the key of a user account would be,
+	along with a key pair, so that key rotations reach it.
+*/
+
+const (
+	AUDIT_OPERATION_BIND_CERTIFICATE          string = "BindCertificate"
+	AUDIT_OPERATION_UNBIND_CERTIFICATE        string = "UnbindCertificate"
+	AUDIT_OPERATION_LIST_CERTIFICATE_BINDINGS string = "ListCertificateBindings"
+)
+
+const (
+	certificateCredentialPrefix = "hmc"
+	// certificateCredentialTTL bounds the use of a credential to the
+	// request it was made for.
+	certificateCredentialTTL = time.Minute
+)
+
+type CertificateBinding struct {
+	Identity  string    `json:"identity"`
+	UserUUID  string    `json:"user_uuid"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ErrUnknownCertificateBinding struct {
+	identity string
+}
+
+func (e *ErrUnknownCertificateBinding) Error() string {
+	return fmt.Sprintf("Certificate identity '%s' is not bound", e.identity)
+}
+
+type ErrNoCertificateKey struct{}
+
+func (e *ErrNoCertificateKey) Error() string {
+	return "No certificate key set"
+}
+
+// SetCertificateKey sets the key certificate credentials and the wrapping
+// of the certificate bound repository keys derive from. It must be kept
+// apart from the data access, and stay the same across restarts.
+func (h *Himitsu) SetCertificateKey(certificateKey []byte) {
+	h.certificateKey = certificateKey
+}
+
+func (h *Himitsu) certificateMAC(parts ...string) []byte {
+	mac := hmac.New(sha256.New, h.certificateKey)
+	for _, part := range parts {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	return mac.Sum(nil)
+}
+
+// CertificateCredential returns a short lived credential standing for the
+// password of the user account the identity is bound to. It must only be
+// asked for an identity taken from a verified client certificate.
+func (h *Himitsu) CertificateCredential(identity string) (string, error) {
+	if len(h.certificateKey) == 0 {
+		return "", &ErrNoCertificateKey{}
+	}
+
+	expiresAt := strconv.FormatInt(
+		time.Now().Add(certificateCredentialTTL).Unix(), 10)
+	encodedIdentity := base64.RawURLEncoding.EncodeToString([]byte(identity))
+	mac := h.certificateMAC("credential", identity, expiresAt)
+
+	return strings.Join([]string{certificateCredentialPrefix,
+		encodedIdentity, expiresAt,
+		base64.RawURLEncoding.EncodeToString(mac)}, "."), nil
+}
+
+// parseCertificateCredential returns the identity of a certificate
+// credential, ok being false when userPwd is not a live one.
+func (h *Himitsu) parseCertificateCredential(
+	userPwd string) (identity string, ok bool) {
+
+	parts := strings.Split(userPwd, ".")
+	if len(parts) != 4 || parts[0] != certificateCredentialPrefix ||
+		len(h.certificateKey) == 0 {
+		return "", false
+	}
+
+	rawIdentity, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+	expiresAt, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() >= expiresAt {
+		return "", false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", false
+	}
+
+	identity = string(rawIdentity)
+	if !hmac.Equal(mac,
+		h.certificateMAC("credential", identity, parts[2])) {
+		return "", false
+	}
+	return identity, true
+}
+
+// certificateKeySlot is the name the repository key wrapped for the
+// identity is stored under, in place of a user account UUID.
+func certificateKeySlot(identity string) string {
+	identityHash := sha256.Sum256([]byte(identity))
+	return "certificate:" + hex.EncodeToString(identityHash[:])
+}
+
+func (h *Himitsu) deriveCertificateKey(identity string) []byte {
+	return h.certificateMAC("wrap", identity)
+}
+
+// loadRepositoryKeyWithCertificate unwraps the repository key bound to the
+// identity. An unbound identity gives ErrInvalidCredentials.
+func (h *Himitsu) loadRepositoryKeyWithCertificate(
+	userUUID, repoUUID, identity string) ([]byte, error) {
+
+	slot := certificateKeySlot(identity)
+	cipherRepoKey, err := h.dataAccess.ReadCipherRepositoryKey(slot, repoUUID)
+	_, isNotFound := err.(*data_access.ErrRepositoryKeyNotFound)
+	if isNotFound || (err == nil && cipherRepoKey == nil) {
+		return nil, &ErrInvalidCredentials{userUUID: userUUID}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	derivedKey := h.deriveCertificateKey(identity)
+	defer Zero(derivedKey)
+
+	repoKey, err := h.cryptoEngine.Decrypt(cipherRepoKey, derivedKey)
+	if err != nil {
+		return nil, unwrapError(userUUID, err)
+	}
+
+	return h.completePendingRepositoryKeys(
+		slot, repoUUID, repoKey, derivedKey)
+}
+
+// useCertificate checks the identity the repository was opened with is
+// bound to the user account.
+func (r *Repository) useCertificate(userUUID, identity string) error {
+	binding, exists := r.CertificateBindings[identity]
+	if !exists || binding.UserUUID != userUUID {
+		return &ErrInvalidCredentials{userUUID: userUUID}
+	}
+	return nil
+}
+
+func (r *Repository) BindCertificate(
+	userUUID string, binding *CertificateBinding) error {
+
+	if err := r.checkAdminRight(userUUID); err != nil {
+		return err
+	}
+
+	if _, err := r.findUserAccount(binding.UserUUID); err != nil {
+		return err
+	}
+
+	if r.CertificateBindings == nil {
+		r.CertificateBindings = make(map[string]*CertificateBinding)
+	}
+	r.CertificateBindings[binding.Identity] = binding
+
+	return nil
+}
+
+func (r *Repository) UnbindCertificate(userUUID, identity string) error {
+	if err := r.checkAdminRight(userUUID); err != nil {
+		return err
+	}
+
+	if _, exists := r.CertificateBindings[identity]; !exists {
+		return &ErrUnknownCertificateBinding{identity: identity}
+	}
+	delete(r.CertificateBindings, identity)
+
+	return nil
+}
+
+func (r *Repository) ListCertificateBindings(
+	userUUID string) ([]*CertificateBinding, error) {
+
+	if err := r.checkAdminRight(userUUID); err != nil {
+		return nil, err
+	}
+
+	bindings := make([]*CertificateBinding, 0, len(r.CertificateBindings))
+	for _, binding := range r.CertificateBindings {
+		bindingCopy := *binding
+		bindings = append(bindings, &bindingCopy)
+	}
+	sort.Sort(byIdentity(bindings))
+	return bindings, nil
+}
+
+// userAccountCertificateIdentities returns the identities bound to the
+// user account.
+func (r *Repository) userAccountCertificateIdentities(
+	userUUID string) []string {
+
+	identities := make([]string, 0)
+	for identity, binding := range r.CertificateBindings {
+		if binding.UserUUID == userUUID {
+			identities = append(identities, identity)
+		}
+	}
+	return identities
+}
+
+type byIdentity []*CertificateBinding
+
+func (s byIdentity) Len() int           { return len(s) }
+func (s byIdentity) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byIdentity) Less(i, j int) bool { return s[i].Identity < s[j].Identity }
+
+// BindCertificate binds the client certificate identity to the user account,
+// wrapping a copy of the repository key for it. Binding an identity again
+// moves it to the new user account.
+func (h *Himitsu) BindCertificate(repoUUID, userUUID, userPwd,
+	identity, boundUserUUID string) (err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_BIND_CERTIFICATE,
+		userUUID, repoUUID, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	if len(h.certificateKey) == 0 {
+		return &ErrNoCertificateKey{}
+	}
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if err := repository.BindCertificate(userUUID, &CertificateBinding{
+		Identity:  identity,
+		UserUUID:  boundUserUUID,
+		CreatedAt: time.Now().UTC()}); err != nil {
+		return err
+	}
+
+	derivedKey := h.deriveCertificateKey(identity)
+	defer Zero(derivedKey)
+
+	cipherRepoKey, err := h.wrapRepositoryKey(repoKey, derivedKey)
+	if err != nil {
+		return err
+	}
+
+	slot := certificateKeySlot(identity)
+	batch := h.dataAccess.NewBatch()
+	batch.SaveCipherRepositoryKey(slot, repoUUID, cipherRepoKey)
+	// the key pair of an identity bound elsewhere already is kept
+	publicKey, _, err := h.dataAccess.ReadKeyPair(slot)
+	if err != nil {
+		return err
+	}
+	if publicKey == nil {
+		if err := h.batchSaveNewKeyPair(
+			batch, slot, derivedKey); err != nil {
+			return err
+		}
+	}
+	if err := h.batchSaveRepository(batch, repository, repoKey); err != nil {
+		return err
+	}
+
+	return record.commit(batch)
+}
+
+// UnbindCertificate removes the binding from the repository, which is
+// enough to refuse the identity, then its wrapped repository key.
+func (h *Himitsu) UnbindCertificate(
+	repoUUID, userUUID, userPwd, identity string) (err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_UNBIND_CERTIFICATE,
+		userUUID, repoUUID, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if err := repository.UnbindCertificate(userUUID, identity); err != nil {
+		return err
+	}
+
+	batch := h.dataAccess.NewBatch()
+	if err := h.batchSaveRepository(batch, repository, repoKey); err != nil {
+		return err
+	}
+	batch.DeleteCipherRepositoryKey(certificateKeySlot(identity), repoUUID)
+
+	return record.commit(batch)
+}
+
+func (h *Himitsu) ListCertificateBindings(repoUUID, userUUID,
+	userPwd string) (bindings []*CertificateBinding, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_LIST_CERTIFICATE_BINDINGS,
+		userUUID, repoUUID, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			bindings = nil
+		}
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	return repository.ListCertificateBindings(userUUID)
+}
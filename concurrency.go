@@ -0,0 +1,104 @@
+package himitsu
+
+import (
+	"fmt"
+)
+
+// MaxConflictRetries bounds how many times WriteSecret starts over after
+// losing a race against another writer.
+const MaxConflictRetries = 3
+
+type ErrConflict struct {
+	repoUUID string
+}
+
+func (e *ErrConflict) Error() string {
+	return fmt.Sprintf("Repository '%s' was modified concurrently", e.repoUUID)
+}
+
+// ReadSecretWithRevision reads the secret along with the revision of the
+// repository it was read from.
+func (h *Himitsu) ReadSecretWithRevision(repoUUID, userUUID, userPwd,
+	secretName string) (secretValue []byte, revision uint64, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_READ_SECRET,
+		userUUID, repoUUID, secretName)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			secretValue, revision = nil, 0
+		}
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	secretValue, err = repository.ReadSecret(userUUID, secretName)
+	if err != nil {
+		return nil, 0, err
+	}
+	return secretValue, repository.Revision, nil
+}
+
+// WriteSecretIfRevision writes the secret only if the repository is still at
+// revision, and returns its new revision. It fails with ErrConflict
+// otherwise.
+func (h *Himitsu) WriteSecretIfRevision(repoUUID, userUUID, userPwd,
+	secretName string, secretValue []byte, opts *WriteSecretOptions,
+	revision uint64) (newRevision uint64, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_WRITE_SECRET,
+		userUUID, repoUUID, secretName)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			newRevision = 0
+		}
+	}()
+
+	return h.writeSecret(record, repoUUID, userUUID, userPwd, secretName,
+		secretValue, opts, &revision)
+}
+
+func (h *Himitsu) writeSecret(record *auditRecord,
+	repoUUID, userUUID, userPwd, secretName string,
+	secretValue []byte, opts *WriteSecretOptions,
+	expectedRevision *uint64) (uint64, error) {
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return 0, err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if expectedRevision != nil && repository.Revision != *expectedRevision {
+		return 0, &ErrConflict{repoUUID: repoUUID}
+	}
+
+	if err := repository.WriteSecret(
+		userUUID, secretName, secretValue, opts); err != nil {
+		return 0, err
+	}
+
+	if err := record.saveRepository(repository, repoKey); err != nil {
+		return 0, err
+	}
+	return repository.Revision, nil
+}
@@ -0,0 +1,71 @@
+package himitsu
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestWriteSecretIfRevision(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	_, revision, err := h.ReadSecretWithRevision(
+		repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+
+	newRevision, err := h.WriteSecretIfRevision(repoUUID, adminUUID,
+		"password", "hello", []byte("first"), nil, revision)
+	assert.Nil(err)
+	assert.Equal(revision+1, newRevision)
+
+	// a writer still at the former revision loses
+	newRevision, err = h.WriteSecretIfRevision(repoUUID, adminUUID,
+		"password", "hello", []byte("second"), nil, revision)
+	assert.IsType(&ErrConflict{}, err)
+	assert.Equal(uint64(0), newRevision)
+
+	secret, currentRevision, err := h.ReadSecretWithRevision(
+		repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+	assert.Equal([]byte("first"), secret)
+	assert.Equal(revision+1, currentRevision)
+
+	// any save moves the revision, whatever the secret
+	assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", "other",
+		[]byte("other"), nil))
+	_, err = h.WriteSecretIfRevision(repoUUID, adminUUID,
+		"password", "hello", []byte("second"), nil, currentRevision)
+	assert.IsType(&ErrConflict{}, err)
+}
+
+func TestConcurrentWritesAreAllKept(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+
+	// each writer loses at most once to every other one
+	writers := MaxConflictRetries + 1
+	var wg sync.WaitGroup
+	errs := make([]error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = h.WriteSecret(repoUUID, adminUUID, "password",
+				fmt.Sprintf("secret-%d", i), []byte("value"), nil)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < writers; i++ {
+		assert.Nil(errs[i])
+		_, err := h.ReadSecret(repoUUID, adminUUID, "password",
+			fmt.Sprintf("secret-%d", i))
+		assert.Nil(err)
+	}
+}
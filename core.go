@@ -2,6 +2,7 @@ package himitsu
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/gob"
 	"fmt"
 	"github.com/pagedegeek/himitsu/crypto_engine"
@@ -10,6 +11,9 @@ import (
 	"github.com/pagedegeek/himitsu/salt_generation"
 	"github.com/pagedegeek/himitsu/uuid_generation"
 	"reflect"
+	"sort"
+	"sync"
+	"time"
 )
 
 type Himitsu struct {
@@ -18,8 +22,27 @@ type Himitsu struct {
 	passwordDerivator password_derivation.PasswordDerivator
 	cryptoEngine      crypto_engine.CryptoEngine
 	dataAccess        data_access.DataAccess
+	maxSecretVersions int
+	auditKey          []byte
+	auditMutex        sync.Mutex
+	sessionTTL        time.Duration
+	sessions          *sessionStore
+	certificateKey    []byte
+	lockoutPolicy     LockoutPolicy
+	passwordPolicy    PasswordPolicy
+
+	// legacyPasswordDerivator derives the bare salts, nil for
+	// passwordDerivator
+	legacyPasswordDerivator password_derivation.PasswordDerivator
+	// derivations holds a token for each password derivation running, see
+	// SetMaxConcurrentDerivations
+	derivations chan struct{}
 }
 
+// DefaultMaxConcurrentDerivations bounds the password derivations running
+// at once, an Argon2id derivation taking 64 MiB.
+const DefaultMaxConcurrentDerivations int = 4
+
 func NewHimitsu(
 	saltGenerator salt_generation.SaltGenerator,
 	uuidGenerator uuid_generation.UUIDGenerator,
@@ -33,9 +56,41 @@ func NewHimitsu(
 		passwordDerivator: passwordDerivator,
 		cryptoEngine:      cryptoEngine,
 		dataAccess:        dataAccess,
+		maxSecretVersions: DefaultMaxSecretVersions,
+		sessionTTL:        DefaultSessionTTL,
+		sessions:          newSessionStore(),
+		lockoutPolicy:     DefaultLockoutPolicy,
+		passwordPolicy:    DefaultPasswordPolicy,
+		derivations: make(
+			chan struct{}, DefaultMaxConcurrentDerivations),
 	}
 }
 
+// SetMaxConcurrentDerivations sets how many password derivations may run at
+// once, unknown user accounts included. The others wait for their turn. It
+// must be called before any derivation.
+func (h *Himitsu) SetMaxConcurrentDerivations(maxConcurrentDerivations int) {
+	h.derivations = make(chan struct{}, maxConcurrentDerivations)
+}
+
+// derivePassword derives the password with the derivator once fewer than
+// the maximum of derivations run, see SetMaxConcurrentDerivations.
+func (h *Himitsu) derivePassword(
+	passwordDerivator password_derivation.PasswordDerivator,
+	userPwd string, salt []byte) []byte {
+
+	h.derivations <- struct{}{}
+	defer func() { <-h.derivations }()
+
+	return passwordDerivator.Call([]byte(userPwd), salt)
+}
+
+// SetMaxSecretVersions sets how many versions of each secret are kept in
+// the repository history, the current one included.
+func (h *Himitsu) SetMaxSecretVersions(maxSecretVersions int) {
+	h.maxSecretVersions = maxSecretVersions
+}
+
 func Zero(in []byte) {
 	for i := 0; i < 1000; i++ {
 
@@ -54,24 +109,168 @@ func Clear(v interface{}) {
 	p.Set(reflect.Zero(p.Type()))
 }
 
-func (h *Himitsu) loadRepositoryKey(userUUID, userPwd string) ([]byte, error) {
-	userSalt, err := h.dataAccess.ReadUserAccountSalt(userUUID)
+func (h *Himitsu) deriveUserPassword(
+	userUUID, userPwd string) ([]byte, error) {
+
+	if err := h.checkLockout(
+		lockoutSubjectUserAccount + userUUID); err != nil {
+		return nil, err
+	}
+
+	encodedUserSalt, err := h.dataAccess.ReadUserAccountSalt(userUUID)
+	_, isNotFound := err.(*data_access.ErrUserAccountNotFound)
+	if isNotFound {
+		// do the same work as for a wrong password of a user account
+		// enrolled now, so that unknown user accounts cannot be told apart
+		encodedUserSalt = password_derivation.EncodeSalt(
+			h.passwordDerivator, fakeUserSalt(userUUID))
+	} else if err != nil {
+		return nil, err
+	}
+
+	// each user account is derived with the parameters it enrolled with
+	passwordDerivator, userSalt, err := password_derivation.DecodeSalt(
+		encodedUserSalt)
 	if err != nil {
 		return nil, err
 	}
+	if passwordDerivator == nil {
+		passwordDerivator = h.bareSaltDerivator()
+	} else {
+		defer passwordDerivator.Close()
+	}
 
-	derivedUserPwd := h.passwordDerivator.Call([]byte(userPwd), userSalt)
-	defer Zero(derivedUserPwd)
+	derivedUserPwd := h.derivePassword(passwordDerivator, userPwd, userSalt)
+	if isNotFound {
+		Zero(derivedUserPwd)
+		return nil, h.failedUnwrap(lockoutSubjectUserAccount+userUUID,
+			&ErrInvalidCredentials{userUUID: userUUID})
+	}
+	return derivedUserPwd, nil
+}
+
+// bareSaltDerivator returns the derivator of the salts stored
+// without their parameters, see SetLegacyPasswordDerivator.
+func (h *Himitsu) bareSaltDerivator() password_derivation.PasswordDerivator {
+	if h.legacyPasswordDerivator != nil {
+		return h.legacyPasswordDerivator
+	}
+	return h.passwordDerivator
+}
 
-	cipherRepoKey, err := h.dataAccess.ReadCipherRepositoryKey(userUUID)
+// fakeUserSalt stands for the salt of an unknown user account. It is the
+// same on each attempt, as a real salt would be.
+func fakeUserSalt(userUUID string) []byte {
+	fakeSalt := sha256.Sum256([]byte("himitsu fake salt\x00" + userUUID))
+	return fakeSalt[:]
+}
+
+// SetLegacyPasswordDerivator sets the derivator of the salts stored without
+// their algorithm and parameters, that is before they were stored, or by a
+// derivator without parameters. It defaults to the one given to NewHimitsu.
+func (h *Himitsu) SetLegacyPasswordDerivator(
+	legacyPasswordDerivator password_derivation.PasswordDerivator) {
+
+	h.legacyPasswordDerivator = legacyPasswordDerivator
+}
+
+func (h *Himitsu) unwrapRepositoryKey(
+	userUUID, repoUUID string, derivedUserPwd []byte) ([]byte, error) {
+
+	cipherRepoKey, err := h.dataAccess.ReadCipherRepositoryKey(
+		userUUID, repoUUID)
 	if err != nil {
 		return nil, err
 	}
+	if cipherRepoKey == nil {
+		return h.migrateLegacyRepositoryKey(
+			userUUID, repoUUID, derivedUserPwd)
+	}
 
 	repoKey, err := h.cryptoEngine.Decrypt(cipherRepoKey, derivedUserPwd)
+	if err != nil {
+		return nil, h.passwordUnwrapError(userUUID, err)
+	}
+
+	return h.completePendingRepositoryKeys(
+		userUUID, repoUUID, repoKey, derivedUserPwd)
+}
+
+func (h *Himitsu) wrapRepositoryKey(
+	repoKey, derivedUserPwd []byte) ([]byte, error) {
+
+	repoKeyIV, err := h.saltGenerator.Call(16)
 	if err != nil {
 		return nil, err
 	}
+	return h.cryptoEngine.Encrypt(repoKey, derivedUserPwd, repoKeyIV)
+}
+
+// loadRepositoryKey returns the repository key of the user account, from
+// its session when userPwd is a session token, see Login, or unwrapped with
+// the API key or certificate credential when it is one, see CreateAPIKey
+// and CertificateCredential.
+func (h *Himitsu) loadRepositoryKey(
+	userUUID, repoUUID, userPwd string) ([]byte, error) {
+
+	if repoKey := h.sessions.repositoryKey(
+		userUUID, repoUUID, userPwd); repoKey != nil {
+		return repoKey, nil
+	}
+	if apiKeyID, secret, ok := parseAPIKey(userPwd); ok {
+		defer Zero(secret)
+		return h.loadRepositoryKeyWithAPIKey(
+			userUUID, repoUUID, apiKeyID, secret)
+	}
+	if identity, ok := h.parseCertificateCredential(userPwd); ok {
+		return h.loadRepositoryKeyWithCertificate(
+			userUUID, repoUUID, identity)
+	}
+	return h.loadRepositoryKeyWithPassword(userUUID, repoUUID, userPwd, "")
+}
+
+// isPassword tells whether userPwd is the password of the user account
+// rather than one of the credentials loadRepositoryKey takes in its place.
+func (h *Himitsu) isPassword(userUUID, repoUUID, userPwd string) bool {
+	if repoKey := h.sessions.repositoryKey(
+		userUUID, repoUUID, userPwd); repoKey != nil {
+		Zero(repoKey)
+		return false
+	}
+	if _, _, ok := parseAPIKey(userPwd); ok {
+		return false
+	}
+	_, ok := h.parseCertificateCredential(userPwd)
+	return !ok
+}
+
+// loadRepositoryKeyWithPassword unwraps the repository key with the
+// password of the user account and, when it is enrolled, its TOTP code, see
+// EnrollTOTP.
+func (h *Himitsu) loadRepositoryKeyWithPassword(
+	userUUID, repoUUID, userPwd, totpCode string) ([]byte, error) {
+
+	derivedUserPwd, err := h.deriveUserPassword(userUUID, userPwd)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(derivedUserPwd)
+
+	repoKey, err := h.unwrapRepositoryKey(userUUID, repoUUID, derivedUserPwd)
+	if _, isNotFound := err.(*data_access.ErrRepositoryKeyNotFound); isNotFound {
+		// nothing to check the password against: without a key for the
+		// repository, a user account cannot be told apart from an unknown one
+		return nil, h.failedUnwrap(lockoutSubjectUserAccount+userUUID,
+			&ErrInvalidCredentials{userUUID: userUUID})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.checkTOTP(userUUID, derivedUserPwd, totpCode); err != nil {
+		Zero(repoKey)
+		return nil, err
+	}
 	return repoKey, nil
 }
 
@@ -85,121 +284,210 @@ func (h *Himitsu) loadRepository(
 
 	encodedRepo, err := h.cryptoEngine.Decrypt(cipherRepo, repoKey)
 	if err != nil {
-		return nil, err
+		return nil, &ErrIntegrity{err: err}
 	}
 	defer Zero(encodedRepo)
 
-	b := bytes.NewBuffer(encodedRepo)
-	defer b.Reset()
-	repository := &Repository{}
-
-	dec := gob.NewDecoder(b)
-	if err := dec.Decode(repository); err != nil {
-		return nil, err
+	repository, err := decodeRepository(encodedRepo)
+	if err != nil {
+		return nil, &ErrIntegrity{err: err}
 	}
+	repository.maxSecretVersions = h.maxSecretVersions
 
 	return repository, nil
 }
 
-func (h *Himitsu) WriteSecret(
-	repoUUID, userUUID, userPwd, secretName string, secretValue []byte) error {
+func (h *Himitsu) openRepository(
+	repoUUID, userUUID, userPwd string) (*Repository, []byte, error) {
 
-	repoKey, err := h.loadRepositoryKey(userUUID, userPwd)
+	repoKey, err := h.loadRepositoryKey(userUUID, repoUUID, userPwd)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer Zero(repoKey)
 
 	repository, err := h.loadRepository(repoUUID, repoKey)
 	if err != nil {
-		return err
+		Zero(repoKey)
+		return nil, nil, err
 	}
-	defer func() {
+
+	if apiKeyID, _, ok := parseAPIKey(userPwd); ok {
+		err = repository.useAPIKey(userUUID, apiKeyID)
+	} else if identity, ok := h.parseCertificateCredential(userPwd); ok {
+		err = repository.useCertificate(userUUID, identity)
+	} else if h.isPassword(userUUID, repoUUID, userPwd) {
+		err = h.clearFailedUnwraps(lockoutSubjectUserAccount + userUUID)
+	}
+	if err != nil {
+		Zero(repoKey)
 		Clear(repository)
-		repository = nil
-	}()
+		return nil, nil, err
+	}
+	return repository, repoKey, nil
+}
 
-	if err := repository.WriteSecret(userUUID, secretName, secretValue); err != nil {
+// WriteSecret writes the secret, starting over from the stored repository
+// when another writer saved it in between, up to MaxConflictRetries times.
+func (h *Himitsu) WriteSecret(repoUUID, userUUID, userPwd, secretName string,
+	secretValue []byte, opts *WriteSecretOptions) (err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_WRITE_SECRET,
+		userUUID, repoUUID, secretName)
+	if err != nil {
 		return err
 	}
+	defer func() {
+		err = record.end(err)
+	}()
 
-	return h.saveRepository(repository, repoKey)
+	for retry := 0; ; retry++ {
+		_, err = h.writeSecret(record, repoUUID, userUUID, userPwd,
+			secretName, secretValue, opts, nil)
+		if _, isConflict := err.(*ErrConflict); !isConflict ||
+			retry == MaxConflictRetries {
+			return err
+		}
+	}
 }
 
 func (h *Himitsu) ReadSecret(
 	repoUUID, userUUID, userPwd, secretName string) ([]byte, error) {
 
-	repoKey, err := h.loadRepositoryKey(userUUID, userPwd)
+	secretValue, _, err := h.ReadSecretWithRevision(
+		repoUUID, userUUID, userPwd, secretName)
+	return secretValue, err
+}
+
+// ListSecretNames lists the secrets under the prefix folder, see
+// listSecretPaths.
+func (h *Himitsu) ListSecretNames(repoUUID, userUUID, userPwd, prefix string,
+	recursive bool) (secretNames []string, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_LIST_SECRET_NAMES,
+		userUUID, repoUUID, prefix)
 	if err != nil {
 		return nil, err
 	}
-	defer Zero(repoKey)
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			secretNames = nil
+		}
+	}()
 
-	repository, err := h.loadRepository(repoUUID, repoKey)
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
 	if err != nil {
 		return nil, err
 	}
+	defer Zero(repoKey)
 	defer func() {
 		Clear(repository)
 		repository = nil
 	}()
 
-	return repository.ReadSecret(userUUID, secretName)
+	return repository.ListSecretNames(userUUID, prefix, recursive)
 }
 
-func (h *Himitsu) ListSecretNames(
-	repoUUID, userUUID, userPwd string) ([]string, error) {
+func (h *Himitsu) DeleteSecret(
+	repoUUID, userUUID, userPwd, secretName string) (err error) {
 
-	repoKey, err := h.loadRepositoryKey(userUUID, userPwd)
+	record, err := h.beginAudit(AUDIT_OPERATION_DELETE_SECRET,
+		userUUID, repoUUID, secretName)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer Zero(repoKey)
+	defer func() {
+		err = record.end(err)
+	}()
 
-	repository, err := h.loadRepository(repoUUID, repoKey)
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer Zero(repoKey)
 	defer func() {
 		Clear(repository)
 		repository = nil
 	}()
 
-	return repository.ListSecretNames(userUUID)
+	if err := repository.DeleteSecret(userUUID, secretName); err != nil {
+		return err
+	}
+
+	return record.saveRepository(repository, repoKey)
 }
 
-func (h *Himitsu) CreateRepository(
-	repoLabel, userLabel, userPwd string) (string, string, error) {
+func (h *Himitsu) RenameSecret(repoUUID, userUUID, userPwd,
+	secretName, newSecretName string) (err error) {
 
-	userAccountSalt, err := h.saltGenerator.Call(32)
+	record, err := h.beginAudit(AUDIT_OPERATION_RENAME_SECRET,
+		userUUID, repoUUID, secretName)
 	if err != nil {
-		return "", "", err
+		return err
 	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if err := repository.RenameSecret(
+		userUUID, secretName, newSecretName); err != nil {
+		return err
+	}
+
+	return record.saveRepository(repository, repoKey)
+}
+
+func (h *Himitsu) CreateRepository(repoLabel, userLabel, userPwd string) (
+	repoUUID string, adminUUID string, err error) {
 
 	admin := &UserAccount{
-		UUID:                 h.uuidGenerator.Call(),
-		Label:                userLabel,
-		CanReadSecret:        true,
-		CanWriteSecret:       true,
-		CanAdminUserAccounts: true}
+		UUID:  h.uuidGenerator.Call(),
+		Label: userLabel}
+	auditRepoUUID := h.uuidGenerator.Call()
 
-	err = h.dataAccess.SaveUserAccountSalt(admin.UUID, userAccountSalt)
+	record, err := h.beginAudit(AUDIT_OPERATION_CREATE_REPOSITORY,
+		admin.UUID, auditRepoUUID, "")
 	if err != nil {
 		return "", "", err
 	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			repoUUID, adminUUID = "", ""
+		}
+	}()
+
+	if err := h.passwordPolicy.Check(userPwd); err != nil {
+		return "", "", err
+	}
 
 	repo := &Repository{
-		UUID:         h.uuidGenerator.Call(),
+		UUID:         auditRepoUUID,
 		Label:        repoLabel,
 		UserAccounts: map[string]*UserAccount{admin.UUID: admin},
-		Secrets:      make(map[string][]byte)}
+		Secrets:      make(map[string]*Secret),
+		Policies:     make(map[string]*Policy),
+
+		maxSecretVersions: h.maxSecretVersions}
+	repo.applyRights(admin, []string{CAPABILITY_DELETE, CAPABILITY_LIST,
+		CAPABILITY_READ, CAPABILITY_RENAME, CAPABILITY_WRITE}, true)
 
 	defer func() {
 		Clear(repo)
 		repo = nil
 	}()
 
-	repo.Secrets["hello"] = []byte("Hello World !")
+	repo.writeSecret(admin.UUID, "hello", []byte("Hello World !"), nil)
 
 	repositoryKey, err := h.saltGenerator.Call(32)
 	if err != nil {
@@ -207,66 +495,451 @@ func (h *Himitsu) CreateRepository(
 	}
 	defer Zero(repositoryKey)
 
-	derivedUserPwd := h.passwordDerivator.Call(
-		[]byte(userPwd), userAccountSalt)
+	batch := h.dataAccess.NewBatch()
+	if err := h.createUserAccountCredentials(batch,
+		admin.UUID, userPwd, repo.UUID, repositoryKey); err != nil {
+		return "", "", err
+	}
+
+	if err := h.batchSaveRepository(batch, repo, repositoryKey); err != nil {
+		return "", "", err
+	}
+
+	if err := record.commit(batch); err != nil {
+		return "", "", err
+	}
+
+	return repo.UUID, admin.UUID, nil
+}
+
+// createUserAccountCredentials generates a fresh salt and key pair for a new
+// user account and adds them, along with the repository key wrapped under
+// the user's derived password, to the batch.
+func (h *Himitsu) createUserAccountCredentials(batch data_access.Batch,
+	userUUID, userPwd, repoUUID string, repositoryKey []byte) error {
+
+	userAccountSalt, err := h.saltGenerator.Call(32)
+	if err != nil {
+		return err
+	}
+
+	derivedUserPwd := h.derivePassword(
+		h.passwordDerivator, userPwd, userAccountSalt)
 	defer Zero(derivedUserPwd)
 
-	repositoryKeyIV, err := h.saltGenerator.Call(16)
+	cipherRepositoryKey, err := h.wrapRepositoryKey(
+		repositoryKey, derivedUserPwd)
 	if err != nil {
-		return "", "", err
+		return err
 	}
-	cipherRepositoryKey, err := h.cryptoEngine.Encrypt(repositoryKey,
-		derivedUserPwd, repositoryKeyIV)
+
+	batch.SaveUserAccountCredentials(userUUID,
+		password_derivation.EncodeSalt(h.passwordDerivator, userAccountSalt),
+		map[string][]byte{repoUUID: cipherRepositoryKey}, nil)
+	return h.batchSaveNewKeyPair(batch, userUUID, derivedUserPwd)
+}
+
+// saveUserAccountRepositoryKey adds the repository key wrapped under the
+// derived password of an existing user account to the batch.
+func (h *Himitsu) saveUserAccountRepositoryKey(batch data_access.Batch,
+	userUUID, userPwd, repoUUID string, repositoryKey []byte) error {
+
+	derivedUserPwd, err := h.deriveUserPassword(userUUID, userPwd)
 	if err != nil {
-		return "", "", err
+		return err
 	}
+	defer Zero(derivedUserPwd)
 
-	if err := h.dataAccess.SaveCipherRepositoryKey(admin.UUID,
-		cipherRepositoryKey); err != nil {
-		return "", "", err
+	cipherRepositoryKey, err := h.wrapRepositoryKey(
+		repositoryKey, derivedUserPwd)
+	if err != nil {
+		return err
 	}
 
-	if err := h.saveRepository(repo, repositoryKey); err != nil {
-		return "", "", err
+	batch.SaveCipherRepositoryKey(userUUID, repoUUID, cipherRepositoryKey)
+	return nil
+}
+
+// ChangeUserPassword re-wraps every repository key of the user account,
+// legacy one included, its private key and its TOTP record under a fresh
+// salt and the new password. It takes a TOTP code when the user account is
+// enrolled, see EnrollTOTP.
+func (h *Himitsu) ChangeUserPassword(
+	userUUID, oldPwd, newPwd, totpCode string) (err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_CHANGE_USER_PASSWORD,
+		userUUID, "", "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	if err := h.passwordPolicy.Check(newPwd); err != nil {
+		return err
 	}
 
-	return repo.UUID, admin.UUID, nil
+	derivedOldPwd, err := h.deriveUserPassword(userUUID, oldPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(derivedOldPwd)
+
+	repoUUIDs, err := h.dataAccess.ListRepositoryUUIDs(userUUID)
+	if err != nil {
+		return err
+	}
+
+	repoKeys := make(map[string][]byte)
+	defer func() {
+		for _, repoKey := range repoKeys {
+			Zero(repoKey)
+		}
+	}()
+	for _, repoUUID := range repoUUIDs {
+		repoKey, err := h.unwrapRepositoryKey(
+			userUUID, repoUUID, derivedOldPwd)
+		if err != nil {
+			return err
+		}
+		repoKeys[repoUUID] = repoKey
+	}
+
+	legacyRepoKey, err := h.unwrapLegacyRepositoryKey(
+		userUUID, derivedOldPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(legacyRepoKey)
+
+	if len(repoKeys) == 0 && legacyRepoKey == nil {
+		// the password could not be checked
+		return &ErrInvalidCredentials{userUUID: userUUID}
+	}
+
+	if err := h.checkTOTP(userUUID, derivedOldPwd, totpCode); err != nil {
+		return err
+	}
+
+	userAccountSalt, err := h.saltGenerator.Call(32)
+	if err != nil {
+		return err
+	}
+
+	derivedNewPwd := h.derivePassword(
+		h.passwordDerivator, newPwd, userAccountSalt)
+	defer Zero(derivedNewPwd)
+
+	cipherRepoKeys := make(map[string][]byte)
+	for repoUUID, repoKey := range repoKeys {
+		cipherRepoKey, err := h.wrapRepositoryKey(repoKey, derivedNewPwd)
+		if err != nil {
+			return err
+		}
+		cipherRepoKeys[repoUUID] = cipherRepoKey
+	}
+
+	var legacyCipherRepoKey []byte
+	if legacyRepoKey != nil {
+		legacyCipherRepoKey, err = h.wrapRepositoryKey(
+			legacyRepoKey, derivedNewPwd)
+		if err != nil {
+			return err
+		}
+	}
+
+	batch := h.dataAccess.NewBatch()
+	batch.SaveUserAccountCredentials(userUUID,
+		password_derivation.EncodeSalt(h.passwordDerivator, userAccountSalt),
+		cipherRepoKeys, legacyCipherRepoKey)
+	if err := h.batchRewrapKeyPair(batch,
+		userUUID, derivedOldPwd, derivedNewPwd); err != nil {
+		return err
+	}
+	if err := h.batchRewrapTOTP(batch,
+		userUUID, derivedOldPwd, derivedNewPwd); err != nil {
+		return err
+	}
+	if err := record.commit(batch); err != nil {
+		return err
+	}
+
+	h.revokeUserAccountSessions("", userUUID)
+	return nil
 }
 
-func (h *Himitsu) saveRepository(
-	repository *Repository, repositoryKey []byte) error {
+func (h *Himitsu) AddUserAccount(
+	repoUUID, userUUID, userPwd, newUserLabel, newUserPwd string,
+	rights []string) (newUserUUID string, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_ADD_USER_ACCOUNT,
+		userUUID, repoUUID, "")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			newUserUUID = ""
+		}
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return "", err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if err := h.passwordPolicy.Check(newUserPwd); err != nil {
+		return "", err
+	}
+
+	newUserAccount := &UserAccount{
+		UUID:  h.uuidGenerator.Call(),
+		Label: newUserLabel}
+
+	if err := repository.AddUserAccount(
+		userUUID, newUserAccount, rights); err != nil {
+		return "", err
+	}
+
+	batch := h.dataAccess.NewBatch()
+	if err := h.createUserAccountCredentials(batch, newUserAccount.UUID,
+		newUserPwd, repoUUID, repoKey); err != nil {
+		return "", err
+	}
+
+	if err := h.batchSaveRepository(batch, repository, repoKey); err != nil {
+		return "", err
+	}
+
+	record.secretName = newUserAccount.UUID
+	if err := record.commit(batch); err != nil {
+		return "", err
+	}
+
+	return newUserAccount.UUID, nil
+}
+
+// RemoveUserAccount removes the user account from the repository along
+// with its API keys and certificate bindings, and drops their wrapped keys.
+// As the user account may have kept the repository key, the repository key
+// is rotated in the same batch, see RotateRepositoryKey.
+func (h *Himitsu) RemoveUserAccount(
+	repoUUID, userUUID, userPwd, targetUserUUID string) (err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_REMOVE_USER_ACCOUNT,
+		userUUID, repoUUID, targetUserUUID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	apiKeyIDs := repository.serviceAccountAPIKeyIDs(targetUserUUID)
+	keySlots := append([]string{targetUserUUID}, apiKeyIDs...)
+	for _, identity := range repository.userAccountCertificateIdentities(
+		targetUserUUID) {
+		keySlots = append(keySlots, certificateKeySlot(identity))
+	}
+	if err := repository.RemoveUserAccount(
+		userUUID, targetUserUUID); err != nil {
+		return err
+	}
+
+	batch := h.dataAccess.NewBatch()
+	for _, keySlot := range keySlots {
+		batch.DeleteCipherRepositoryKey(keySlot, repoUUID)
+	}
+	for _, apiKeyID := range apiKeyIDs {
+		batch.DeleteKeyPair(apiKeyID)
+	}
+
+	newRepoKey, err := h.batchRotateRepositoryKey(
+		batch, repository, repoKey, userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(newRepoKey)
+
+	if err := h.batchSaveRepository(
+		batch, repository, newRepoKey); err != nil {
+		return err
+	}
+	batch.DeleteUnusedUserAccountSalt(targetUserUUID)
+
+	if err := record.commit(batch); err != nil {
+		return err
+	}
+
+	h.revokeRepositorySessions(repoUUID)
+	return nil
+}
+
+func (h *Himitsu) UpdateUserAccountRights(
+	repoUUID, userUUID, userPwd, targetUserUUID string,
+	rights []string) (err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_UPDATE_USER_ACCOUNT_RIGHTS,
+		userUUID, repoUUID, targetUserUUID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if err := repository.UpdateUserAccountRights(
+		userUUID, targetUserUUID, rights); err != nil {
+		return err
+	}
+
+	return record.saveRepository(repository, repoKey)
+}
+
+func (h *Himitsu) ListUserAccounts(repoUUID, userUUID, userPwd string) (
+	userAccounts []*UserAccount, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_LIST_USER_ACCOUNTS,
+		userUUID, repoUUID, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			userAccounts = nil
+		}
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	return repository.ListUserAccounts(userUUID)
+}
+
+// sealRepository moves the repository to its next revision and encrypts it.
+func (h *Himitsu) sealRepository(
+	repository *Repository, repositoryKey []byte) ([]byte, error) {
+
+	repository.Revision++
 
 	var encodedRepository bytes.Buffer
 	defer encodedRepository.Reset()
 	enc := gob.NewEncoder(&encodedRepository)
 	if err := enc.Encode(repository); err != nil {
-		return err
+		return nil, err
 	}
 
 	repositoryIV, err := h.saltGenerator.Call(16)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	cipherRepository, err := h.cryptoEngine.Encrypt(
+	return h.cryptoEngine.Encrypt(
 		encodedRepository.Bytes(), repositoryKey, repositoryIV)
+}
+
+// saveRepository stores the repository at its next revision, unless another
+// writer stored that revision first.
+func (h *Himitsu) saveRepository(
+	repository *Repository, repositoryKey []byte) error {
+
+	cipherRepository, err := h.sealRepository(repository, repositoryKey)
+	if err != nil {
+		return err
+	}
+
+	return conflictError(h.dataAccess.SaveCipherRepositoryIfRevision(
+		repository.UUID, cipherRepository, repository.Revision-1),
+		repository.UUID)
+}
+
+// batchSaveRepository adds saving the repository, as saveRepository does, to
+// the batch.
+func (h *Himitsu) batchSaveRepository(batch data_access.Batch,
+	repository *Repository, repositoryKey []byte) error {
+
+	cipherRepository, err := h.sealRepository(repository, repositoryKey)
 	if err != nil {
 		return err
 	}
 
-	return h.dataAccess.SaveCipherRepository(
-		repository.UUID, cipherRepository)
+	batch.SaveCipherRepositoryIfRevision(
+		repository.UUID, cipherRepository, repository.Revision-1)
+	return nil
+}
+
+func (h *Himitsu) commitBatch(batch data_access.Batch, repoUUID string) error {
+	return conflictError(batch.Commit(), repoUUID)
+}
+
+func conflictError(err error, repoUUID string) error {
+	switch err.(type) {
+	case *data_access.ErrRevisionConflict,
+		*data_access.ErrPendingRepositoryKeysChanged:
+		return &ErrConflict{repoUUID: repoUUID}
+	}
+	return err
 }
 
 type Repository struct {
 	UUID         string                  `json:"uuid"`
 	Label        string                  `json:"label"`
 	UserAccounts map[string]*UserAccount `json:"user_accounts"`
-	Secrets      map[string][]byte       `json:"secrets"`
+	Secrets      map[string]*Secret      `json:"secrets"`
+	Policies     map[string]*Policy      `json:"policies"`
+	Revision     uint64                  `json:"revision"`
+	APIKeys      map[string]*APIKey      `json:"api_keys"`
+
+	CertificateBindings map[string]*CertificateBinding `json:"certificate_bindings"`
+	Invitations         map[string]*Invitation         `json:"invitations"`
+
+	maxSecretVersions int
+	// apiKey is the API key the repository was opened with, if any, see
+	// useAPIKey.
+	apiKey *APIKey
 }
 
 const (
-	RIGHT_READ_SECRET  string = "ReadSecret"
-	RIGHT_WRITE_SECRET string = "WriteSecret"
+	RIGHT_READ_SECRET         string = "ReadSecret"
+	RIGHT_WRITE_SECRET        string = "WriteSecret"
+	RIGHT_LIST_SECRET         string = "ListSecret"
+	RIGHT_DELETE_SECRET       string = "DeleteSecret"
+	RIGHT_RENAME_SECRET       string = "RenameSecret"
+	RIGHT_ADMIN_USER_ACCOUNTS string = "AdminUserAccounts"
 )
 
 type ErrUnknownRight struct {
@@ -278,39 +951,48 @@ func (e *ErrUnknownRight) Error() string {
 }
 
 type ErrUserAccountHasNoRight struct {
-	userUUID  string
-	rightName string
+	userUUID   string
+	rightName  string
+	secretName string
 }
 
 func (e *ErrUserAccountHasNoRight) Error() string {
+	if e.secretName != "" {
+		return fmt.Sprintf("UserAccount '%s' has no right '%s' on '%s'",
+			e.userUUID, e.rightName, e.secretName)
+	}
 	return fmt.Sprintf("UserAccount '%s' has no right '%s'",
 		e.userUUID, e.rightName)
 }
 
+// checkRight checks the right of the user account on the secret, through its
+// policies. The admin right does not depend on any secret.
 func (r *Repository) checkRight(
-	userAccount *UserAccount, rightName string) (err error) {
+	userAccount *UserAccount, rightName, secretName string) (err error) {
 	var userHasRight bool = false
 
 	switch rightName {
-	case RIGHT_READ_SECRET:
-		userHasRight = userAccount.CanReadSecret
-	case RIGHT_WRITE_SECRET:
-		userHasRight = userAccount.CanWriteSecret
+	case RIGHT_ADMIN_USER_ACCOUNTS:
+		userHasRight = userAccount.CanAdminUserAccounts && r.apiKey == nil
 	default:
-		return &ErrUnknownRight{rightName: rightName}
+		capability, exists := rightCapabilities[rightName]
+		if !exists {
+			return &ErrUnknownRight{rightName: rightName}
+		}
+		userHasRight = r.isAllowed(userAccount, capability, secretName)
 	}
 
 	if userHasRight {
 		return nil
 	}
-	return &ErrUserAccountHasNoRight{
-		userUUID: userAccount.UUID, rightName: rightName}
+	return &ErrUserAccountHasNoRight{userUUID: userAccount.UUID,
+		rightName: rightName, secretName: secretName}
 }
 
 func (r *Repository) findUserAccount(userUUID string) (*UserAccount, error) {
 	userAccount, exists := r.UserAccounts[userUUID]
 	if !exists {
-		return nil, fmt.Errorf("UserAccount '%s' not exists", userUUID)
+		return nil, &ErrUnknownUserAccount{userUUID: userUUID}
 	}
 	return userAccount, nil
 }
@@ -329,58 +1011,307 @@ func (r *Repository) ReadSecret(userUUID, secretName string) ([]byte, error) {
 		return nil, err
 	}
 
-	if err := r.checkRight(userAccount, RIGHT_READ_SECRET); err != nil {
+	if err := r.checkRight(
+		userAccount, RIGHT_READ_SECRET, secretName); err != nil {
 		return nil, err
 	}
 
 	secret, exists := r.Secrets[secretName]
-	if !exists {
+	if !exists || len(secret.Versions) == 0 {
 		return nil, &ErrUnknownSecret{secretName: secretName}
 	}
-	return secret, nil
+
+	secretVersion := secret.Versions[len(secret.Versions)-1]
+	if err := secretVersion.checkValidity(
+		secretName, time.Now()); err != nil {
+		return nil, err
+	}
+	return secretVersion.Value, nil
 }
 
-func (r *Repository) ListSecretNames(userUUID string) ([]string, error) {
+func (r *Repository) ListSecretNames(
+	userUUID, prefix string, recursive bool) ([]string, error) {
+
 	userAccount, err := r.findUserAccount(userUUID)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := r.checkRight(userAccount, RIGHT_READ_SECRET); err != nil {
-		return nil, err
+	listableSecrets := make(map[string]*Secret)
+	for secretName, secret := range r.Secrets {
+		if r.isAllowed(userAccount, CAPABILITY_LIST, secretName) {
+			listableSecrets[secretName] = secret
+		}
 	}
 
-	secretNames := make([]string, 0)
-	for k, _ := range r.Secrets {
-		secretNames = append(secretNames, k)
+	return listSecretPaths(listableSecrets, prefix, recursive), nil
+}
+
+func (r *Repository) WriteSecret(userUUID, secretName string,
+	secretValue []byte, opts *WriteSecretOptions) error {
+
+	userAccount, err := r.findUserAccount(userUUID)
+	if err != nil {
+		return err
+	}
+
+	if err := r.checkRight(
+		userAccount, RIGHT_WRITE_SECRET, secretName); err != nil {
+		return err
+	}
+
+	if err := checkSecretName(secretName); err != nil {
+		return err
 	}
 
-	return secretNames, nil
+	if err := opts.check(secretName); err != nil {
+		return err
+	}
+
+	r.writeSecret(userUUID, secretName, secretValue, opts)
+
+	return nil
 }
 
-func (r *Repository) WriteSecret(
-	userUUID, secretName string, secretValue []byte) error {
+type ErrSecretAlreadyExists struct {
+	secretName string
+}
+
+func (e *ErrSecretAlreadyExists) Error() string {
+	return fmt.Sprintf("Secret '%s' already exists", e.secretName)
+}
+
+func (r *Repository) DeleteSecret(userUUID, secretName string) error {
+	userAccount, err := r.findUserAccount(userUUID)
+	if err != nil {
+		return err
+	}
+
+	if err := r.checkRight(
+		userAccount, RIGHT_DELETE_SECRET, secretName); err != nil {
+		return err
+	}
+
+	secret, exists := r.Secrets[secretName]
+	if !exists {
+		return &ErrUnknownSecret{secretName: secretName}
+	}
+	for _, secretVersion := range secret.Versions {
+		Zero(secretVersion.Value)
+	}
+	delete(r.Secrets, secretName)
+
+	return nil
+}
+
+func (r *Repository) RenameSecret(
+	userUUID, secretName, newSecretName string) error {
 
 	userAccount, err := r.findUserAccount(userUUID)
 	if err != nil {
 		return err
 	}
 
-	if err := r.checkRight(userAccount, RIGHT_WRITE_SECRET); err != nil {
+	if err := r.checkRight(
+		userAccount, RIGHT_RENAME_SECRET, secretName); err != nil {
+		return err
+	}
+
+	if err := r.checkRight(
+		userAccount, RIGHT_RENAME_SECRET, newSecretName); err != nil {
+		return err
+	}
+
+	secret, exists := r.Secrets[secretName]
+	if !exists {
+		return &ErrUnknownSecret{secretName: secretName}
+	}
+
+	if err := checkSecretName(newSecretName); err != nil {
 		return err
 	}
 
-	r.Secrets[secretName] = secretValue
+	if _, exists := r.Secrets[newSecretName]; exists {
+		return &ErrSecretAlreadyExists{secretName: newSecretName}
+	}
+
+	delete(r.Secrets, secretName)
+	r.Secrets[newSecretName] = secret
 
 	return nil
 }
 
+type ErrLastAdminUserAccount struct {
+	userUUID string
+}
+
+func (e *ErrLastAdminUserAccount) Error() string {
+	return fmt.Sprintf("UserAccount '%s' is the last admin of the repository",
+		e.userUUID)
+}
+
+func (r *Repository) countAdminUserAccounts() int {
+	count := 0
+	for _, userAccount := range r.UserAccounts {
+		if userAccount.CanAdminUserAccounts {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *Repository) AddUserAccount(userUUID string,
+	newUserAccount *UserAccount, rights []string) error {
+
+	userAccount, err := r.findUserAccount(userUUID)
+	if err != nil {
+		return err
+	}
+
+	if err := r.checkRight(
+		userAccount, RIGHT_ADMIN_USER_ACCOUNTS, ""); err != nil {
+		return err
+	}
+
+	if _, exists := r.UserAccounts[newUserAccount.UUID]; exists {
+		return fmt.Errorf("UserAccount '%s' already exists",
+			newUserAccount.UUID)
+	}
+
+	capabilities, canAdminUserAccounts, err := parseRights(rights)
+	if err != nil {
+		return err
+	}
+
+	if canAdminUserAccounts && newUserAccount.ServiceAccount {
+		return &ErrServiceAccountAdmin{userUUID: newUserAccount.UUID}
+	}
+
+	r.applyRights(newUserAccount, capabilities, canAdminUserAccounts)
+	r.UserAccounts[newUserAccount.UUID] = newUserAccount
+
+	return nil
+}
+
+func (r *Repository) RemoveUserAccount(
+	userUUID, targetUserUUID string) error {
+
+	userAccount, err := r.findUserAccount(userUUID)
+	if err != nil {
+		return err
+	}
+
+	if err := r.checkRight(
+		userAccount, RIGHT_ADMIN_USER_ACCOUNTS, ""); err != nil {
+		return err
+	}
+
+	targetUserAccount, err := r.findUserAccount(targetUserUUID)
+	if err != nil {
+		return err
+	}
+
+	if targetUserAccount.CanAdminUserAccounts &&
+		r.countAdminUserAccounts() == 1 {
+		return &ErrLastAdminUserAccount{userUUID: targetUserUUID}
+	}
+
+	delete(r.UserAccounts, targetUserUUID)
+	delete(r.Policies, personalPolicyName(targetUserUUID))
+	for _, apiKeyID := range r.serviceAccountAPIKeyIDs(targetUserUUID) {
+		delete(r.APIKeys, apiKeyID)
+	}
+	for _, identity := range r.userAccountCertificateIdentities(
+		targetUserUUID) {
+		delete(r.CertificateBindings, identity)
+	}
+
+	return nil
+}
+
+func (r *Repository) UpdateUserAccountRights(
+	userUUID, targetUserUUID string, rights []string) error {
+
+	userAccount, err := r.findUserAccount(userUUID)
+	if err != nil {
+		return err
+	}
+
+	if err := r.checkRight(
+		userAccount, RIGHT_ADMIN_USER_ACCOUNTS, ""); err != nil {
+		return err
+	}
+
+	targetUserAccount, err := r.findUserAccount(targetUserUUID)
+	if err != nil {
+		return err
+	}
+
+	capabilities, canAdminUserAccounts, err := parseRights(rights)
+	if err != nil {
+		return err
+	}
+
+	if canAdminUserAccounts && targetUserAccount.ServiceAccount {
+		return &ErrServiceAccountAdmin{userUUID: targetUserUUID}
+	}
+
+	if targetUserAccount.CanAdminUserAccounts && !canAdminUserAccounts &&
+		r.countAdminUserAccounts() == 1 {
+		return &ErrLastAdminUserAccount{userUUID: targetUserUUID}
+	}
+
+	r.applyRights(targetUserAccount, capabilities, canAdminUserAccounts)
+
+	return nil
+}
+
+func (r *Repository) ListUserAccounts(userUUID string) ([]*UserAccount, error) {
+	userAccount, err := r.findUserAccount(userUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.checkRight(
+		userAccount, RIGHT_ADMIN_USER_ACCOUNTS, ""); err != nil {
+		return nil, err
+	}
+
+	userAccounts := make([]*UserAccount, 0, len(r.UserAccounts))
+	for _, ua := range r.UserAccounts {
+		userAccountCopy := *ua
+		userAccountCopy.Policies = append([]string{}, ua.Policies...)
+		userAccounts = append(userAccounts, &userAccountCopy)
+	}
+	sort.Sort(byLabel(userAccounts))
+
+	return userAccounts, nil
+}
+
+type byLabel []*UserAccount
+
+func (s byLabel) Len() int      { return len(s) }
+func (s byLabel) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byLabel) Less(i, j int) bool {
+	if s[i].Label == s[j].Label {
+		return s[i].UUID < s[j].UUID
+	}
+	return s[i].Label < s[j].Label
+}
+
 type UserAccount struct {
-	UUID                 string `json:"uuid"`
-	Label                string `json:"label"`
-	CanReadSecret        bool   `json:"can_read_secret"`
-	CanWriteSecret       bool   `json:"can_write_secret"`
-	CanAdminUserAccounts bool   `json:"can_admin_user_accounts"`
+	UUID                 string   `json:"uuid"`
+	Label                string   `json:"label"`
+	Policies             []string `json:"policies"`
+	CanAdminUserAccounts bool     `json:"can_admin_user_accounts"`
+	ServiceAccount       bool     `json:"service_account"`
+
+	// Secret rights of repositories stored before policies, see
+	// migratePolicies.
+	CanReadSecret   bool `json:"-"`
+	CanWriteSecret  bool `json:"-"`
+	CanDeleteSecret bool `json:"-"`
+	CanRenameSecret bool `json:"-"`
 }
 
 func (h *Himitsu) Close() error {
@@ -396,6 +1327,12 @@ func (h *Himitsu) Close() error {
 		return err
 	}
 
+	if h.legacyPasswordDerivator != nil {
+		if err := h.legacyPasswordDerivator.Close(); err != nil {
+			return err
+		}
+	}
+
 	if err := h.cryptoEngine.Close(); err != nil {
 		return err
 	}
@@ -404,5 +1341,6 @@ func (h *Himitsu) Close() error {
 		return err
 	}
 
+	h.sessions.revoke(func(info *SessionInfo) bool { return true })
 	return nil
 }
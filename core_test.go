@@ -0,0 +1,575 @@
+package himitsu
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/pagedegeek/himitsu/crypto_engine"
+	"github.com/pagedegeek/himitsu/data_access"
+	"github.com/pagedegeek/himitsu/password_derivation"
+	"github.com/pagedegeek/himitsu/salt_generation"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingSaltGenerator fails its failAt-th call, so that operations can be
+// interrupted partway through.
+type failingSaltGenerator struct {
+	salt_generation.SaltGenerator
+	calls  int
+	failAt int
+}
+
+func (g *failingSaltGenerator) Call(size int) ([]byte, error) {
+	g.calls++
+	if g.calls == g.failAt {
+		return nil, errors.New("injected failure")
+	}
+	return g.SaltGenerator.Call(size)
+}
+
+// slowPasswordDerivator records the salts it derives with, taking at least
+// delay on each call.
+type slowPasswordDerivator struct {
+	password_derivation.PasswordDerivator
+	delay time.Duration
+	salts [][]byte
+}
+
+func (pd *slowPasswordDerivator) Call(pwd, salt []byte) []byte {
+	time.Sleep(pd.delay)
+	pd.salts = append(pd.salts, salt)
+	return pd.PasswordDerivator.Call(pwd, salt)
+}
+
+// concurrentPasswordDerivator records the most calls it ran at once.
+type concurrentPasswordDerivator struct {
+	password_derivation.PasswordDerivator
+	mutex         sync.Mutex
+	running       int
+	maxConcurrent int
+}
+
+func (pd *concurrentPasswordDerivator) Call(pwd, salt []byte) []byte {
+	pd.mutex.Lock()
+	pd.running++
+	if pd.running > pd.maxConcurrent {
+		pd.maxConcurrent = pd.running
+	}
+	pd.mutex.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	pd.mutex.Lock()
+	pd.running--
+	pd.mutex.Unlock()
+	return pd.PasswordDerivator.Call(pwd, salt)
+}
+
+type sequenceUUIDGenerator struct {
+	next int
+}
+
+func (g *sequenceUUIDGenerator) Call() string {
+	g.next++
+	return fmt.Sprintf("uuid-%d", g.next)
+}
+
+func (g *sequenceUUIDGenerator) Close() error {
+	return nil
+}
+
+func setupHimitsu(t *testing.T) (
+	*assert.Assertions, *Himitsu, *failingSaltGenerator, *sequenceUUIDGenerator,
+	data_access.DataAccess, func()) {
+
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "himitsu")
+	assert.Nil(err)
+
+	dataAccess, err := data_access.NewDefaultDataAccess(
+		filepath.Join(dir, "himitsu.bin"))
+	assert.Nil(err)
+
+	saltGenerator := &failingSaltGenerator{
+		SaltGenerator: salt_generation.NewDefaultSaltGenerator()}
+	uuidGenerator := &sequenceUUIDGenerator{}
+	h := NewHimitsu(saltGenerator, uuidGenerator,
+		password_derivation.NewPBKDF2PasswordDerivator(32, 10, sha256.New),
+		crypto_engine.NewAESCFBEngine(), dataAccess)
+	auditKey, err := saltGenerator.SaltGenerator.Call(32)
+	assert.Nil(err)
+	h.SetAuditKey(auditKey)
+
+	return assert, h, saltGenerator, uuidGenerator, dataAccess, func() {
+		h.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCreateRepositoryIsAtomic(t *testing.T) {
+	// repository key, user salt, repository key IV, private key, private key
+	// IV, repository IV
+	for failAt := 1; failAt <= 6; failAt++ {
+		assert, h, saltGenerator, uuidGenerator, dataAccess, teardown :=
+			setupHimitsu(t)
+
+		saltGenerator.failAt = failAt
+		_, _, err := h.CreateRepository("repo", "admin", "password")
+		assert.NotNil(err, "failing call %d", failAt)
+
+		adminUUID := "uuid-1"
+		repoUUID := "uuid-2"
+		assert.Equal(2, uuidGenerator.next)
+
+		salt, _ := dataAccess.ReadUserAccountSalt(adminUUID)
+		assert.Nil(salt, "failing call %d", failAt)
+
+		key, _ := dataAccess.ReadCipherRepositoryKey(adminUUID, repoUUID)
+		assert.Nil(key, "failing call %d", failAt)
+
+		repository, _ := dataAccess.ReadCipherRepository(repoUUID)
+		assert.Nil(repository, "failing call %d", failAt)
+
+		teardown()
+	}
+}
+
+func TestAddUserAccountIsAtomic(t *testing.T) {
+	// user salt, repository key IV, private key, private key IV, repository
+	// IV
+	for failAt := 1; failAt <= 5; failAt++ {
+		assert, h, saltGenerator, _, dataAccess, teardown := setupHimitsu(t)
+
+		repoUUID, adminUUID, err := h.CreateRepository(
+			"repo", "admin", "password")
+		assert.Nil(err)
+
+		saltGenerator.failAt = saltGenerator.calls + failAt
+		_, err = h.AddUserAccount(repoUUID, adminUUID, "password",
+			"bob", "bob password", []string{RIGHT_READ_SECRET})
+		assert.NotNil(err, "failing call %d", failAt)
+
+		bobUUID := "uuid-3"
+		salt, _ := dataAccess.ReadUserAccountSalt(bobUUID)
+		assert.Nil(salt, "failing call %d", failAt)
+
+		key, _ := dataAccess.ReadCipherRepositoryKey(bobUUID, repoUUID)
+		assert.Nil(key, "failing call %d", failAt)
+
+		userAccounts, err := h.ListUserAccounts(
+			repoUUID, adminUUID, "password")
+		assert.Nil(err)
+		assert.Equal(1, len(userAccounts), "failing call %d", failAt)
+
+		teardown()
+	}
+}
+
+func TestAddUserAccount(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{RIGHT_READ_SECRET})
+	assert.Nil(err)
+
+	secret, err := h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.Nil(err)
+	assert.Equal([]byte("Hello World !"), secret)
+}
+
+func TestAuthenticationFailuresAreUniform(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+	h.SetLockoutPolicy(LockoutPolicy{FreeAttempts: 100})
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	otherRepoUUID, _, err := h.CreateRepository("other", "other", "password")
+	assert.Nil(err)
+
+	invalidCredentials := func(userUUID string) error {
+		return &ErrInvalidCredentials{userUUID: userUUID}
+	}
+
+	// wrong password
+	_, err = h.ReadSecret(repoUUID, adminUUID, "wrong", "hello")
+	assert.Equal(invalidCredentials(adminUUID), err)
+
+	// unknown user account
+	_, err = h.ReadSecret(repoUUID, "ghost", "password", "hello")
+	assert.Equal(invalidCredentials("ghost"), err)
+
+	// user account without key for the repository, or unknown repository
+	_, err = h.ReadSecret(otherRepoUUID, adminUUID, "password", "hello")
+	assert.Equal(invalidCredentials(adminUUID), err)
+	_, err = h.ReadSecret("nowhere", adminUUID, "wrong", "hello")
+	assert.Equal(invalidCredentials(adminUUID), err)
+
+	_, _, err = h.Login(repoUUID, "ghost", "password", "")
+	assert.Equal(invalidCredentials("ghost"), err)
+	_, _, err = h.Login(repoUUID, adminUUID, "wrong", "")
+	assert.Equal(invalidCredentials(adminUUID), err)
+
+	assert.Equal(invalidCredentials("ghost"),
+		h.ChangeUserPassword("ghost", "password", "new password", ""))
+	assert.Equal(invalidCredentials(adminUUID),
+		h.ChangeUserPassword(adminUUID, "wrong", "new password", ""))
+
+	_, err = h.ListRepositoriesForUser("ghost", "password", "")
+	assert.Equal(invalidCredentials("ghost"), err)
+	_, err = h.ListRepositoriesForUser(adminUUID, "wrong", "")
+	assert.Equal(invalidCredentials(adminUUID), err)
+
+	// a user account without repository left cannot be told apart either
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{RIGHT_READ_SECRET})
+	assert.Nil(err)
+	assert.Nil(h.RemoveUserAccount(repoUUID, adminUUID, "password", bobUUID))
+	_, err = h.ListRepositoriesForUser(bobUUID, "bob password", "")
+	assert.Equal(invalidCredentials(bobUUID), err)
+}
+
+func TestUnknownUserAccountTakesPasswordDerivation(t *testing.T) {
+	assert, h, _, _, dataAccess, teardown := setupHimitsu(t)
+	defer teardown()
+	h.SetLockoutPolicy(LockoutPolicy{FreeAttempts: 100})
+
+	// without parameters, the salts are stored bare
+	derivator := &slowPasswordDerivator{
+		PasswordDerivator: h.passwordDerivator,
+		delay:             50 * time.Millisecond}
+	h.passwordDerivator = derivator
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	adminSalt, err := dataAccess.ReadUserAccountSalt(adminUUID)
+	assert.Nil(err)
+	derivator.salts = nil
+
+	attempt := func(userUUID string) time.Duration {
+		start := time.Now()
+		_, err := h.ReadSecret(repoUUID, userUUID, "wrong", "hello")
+		assert.IsType(&ErrInvalidCredentials{}, err)
+		return time.Since(start)
+	}
+
+	wrongPassword := attempt(adminUUID)
+	unknownUser := attempt("ghost")
+	attempt("ghost")
+	attempt("phantom")
+
+	// one derivation per attempt, whether the user account exists or not
+	assert.Equal(4, len(derivator.salts))
+	assert.True(wrongPassword >= derivator.delay)
+	assert.True(unknownUser >= derivator.delay)
+
+	// the fake salt looks like a real one and stays the same across
+	// attempts, without being shared by unknown user accounts
+	assert.Equal(adminSalt, derivator.salts[0])
+	assert.Equal(len(adminSalt), len(derivator.salts[1]))
+	assert.Equal(derivator.salts[1], derivator.salts[2])
+	assert.NotEqual(derivator.salts[1], derivator.salts[3])
+}
+
+func TestUnknownUserAccountTakesCurrentPasswordDerivation(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+	h.SetLockoutPolicy(LockoutPolicy{FreeAttempts: 100})
+
+	// user accounts enrolled without parameters are derived with the fast
+	// legacy derivator, new ones with the slow current one, as the server
+	// does with PBKDF2 and Argon2id
+	legacyDerivator := &slowPasswordDerivator{
+		PasswordDerivator: h.passwordDerivator}
+	h.SetLegacyPasswordDerivator(legacyDerivator)
+	h.passwordDerivator = password_derivation.NewArgon2idPasswordDerivator(
+		32, 3, 64*1024, 4)
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+
+	attempt := func(userUUID string) time.Duration {
+		start := time.Now()
+		_, err := h.ReadSecret(repoUUID, userUUID, "wrong", "hello")
+		assert.IsType(&ErrInvalidCredentials{}, err)
+		return time.Since(start)
+	}
+
+	wrongPassword := attempt(adminUUID)
+	unknownUser := attempt("ghost")
+
+	// an unknown user account takes the derivation of a new one
+	assert.Equal(0, len(legacyDerivator.salts))
+	assert.True(unknownUser >= wrongPassword/2, "%s for an unknown user "+
+		"account, %s for a wrong password", unknownUser, wrongPassword)
+}
+
+func TestConcurrentDerivationsAreBounded(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+	h.SetLockoutPolicy(LockoutPolicy{FreeAttempts: 100})
+	h.SetMaxConcurrentDerivations(2)
+
+	derivator := &concurrentPasswordDerivator{
+		PasswordDerivator: h.passwordDerivator}
+	h.passwordDerivator = derivator
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// unknown user accounts are derived as well
+			userUUID := adminUUID
+			if i%2 == 0 {
+				userUUID = fmt.Sprintf("ghost-%d", i)
+			}
+			h.ReadSecret(repoUUID, userUUID, "password", "hello")
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(2, derivator.maxConcurrent)
+}
+
+func TestUserAccountsKeepTheirPasswordDerivation(t *testing.T) {
+	assert, h, _, _, dataAccess, teardown := setupHimitsu(t)
+	defer teardown()
+
+	pbkdf2Derivator := h.passwordDerivator
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	adminSalt, err := dataAccess.ReadUserAccountSalt(adminUUID)
+	assert.Nil(err)
+	assert.Contains(string(adminSalt), "$pbkdf2-sha256$i=10,l=32$")
+
+	// bob enrolls before the parameters were stored
+	h.passwordDerivator = &slowPasswordDerivator{
+		PasswordDerivator: pbkdf2Derivator}
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{RIGHT_READ_SECRET})
+	assert.Nil(err)
+	bobSalt, err := dataAccess.ReadUserAccountSalt(bobUUID)
+	assert.Nil(err)
+	assert.Equal(32, len(bobSalt))
+
+	h.passwordDerivator = password_derivation.NewArgon2idPasswordDerivator(
+		32, 1, 64, 1)
+	h.SetLegacyPasswordDerivator(pbkdf2Derivator)
+
+	_, err = h.ReadSecret(repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+	_, err = h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.Nil(err)
+
+	// a new password is derived with the current parameters
+	assert.Nil(h.ChangeUserPassword(bobUUID, "bob password", "new password", ""))
+	bobSalt, err = dataAccess.ReadUserAccountSalt(bobUUID)
+	assert.Nil(err)
+	assert.Contains(string(bobSalt), "$argon2id$v=19$m=64,t=1,p=1,l=32$")
+	_, err = h.ReadSecret(repoUUID, bobUUID, "new password", "hello")
+	assert.Nil(err)
+
+	_, err = h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+}
+
+func TestRemoveUserAccount(t *testing.T) {
+	assert, h, _, _, dataAccess, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{RIGHT_READ_SECRET})
+	assert.Nil(err)
+
+	bobRepoKey, err := h.loadRepositoryKey(bobUUID, repoUUID, "bob password")
+	assert.Nil(err)
+
+	// only admins remove user accounts, and never the last one
+	err = h.RemoveUserAccount(repoUUID, bobUUID, "bob password", adminUUID)
+	assert.IsType(&ErrForbidden{}, ClassifyError(err))
+	err = h.RemoveUserAccount(repoUUID, adminUUID, "password", adminUUID)
+	assert.IsType(&ErrLastAdminUserAccount{}, err)
+
+	assert.Nil(h.RemoveUserAccount(repoUUID, adminUUID, "password", bobUUID))
+
+	_, err = h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	_, err = dataAccess.ReadUserAccountSalt(bobUUID)
+	assert.IsType(&data_access.ErrUserAccountNotFound{}, err)
+
+	// the key bob may have kept no longer opens the repository
+	cipherRepo, err := dataAccess.ReadCipherRepository(repoUUID)
+	assert.Nil(err)
+	_, err = h.cryptoEngine.Decrypt(cipherRepo, bobRepoKey)
+	assert.NotNil(err)
+
+	_, err = h.ReadSecret(repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+}
+
+func TestUpdateUserAccountRights(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{RIGHT_READ_SECRET})
+	assert.Nil(err)
+
+	_, err = h.ListUserAccounts(repoUUID, bobUUID, "bob password")
+	assert.IsType(&ErrForbidden{}, ClassifyError(err))
+	err = h.UpdateUserAccountRights(repoUUID, bobUUID, "bob password",
+		bobUUID, []string{RIGHT_ADMIN_USER_ACCOUNTS})
+	assert.IsType(&ErrForbidden{}, ClassifyError(err))
+	err = h.WriteSecret(repoUUID, bobUUID, "bob password", "hello",
+		[]byte("changed"), nil)
+	assert.IsType(&ErrForbidden{}, ClassifyError(err))
+
+	assert.Nil(h.UpdateUserAccountRights(repoUUID, adminUUID, "password",
+		bobUUID, []string{RIGHT_READ_SECRET, RIGHT_WRITE_SECRET,
+			RIGHT_ADMIN_USER_ACCOUNTS}))
+
+	userAccounts, err := h.ListUserAccounts(repoUUID, bobUUID, "bob password")
+	assert.Nil(err)
+	assert.Equal(2, len(userAccounts))
+	assert.Nil(h.WriteSecret(repoUUID, bobUUID, "bob password", "hello",
+		[]byte("changed"), nil))
+
+	err = h.UpdateUserAccountRights(repoUUID, adminUUID, "password",
+		bobUUID, []string{"Fly"})
+	assert.IsType(&ErrUnknownRight{}, err)
+}
+
+func TestChangeUserPassword(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	otherRepoUUID, bobUUID, err := h.CreateRepository(
+		"other", "bob", "bob password")
+	assert.Nil(err)
+	assert.Nil(h.InviteUserAccount(repoUUID, adminUUID, "password",
+		bobUUID, "bob", []string{RIGHT_READ_SECRET}))
+	assert.Nil(h.AcceptInvitation(repoUUID, bobUUID, "bob password", ""))
+	token, _, err := h.Login(repoUUID, bobUUID, "bob password", "")
+	assert.Nil(err)
+
+	err = h.ChangeUserPassword(bobUUID, "wrong password", "new password", "")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	err = h.ChangeUserPassword(bobUUID, "bob password", "short", "")
+	assert.IsType(&ErrWeakPassword{}, err)
+
+	assert.Nil(h.ChangeUserPassword(bobUUID, "bob password", "new password",
+		""))
+
+	// every repository key is re-wrapped, and the sessions are revoked
+	for _, repoUUID := range []string{repoUUID, otherRepoUUID} {
+		_, err = h.ReadSecret(repoUUID, bobUUID, "new password", "hello")
+		assert.Nil(err)
+		_, err = h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+		assert.IsType(&ErrInvalidCredentials{}, err)
+	}
+	_, err = h.ReadSecret(repoUUID, bobUUID, token, "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+
+	// so is the private key, which opens the next invitations
+	thirdRepoUUID, carolUUID, err := h.CreateRepository(
+		"third", "carol", "carol password")
+	assert.Nil(err)
+	assert.Nil(h.InviteUserAccount(thirdRepoUUID, carolUUID, "carol password",
+		bobUUID, "bob", []string{RIGHT_READ_SECRET}))
+	assert.Nil(h.AcceptInvitation(thirdRepoUUID, bobUUID, "new password", ""))
+	_, err = h.ReadSecret(thirdRepoUUID, bobUUID, "new password", "hello")
+	assert.Nil(err)
+
+	// the other user accounts are left alone
+	_, err = h.ReadSecret(repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+}
+
+func TestDeleteAndRenameSecret(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", "bye",
+		[]byte("Bye"), nil))
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{RIGHT_READ_SECRET, RIGHT_WRITE_SECRET})
+	assert.Nil(err)
+
+	// renaming takes its own right, on both names
+	err = h.RenameSecret(repoUUID, bobUUID, "bob password", "hello", "hi")
+	assert.IsType(&ErrUserAccountHasNoRight{}, err)
+	err = h.DeleteSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.IsType(&ErrUserAccountHasNoRight{}, err)
+
+	carolUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"carol", "carol password", []string{RIGHT_RENAME_SECRET})
+	assert.Nil(err)
+	assert.Nil(h.RenameSecret(
+		repoUUID, carolUUID, "carol password", "bye", "ciao"))
+	err = h.DeleteSecret(repoUUID, carolUUID, "carol password", "ciao")
+	assert.IsType(&ErrUserAccountHasNoRight{}, err)
+	err = h.WriteSecret(repoUUID, carolUUID, "carol password", "ciao",
+		[]byte("Ciao"), nil)
+	assert.IsType(&ErrUserAccountHasNoRight{}, err)
+
+	assert.Nil(h.SetPolicy(repoUUID, adminUUID, "password", &Policy{
+		Name: "renamer",
+		Rules: []*PolicyRule{{Effect: POLICY_EFFECT_ALLOW, Path: "ci/**",
+			Capabilities: []string{CAPABILITY_RENAME}}}}))
+	assert.Nil(h.SetUserAccountPolicies(repoUUID, adminUUID, "password",
+		carolUUID, []string{"renamer"}))
+	assert.Nil(h.RenameSecret(
+		repoUUID, adminUUID, "password", "ciao", "ci/ciao"))
+	err = h.RenameSecret(
+		repoUUID, carolUUID, "carol password", "ci/ciao", "prod/ciao")
+	assert.IsType(&ErrUserAccountHasNoRight{}, err)
+	assert.Nil(h.RenameSecret(
+		repoUUID, carolUUID, "carol password", "ci/ciao", "ci/bye"))
+	assert.Nil(h.RenameSecret(
+		repoUUID, adminUUID, "password", "ci/bye", "bye"))
+
+	err = h.RenameSecret(repoUUID, adminUUID, "password", "hello", "bye")
+	assert.IsType(&ErrSecretAlreadyExists{}, err)
+	err = h.RenameSecret(repoUUID, adminUUID, "password", "unknown", "hi")
+	assert.IsType(&ErrUnknownSecret{}, err)
+
+	assert.Nil(h.RenameSecret(repoUUID, adminUUID, "password", "hello", "hi"))
+	_, err = h.ReadSecret(repoUUID, adminUUID, "password", "hello")
+	assert.IsType(&ErrUnknownSecret{}, err)
+	secret, err := h.ReadSecret(repoUUID, adminUUID, "password", "hi")
+	assert.Nil(err)
+	assert.Equal([]byte("Hello World !"), secret)
+
+	assert.Nil(h.DeleteSecret(repoUUID, adminUUID, "password", "hi"))
+	_, err = h.ReadSecret(repoUUID, adminUUID, "password", "hi")
+	assert.IsType(&ErrUnknownSecret{}, err)
+	err = h.DeleteSecret(repoUUID, adminUUID, "password", "hi")
+	assert.IsType(&ErrNotFound{}, ClassifyError(err))
+
+	secretNames, err := h.ListSecretNames(
+		repoUUID, adminUUID, "password", "", false)
+	assert.Nil(err)
+	assert.Equal([]string{"bye"}, secretNames)
+}
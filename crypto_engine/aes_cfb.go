@@ -54,9 +54,21 @@ const (
 	lenHmacSum int = 32
 )
 
+// ErrInvalidHMAC is returned when the cipher data was not produced with the
+// key, or was altered since.
+type ErrInvalidHMAC struct {
+}
+
+func (e *ErrInvalidHMAC) Error() string {
+	return "Invalid HMAC"
+}
+
 func (e *AESCFBEngine) Decrypt(cipherData, key []byte) ([]byte, error) {
 	// message composition:
 	// HMAC(32 bits)|IV(16bits)|CIPHERMSG
+	if len(cipherData) < lenHmacSum+aes.BlockSize {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
 	msgHmacSum := cipherData[:lenHmacSum]
 	ciphermsg := cipherData[lenHmacSum:]
 
@@ -64,7 +76,7 @@ func (e *AESCFBEngine) Decrypt(cipherData, key []byte) ([]byte, error) {
 	hm.Write(ciphermsg)
 	expectedMAC := hm.Sum(nil)
 	if !hmac.Equal(expectedMAC, msgHmacSum) {
-		return nil, fmt.Errorf("Invalid HMAC")
+		return nil, &ErrInvalidHMAC{}
 	}
 
 	c, err := aes.NewCipher(key)
@@ -72,9 +84,6 @@ func (e *AESCFBEngine) Decrypt(cipherData, key []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	if len(ciphermsg) < aes.BlockSize {
-		return nil, fmt.Errorf("ciphertext too short")
-	}
 	iv := ciphermsg[:aes.BlockSize]
 	ciphermsg = ciphermsg[aes.BlockSize:]
 
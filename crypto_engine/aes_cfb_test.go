@@ -103,3 +103,25 @@ func TestEncryptDecrypt(t *testing.T) {
 
 	assert.Equal(plainMsg1, plainMsg2)
 }
+
+func TestDecryptTooShort(t *testing.T) {
+	assert := setup(t)
+
+	for _, cipherData := range [][]byte{nil, expectedCipherMsg[:32+15]} {
+		plainmsg, err := ce.Decrypt(cipherData, key)
+		assert.NotNil(err)
+		assert.Nil(plainmsg)
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	assert := setup(t)
+
+	wrongKey := make([]byte, len(key))
+	copy(wrongKey, key)
+	wrongKey[0] ^= 0xFF
+
+	plainmsg, err := ce.Decrypt(expectedCipherMsg, wrongKey)
+	assert.IsType(&ErrInvalidHMAC{}, err)
+	assert.Nil(plainmsg)
+}
@@ -1,8 +1,12 @@
 package data_access
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"github.com/boltdb/bolt"
+	"sort"
+	"time"
 )
 
 type DataAccess interface {
@@ -10,23 +14,154 @@ type DataAccess interface {
 
 	SaveUserAccountSalt(userUUID string, userSalt []byte) error
 
-	SaveCipherRepositoryKey(userUUID string, cipherRepositoryKey []byte) error
-	SaveCipherRepository(repoUUID string, cipherRepo []byte) error
+	SaveCipherRepositoryKey(
+		userUUID, repoUUID string, cipherRepositoryKey []byte) error
+	SaveCipherRepositoryIfRevision(
+		repoUUID string, cipherRepo []byte, revision uint64) error
+
+	SaveUserAccountCredentials(userUUID string, userSalt []byte,
+		cipherRepositoryKeys map[string][]byte,
+		legacyCipherRepositoryKey []byte) error
 
 	ReadUserAccountSalt(userUUID string) ([]byte, error)
 
-	ReadCipherRepositoryKey(userUUID string) ([]byte, error)
+	ReadCipherRepositoryKey(userUUID, repoUUID string) ([]byte, error)
 	ReadCipherRepository(repoUUID string) ([]byte, error)
+
+	ListRepositoryUUIDs(userUUID string) ([]string, error)
+	ListCipherRepositoryUUIDs() ([]string, error)
+
+	SavePendingRepositoryKeys(
+		userUUID, repoUUID string, pendingKeys []byte) error
+	ReadPendingRepositoryKeys(userUUID, repoUUID string) ([]byte, error)
+	ReadSealedRepositoryKey(userUUID, repoUUID string) ([]byte, error)
+	CompletePendingRepositoryKeys(userUUID, repoUUID string,
+		cipherRepositoryKey, sealedKey, pendingKeys []byte) error
+
+	ReadKeyPair(slot string) ([]byte, []byte, error)
+	DeleteKeyPair(slot string) error
+
+	ReadTOTP(userUUID string) ([]byte, error)
+	SaveTOTPIfUnchanged(
+		userUUID string, cipherTOTP, previousCipherTOTP []byte) error
+
+	ReadLegacyCipherRepositoryKey(userUUID string) ([]byte, error)
+	ReadLegacyPendingRepositoryKeys(userUUID string) ([]byte, error)
+	MigrateLegacyCipherRepositoryKey(
+		userUUID, repoUUID string, cipherRepositoryKey []byte) error
+
+	DeleteUserAccountSalt(userUUID string) error
+
+	DeleteCipherRepositoryKey(userUUID, repoUUID string) error
+
+	SaveAuditEntry(sequence uint64, entry []byte) error
+	ReadLastAuditEntry() (uint64, []byte, error)
+	ListAuditEntries() ([][]byte, error)
+
+	RecordFailedUnwrap(subject string,
+		at, resetBefore time.Time) (*FailedUnwraps, error)
+	ReadFailedUnwraps(subject string) (*FailedUnwraps, error)
+	ListFailedUnwraps() (map[string]*FailedUnwraps, error)
+	DeleteFailedUnwraps(subject string) error
+
+	NewBatch() Batch
+}
+
+// Batch collects writes spanning several buckets and applies them all at
+// once on Commit, or none of them if one fails.
+type Batch interface {
+	SaveCipherRepositoryKey(
+		userUUID, repoUUID string, cipherRepositoryKey []byte)
+	SaveCipherRepositoryIfRevision(
+		repoUUID string, cipherRepo []byte, revision uint64)
+	SaveUserAccountCredentials(userUUID string, userSalt []byte,
+		cipherRepositoryKeys map[string][]byte,
+		legacyCipherRepositoryKey []byte)
+	SaveSealedRepositoryKey(
+		userUUID, repoUUID string, sealedKey []byte)
+	SavePendingRepositoryKeysIfUnchanged(userUUID, repoUUID string,
+		pendingKeys, previousPendingKeys []byte)
+	SaveKeyPair(slot string, publicKey, cipherPrivateKey []byte)
+	SaveTOTPIfUnchanged(
+		userUUID string, cipherTOTP, previousCipherTOTP []byte)
+	DeleteCipherRepositoryKey(userUUID, repoUUID string)
+	DeleteUnusedUserAccountSalt(userUUID string)
+	DeleteKeyPair(slot string)
+	DeleteFailedUnwraps(subject string)
+	SaveAuditEntry(sequence uint64, entry []byte)
+
+	Commit() error
 }
 
 type DefaultDataAccess struct {
 	db *bolt.DB
 }
 
+/*
+	cipher repository keys layout:
+	user_repository_keys/<userUUID>/<repoUUID> -> cipher repository key
+	user_pending_repository_keys/<userUUID>/<repoUUID> -> pending keys
+	user_sealed_repository_keys/<userUUID>/<repoUUID> -> sealed key
+
+	Pending keys are the chain key rotations leave, each encrypted under the
+	previous repository key. A rotation stores the new key sealed to the
+	public key of the user account instead, replacing any sealed key it did
+	not open yet, and only extends the chain of a user account without key
+	pair.
+
+	The legacy layout stored a single key per user account:
+	cipher_repository_keys/<userUUID> -> cipher repository key
+	pending_repository_keys/<userUUID> -> pending keys
+
+	It does not record the repository a key belongs to, so legacy entries
+	are moved to the current layout the first time the user account opens
+	its repository, see MigrateLegacyCipherRepositoryKey.
+
+	cipher repositories layout:
+	cipher_repositories/<repoUUID> -> cipher repository
+	cipher_repository_revisions/<repoUUID> -> big endian revision
+
+	The revision is also stored inside the cipher repository, where it is
+	read along with the content it belongs to. A repository stored before
+	revisions existed is at revision 0.
+
+	audit log layout:
+	audit_entries/<big endian sequence> -> audit entry
+
+	user account salts layout:
+	user_accounts_salts/<userUUID> -> salt, along with the algorithm and
+	parameters of the password derivation, see
+	password_derivation.EncodeSalt
+
+	key pairs layout:
+	slot_public_keys/<slot> -> public key
+	slot_private_keys/<slot> -> cipher private key
+
+	A slot is a user account UUID, or what is stored in place of one, such
+	as an API key ID.
+
+	TOTP layout:
+	user_totp/<userUUID> -> cipher TOTP record of the user account
+
+	failed unwraps layout:
+	failed_unwraps/<subject> -> big endian count, big endian unix nano time
+	of the last failure
+*/
+
 const (
-	bucketNameCipherRepositories   = "cipher_repositories"
-	bucketNameCipherRepositoryKeys = "cipher_repository_keys"
-	bucketNameUserAccountsSalts    = "user_accounts_salts"
+	bucketNameCipherRepositories          = "cipher_repositories"
+	bucketNameCipherRepositoryRevisions   = "cipher_repository_revisions"
+	bucketNameCipherRepositoryKeys        = "user_repository_keys"
+	bucketNameUserAccountsSalts           = "user_accounts_salts"
+	bucketNamePendingRepositoryKeys       = "user_pending_repository_keys"
+	bucketNameSealedRepositoryKeys        = "user_sealed_repository_keys"
+	bucketNameSlotPublicKeys              = "slot_public_keys"
+	bucketNameSlotPrivateKeys             = "slot_private_keys"
+	bucketNameTOTP                        = "user_totp"
+	bucketNameLegacyCipherRepositoryKeys  = "cipher_repository_keys"
+	bucketNameLegacyPendingRepositoryKeys = "pending_repository_keys"
+	bucketNameAuditEntries                = "audit_entries"
+	bucketNameFailedUnwraps               = "failed_unwraps"
 )
 
 func NewDefaultDataAccess(filename string) (*DefaultDataAccess, error) {
@@ -37,21 +172,137 @@ func NewDefaultDataAccess(filename string) (*DefaultDataAccess, error) {
 	return &DefaultDataAccess{db: db}, nil
 }
 
+type ErrUserAccountNotFound struct {
+	userUUID string
+}
+
+func (e *ErrUserAccountNotFound) Error() string {
+	return fmt.Sprintf("UserAccount '%s' not found", e.userUUID)
+}
+
+type ErrRepositoryNotFound struct {
+	repoUUID string
+}
+
+func (e *ErrRepositoryNotFound) Error() string {
+	return fmt.Sprintf("Repository '%s' not found", e.repoUUID)
+}
+
+type ErrRepositoryKeyNotFound struct {
+	userUUID string
+	repoUUID string
+}
+
+func (e *ErrRepositoryKeyNotFound) Error() string {
+	return fmt.Sprintf("UserAccount '%s' has no key for repository '%s'",
+		e.userUUID, e.repoUUID)
+}
+
+type ErrCorruptRecord struct {
+	bucketName string
+	key        string
+}
+
+func (e *ErrCorruptRecord) Error() string {
+	return fmt.Sprintf("Record '%s' of '%s' is corrupt", e.key, e.bucketName)
+}
+
+// checkRecord rejects empty records: nothing is ever stored empty.
+func checkRecord(bucketName, key string, value []byte) error {
+	if value != nil && len(value) == 0 {
+		return &ErrCorruptRecord{bucketName: bucketName, key: key}
+	}
+	return nil
+}
+
 func (dda *DefaultDataAccess) ReadCipherRepository(
 	repoUUID string) ([]byte, error) {
-	return dda.read(
-		bucketNameCipherRepositories, repoUUID)
+	cipherRepo, err := dda.read(bucketNameCipherRepositories, repoUUID)
+	if err != nil {
+		return nil, err
+	}
+	if cipherRepo == nil {
+		return nil, &ErrRepositoryNotFound{repoUUID: repoUUID}
+	}
+	return cipherRepo, nil
 }
 
+// ReadCipherRepositoryKey returns the cipher repository key of the user
+// account for the repository, or nil if it is still in the legacy layout.
+// A user account holding no key for the repository gets
+// ErrRepositoryKeyNotFound, whether the repository exists or not.
 func (dda *DefaultDataAccess) ReadCipherRepositoryKey(
-	userUUID string) ([]byte, error) {
-	return dda.read(
-		bucketNameCipherRepositoryKeys, userUUID)
+	userUUID, repoUUID string) ([]byte, error) {
+	cipherRepositoryKey, err := dda.readNested(
+		bucketNameCipherRepositoryKeys, userUUID, repoUUID)
+	if err != nil || cipherRepositoryKey != nil {
+		return cipherRepositoryKey, err
+	}
+
+	legacyCipherRepositoryKey, err := dda.read(
+		bucketNameLegacyCipherRepositoryKeys, userUUID)
+	if err != nil {
+		return nil, err
+	}
+	if legacyCipherRepositoryKey == nil {
+		return nil, &ErrRepositoryKeyNotFound{
+			userUUID: userUUID, repoUUID: repoUUID}
+	}
+	return nil, nil
 }
 
 func (dda *DefaultDataAccess) ReadUserAccountSalt(
 	userUUID string) ([]byte, error) {
-	return dda.read(bucketNameUserAccountsSalts, userUUID)
+	userSalt, err := dda.read(bucketNameUserAccountsSalts, userUUID)
+	if err != nil {
+		return nil, err
+	}
+	if userSalt == nil {
+		return nil, &ErrUserAccountNotFound{userUUID: userUUID}
+	}
+	return userSalt, nil
+}
+
+// ListRepositoryUUIDs returns the sorted UUIDs of the repositories the user
+// account holds a key for in the current layout.
+func (dda *DefaultDataAccess) ListRepositoryUUIDs(
+	userUUID string) ([]string, error) {
+	repoUUIDs := make([]string, 0)
+	err := dda.db.View(func(tx *bolt.Tx) error {
+		b := nestedBucket(tx, bucketNameCipherRepositoryKeys, userUUID)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			repoUUIDs = append(repoUUIDs, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(repoUUIDs)
+	return repoUUIDs, nil
+}
+
+// ListCipherRepositoryUUIDs returns the sorted UUIDs of every repository.
+func (dda *DefaultDataAccess) ListCipherRepositoryUUIDs() ([]string, error) {
+	repoUUIDs := make([]string, 0)
+	err := dda.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketNameCipherRepositories))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			repoUUIDs = append(repoUUIDs, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(repoUUIDs)
+	return repoUUIDs, nil
 }
 
 func (dda *DefaultDataAccess) SaveUserAccountSalt(
@@ -61,30 +312,737 @@ func (dda *DefaultDataAccess) SaveUserAccountSalt(
 }
 
 func (dda *DefaultDataAccess) SaveCipherRepositoryKey(
-	userUUID string, cipherRepositoryKey []byte) error {
-	return dda.save(
-		bucketNameCipherRepositoryKeys, userUUID, cipherRepositoryKey)
+	userUUID, repoUUID string, cipherRepositoryKey []byte) error {
+	return dda.db.Update(
+		saveCipherRepositoryKey(userUUID, repoUUID, cipherRepositoryKey))
 }
 
-func (dda *DefaultDataAccess) SaveCipherRepository(
-	repoUUID string, cipherRepo []byte) error {
-	return dda.save(
-		bucketNameCipherRepositories, repoUUID, cipherRepo)
+func saveCipherRepositoryKey(userUUID, repoUUID string,
+	cipherRepositoryKey []byte) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		return putNested(tx, bucketNameCipherRepositoryKeys,
+			userUUID, repoUUID, cipherRepositoryKey)
+	}
+}
+
+type ErrRevisionConflict struct {
+	repoUUID string
+	revision uint64
+}
+
+func (e *ErrRevisionConflict) Error() string {
+	return fmt.Sprintf("Repository '%s' is no longer at revision %d",
+		e.repoUUID, e.revision)
+}
+
+// SaveCipherRepositoryIfRevision stores the cipher repository only if the
+// stored one is still at revision, and moves it to the next revision.
+func (dda *DefaultDataAccess) SaveCipherRepositoryIfRevision(
+	repoUUID string, cipherRepo []byte, revision uint64) error {
+	return dda.db.Update(
+		saveCipherRepositoryIfRevision(repoUUID, cipherRepo, revision))
+}
+
+func saveCipherRepositoryIfRevision(repoUUID string, cipherRepo []byte,
+	revision uint64) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		storedRevision, err := readRevision(tx, repoUUID)
+		if err != nil {
+			return err
+		}
+		if storedRevision != revision {
+			return &ErrRevisionConflict{repoUUID: repoUUID, revision: revision}
+		}
+		if err := put(tx, bucketNameCipherRepositories,
+			repoUUID, cipherRepo); err != nil {
+			return err
+		}
+		nextRevision := make([]byte, 8)
+		binary.BigEndian.PutUint64(nextRevision, revision+1)
+		return put(tx, bucketNameCipherRepositoryRevisions,
+			repoUUID, nextRevision)
+	}
+}
+
+func readRevision(tx *bolt.Tx, repoUUID string) (uint64, error) {
+	b := tx.Bucket([]byte(bucketNameCipherRepositoryRevisions))
+	if b == nil {
+		return 0, nil
+	}
+	v := b.Get([]byte(repoUUID))
+	if v == nil {
+		return 0, nil
+	}
+	if len(v) != 8 {
+		return 0, &ErrCorruptRecord{
+			bucketName: bucketNameCipherRepositoryRevisions, key: repoUUID}
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
+
+// SaveUserAccountCredentials replaces the user account salt along with the
+// given cipher repository keys in a single transaction, so that a salt is
+// never stored alongside keys wrapped with another one. Pending keys of the
+// given repositories are dropped. A non nil legacyCipherRepositoryKey
+// replaces the legacy key of the user account and drops its pending keys.
+func (dda *DefaultDataAccess) SaveUserAccountCredentials(userUUID string,
+	userSalt []byte, cipherRepositoryKeys map[string][]byte,
+	legacyCipherRepositoryKey []byte) error {
+	return dda.db.Update(saveUserAccountCredentials(userUUID, userSalt,
+		cipherRepositoryKeys, legacyCipherRepositoryKey))
+}
+
+func saveUserAccountCredentials(userUUID string, userSalt []byte,
+	cipherRepositoryKeys map[string][]byte,
+	legacyCipherRepositoryKey []byte) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		if err := put(tx, bucketNameUserAccountsSalts,
+			userUUID, userSalt); err != nil {
+			return err
+		}
+
+		for repoUUID, cipherRepositoryKey := range cipherRepositoryKeys {
+			if err := putNested(tx, bucketNameCipherRepositoryKeys,
+				userUUID, repoUUID, cipherRepositoryKey); err != nil {
+				return err
+			}
+			if err := removeNested(tx, bucketNamePendingRepositoryKeys,
+				userUUID, repoUUID); err != nil {
+				return err
+			}
+		}
+
+		if legacyCipherRepositoryKey == nil {
+			return nil
+		}
+		if err := put(tx, bucketNameLegacyCipherRepositoryKeys,
+			userUUID, legacyCipherRepositoryKey); err != nil {
+			return err
+		}
+		return remove(tx, bucketNameLegacyPendingRepositoryKeys, userUUID)
+	}
+}
+
+func (dda *DefaultDataAccess) SavePendingRepositoryKeys(
+	userUUID, repoUUID string, pendingKeys []byte) error {
+	return dda.db.Update(
+		savePendingRepositoryKeys(userUUID, repoUUID, pendingKeys))
+}
+
+func savePendingRepositoryKeys(userUUID, repoUUID string,
+	pendingKeys []byte) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		return putNested(tx, bucketNamePendingRepositoryKeys,
+			userUUID, repoUUID, pendingKeys)
+	}
+}
+
+type ErrPendingRepositoryKeysChanged struct {
+	userUUID string
+	repoUUID string
+}
+
+func (e *ErrPendingRepositoryKeysChanged) Error() string {
+	return fmt.Sprintf(
+		"Pending keys of UserAccount '%s' for repository '%s' have changed",
+		e.userUUID, e.repoUUID)
+}
+
+// savePendingRepositoryKeysIfUnchanged replaces the pending keys, failing
+// with ErrPendingRepositoryKeysChanged when they are no longer
+// previousPendingKeys, nil standing for none: they were completed or
+// extended in between.
+func savePendingRepositoryKeysIfUnchanged(userUUID, repoUUID string,
+	pendingKeys, previousPendingKeys []byte) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		if err := checkPendingRepositoryKeys(
+			tx, userUUID, repoUUID, previousPendingKeys); err != nil {
+			return err
+		}
+		return putNested(tx, bucketNamePendingRepositoryKeys,
+			userUUID, repoUUID, pendingKeys)
+	}
+}
+
+func checkPendingRepositoryKeys(tx *bolt.Tx,
+	userUUID, repoUUID string, pendingKeys []byte) error {
+	var storedPendingKeys []byte
+	if b := nestedBucket(tx, bucketNamePendingRepositoryKeys,
+		userUUID); b != nil {
+		storedPendingKeys = b.Get([]byte(repoUUID))
+	}
+	if !bytes.Equal(storedPendingKeys, pendingKeys) {
+		return &ErrPendingRepositoryKeysChanged{
+			userUUID: userUUID, repoUUID: repoUUID}
+	}
+	return nil
+}
+
+func (dda *DefaultDataAccess) ReadPendingRepositoryKeys(
+	userUUID, repoUUID string) ([]byte, error) {
+	return dda.readNested(
+		bucketNamePendingRepositoryKeys, userUUID, repoUUID)
+}
+
+func (dda *DefaultDataAccess) ReadSealedRepositoryKey(
+	userUUID, repoUUID string) ([]byte, error) {
+	return dda.readNested(
+		bucketNameSealedRepositoryKeys, userUUID, repoUUID)
+}
+
+func saveSealedRepositoryKey(userUUID, repoUUID string,
+	sealedKey []byte) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		return putNested(tx, bucketNameSealedRepositoryKeys,
+			userUUID, repoUUID, sealedKey)
+	}
+}
+
+type ErrSealedRepositoryKeyChanged struct {
+	userUUID string
+	repoUUID string
+}
+
+func (e *ErrSealedRepositoryKeyChanged) Error() string {
+	return fmt.Sprintf(
+		"Sealed key of UserAccount '%s' for repository '%s' has changed",
+		e.userUUID, e.repoUUID)
+}
+
+// CompletePendingRepositoryKeys stores the re-wrapped cipher repository key
+// and drops the pending and sealed keys it was derived from in a single
+// transaction. It fails with ErrSealedRepositoryKeyChanged, storing nothing,
+// when the sealed key is no longer sealedKey, nil standing for none: a
+// rotation sealed a newer key in between. It fails likewise with
+// ErrPendingRepositoryKeysChanged when a rotation extended pendingKeys.
+func (dda *DefaultDataAccess) CompletePendingRepositoryKeys(userUUID,
+	repoUUID string, cipherRepositoryKey, sealedKey, pendingKeys []byte) error {
+	return dda.db.Update(func(tx *bolt.Tx) error {
+		if err := checkPendingRepositoryKeys(
+			tx, userUUID, repoUUID, pendingKeys); err != nil {
+			return err
+		}
+
+		var storedSealedKey []byte
+		if b := nestedBucket(tx, bucketNameSealedRepositoryKeys,
+			userUUID); b != nil {
+			storedSealedKey = b.Get([]byte(repoUUID))
+		}
+		if !bytes.Equal(storedSealedKey, sealedKey) {
+			return &ErrSealedRepositoryKeyChanged{
+				userUUID: userUUID, repoUUID: repoUUID}
+		}
+
+		if err := putNested(tx, bucketNameCipherRepositoryKeys,
+			userUUID, repoUUID, cipherRepositoryKey); err != nil {
+			return err
+		}
+		if err := removeNested(tx, bucketNamePendingRepositoryKeys,
+			userUUID, repoUUID); err != nil {
+			return err
+		}
+		return removeNested(tx, bucketNameSealedRepositoryKeys,
+			userUUID, repoUUID)
+	})
+}
+
+type ErrKeyPairExists struct {
+	slot string
+}
+
+func (e *ErrKeyPairExists) Error() string {
+	return fmt.Sprintf("Slot '%s' already has a key pair", e.slot)
+}
+
+// ReadKeyPair returns the public key and cipher private key of the slot, or
+// nil ones if it has none.
+func (dda *DefaultDataAccess) ReadKeyPair(slot string) ([]byte, []byte, error) {
+	publicKey, err := dda.read(bucketNameSlotPublicKeys, slot)
+	if err != nil {
+		return nil, nil, err
+	}
+	cipherPrivateKey, err := dda.read(bucketNameSlotPrivateKeys, slot)
+	if err != nil {
+		return nil, nil, err
+	}
+	if publicKey == nil || cipherPrivateKey == nil {
+		return nil, nil, nil
+	}
+	return publicKey, cipherPrivateKey, nil
+}
+
+// saveKeyPair stores the key pair of the slot. A key pair is only ever
+// re-wrapped: it fails with ErrKeyPairExists when the slot has one with
+// another public key, as keys may be sealed to it already.
+func saveKeyPair(slot string,
+	publicKey, cipherPrivateKey []byte) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(bucketNameSlotPublicKeys)); b != nil {
+			storedPublicKey := b.Get([]byte(slot))
+			if storedPublicKey != nil &&
+				!bytes.Equal(storedPublicKey, publicKey) {
+				return &ErrKeyPairExists{slot: slot}
+			}
+		}
+		if err := put(tx, bucketNameSlotPublicKeys,
+			slot, publicKey); err != nil {
+			return err
+		}
+		return put(tx, bucketNameSlotPrivateKeys, slot, cipherPrivateKey)
+	}
+}
+
+func removeKeyPair(tx *bolt.Tx, slot string) error {
+	if err := remove(tx, bucketNameSlotPublicKeys, slot); err != nil {
+		return err
+	}
+	return remove(tx, bucketNameSlotPrivateKeys, slot)
+}
+
+func (dda *DefaultDataAccess) DeleteKeyPair(slot string) error {
+	return dda.db.Update(deleteKeyPair(slot))
+}
+
+func deleteKeyPair(slot string) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		return removeKeyPair(tx, slot)
+	}
+}
+
+func (dda *DefaultDataAccess) ReadTOTP(userUUID string) ([]byte, error) {
+	return dda.read(bucketNameTOTP, userUUID)
+}
+
+type ErrTOTPChanged struct {
+	userUUID string
+}
+
+func (e *ErrTOTPChanged) Error() string {
+	return fmt.Sprintf("TOTP of UserAccount '%s' has changed", e.userUUID)
+}
+
+// SaveTOTPIfUnchanged stores the cipher TOTP record of the user account, or
+// deletes it when nil. It fails with ErrTOTPChanged, storing nothing, when
+// the stored record is no longer previousCipherTOTP, nil standing for none:
+// a concurrent login used a code in between.
+func (dda *DefaultDataAccess) SaveTOTPIfUnchanged(
+	userUUID string, cipherTOTP, previousCipherTOTP []byte) error {
+	return dda.db.Update(
+		saveTOTPIfUnchanged(userUUID, cipherTOTP, previousCipherTOTP))
+}
+
+func saveTOTPIfUnchanged(userUUID string,
+	cipherTOTP, previousCipherTOTP []byte) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		var storedCipherTOTP []byte
+		if b := tx.Bucket([]byte(bucketNameTOTP)); b != nil {
+			storedCipherTOTP = b.Get([]byte(userUUID))
+		}
+		if !bytes.Equal(storedCipherTOTP, previousCipherTOTP) {
+			return &ErrTOTPChanged{userUUID: userUUID}
+		}
+
+		if cipherTOTP == nil {
+			return remove(tx, bucketNameTOTP, userUUID)
+		}
+		return put(tx, bucketNameTOTP, userUUID, cipherTOTP)
+	}
+}
+
+func (dda *DefaultDataAccess) ReadLegacyCipherRepositoryKey(
+	userUUID string) ([]byte, error) {
+	return dda.read(bucketNameLegacyCipherRepositoryKeys, userUUID)
+}
+
+func (dda *DefaultDataAccess) ReadLegacyPendingRepositoryKeys(
+	userUUID string) ([]byte, error) {
+	return dda.read(bucketNameLegacyPendingRepositoryKeys, userUUID)
+}
+
+// MigrateLegacyCipherRepositoryKey stores the cipher repository key of the
+// user account for the repository in the current layout and drops the
+// legacy key and every pending key it was derived from.
+func (dda *DefaultDataAccess) MigrateLegacyCipherRepositoryKey(
+	userUUID, repoUUID string, cipherRepositoryKey []byte) error {
+	return dda.db.Update(func(tx *bolt.Tx) error {
+		if err := putNested(tx, bucketNameCipherRepositoryKeys,
+			userUUID, repoUUID, cipherRepositoryKey); err != nil {
+			return err
+		}
+		if err := removeNested(tx, bucketNamePendingRepositoryKeys,
+			userUUID, repoUUID); err != nil {
+			return err
+		}
+		if err := remove(tx, bucketNameLegacyCipherRepositoryKeys,
+			userUUID); err != nil {
+			return err
+		}
+		return remove(tx, bucketNameLegacyPendingRepositoryKeys, userUUID)
+	})
+}
+
+// DeleteUserAccountSalt deletes the salt of the user account along with its
+// legacy key, pending keys and key pair, if any.
+func (dda *DefaultDataAccess) DeleteUserAccountSalt(userUUID string) error {
+	return dda.db.Update(deleteUserAccountSalt(userUUID))
+}
+
+func deleteUserAccountSalt(userUUID string) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		for _, bucketName := range []string{
+			bucketNameUserAccountsSalts,
+			bucketNameTOTP,
+			bucketNameLegacyCipherRepositoryKeys,
+			bucketNameLegacyPendingRepositoryKeys} {
+			if err := remove(tx, bucketName, userUUID); err != nil {
+				return err
+			}
+		}
+		return removeKeyPair(tx, userUUID)
+	}
+}
+
+// deleteUnusedUserAccountSalt deletes the salt of the user account, as
+// DeleteUserAccountSalt does, once it holds no repository key left in the
+// current layout.
+func deleteUnusedUserAccountSalt(userUUID string) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		if nestedBucket(tx, bucketNameCipherRepositoryKeys, userUUID) != nil {
+			return nil
+		}
+		return deleteUserAccountSalt(userUUID)(tx)
+	}
+}
+
+// DeleteCipherRepositoryKey deletes the cipher repository key of the user
+// account for the repository along with its pending and sealed keys, if any.
+func (dda *DefaultDataAccess) DeleteCipherRepositoryKey(
+	userUUID, repoUUID string) error {
+	return dda.db.Update(deleteCipherRepositoryKey(userUUID, repoUUID))
+}
+
+func deleteCipherRepositoryKey(
+	userUUID, repoUUID string) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		for _, bucketName := range []string{
+			bucketNameCipherRepositoryKeys,
+			bucketNamePendingRepositoryKeys,
+			bucketNameSealedRepositoryKeys} {
+			if err := removeNested(tx, bucketName,
+				userUUID, repoUUID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+type ErrAuditEntryAlreadyExists struct {
+	sequence uint64
+}
+
+func (e *ErrAuditEntryAlreadyExists) Error() string {
+	return fmt.Sprintf("Audit entry %d already exists", e.sequence)
+}
+
+func auditEntryKey(sequence uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, sequence)
+	return key
+}
+
+// SaveAuditEntry appends the audit entry to the log. Entries are never
+// overwritten, so that two writers racing for the same sequence cannot fork
+// the log.
+func (dda *DefaultDataAccess) SaveAuditEntry(
+	sequence uint64, entry []byte) error {
+	return dda.db.Update(saveAuditEntry(sequence, entry))
+}
+
+func saveAuditEntry(sequence uint64, entry []byte) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucketNameAuditEntries))
+		if err != nil {
+			return err
+		}
+		key := auditEntryKey(sequence)
+		if b.Get(key) != nil {
+			return &ErrAuditEntryAlreadyExists{sequence: sequence}
+		}
+		return b.Put(key, entry)
+	}
+}
+
+// ReadLastAuditEntry returns the sequence and content of the last audit
+// entry, or a nil entry if the log is empty.
+func (dda *DefaultDataAccess) ReadLastAuditEntry() (uint64, []byte, error) {
+	var sequence uint64
+	var entry []byte
+	err := dda.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketNameAuditEntries))
+		if b == nil {
+			return nil
+		}
+		k, v := b.Cursor().Last()
+		if k == nil {
+			return nil
+		}
+		if len(k) != 8 {
+			return &ErrCorruptRecord{
+				bucketName: bucketNameAuditEntries, key: string(k)}
+		}
+		sequence = binary.BigEndian.Uint64(k)
+		entry = copyValue(v)
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return sequence, entry, nil
+}
+
+// ListAuditEntries returns every audit entry in sequence order.
+func (dda *DefaultDataAccess) ListAuditEntries() ([][]byte, error) {
+	entries := make([][]byte, 0)
+	err := dda.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketNameAuditEntries))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			entries = append(entries, copyValue(v))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// FailedUnwraps counts the failed key unwraps of a subject, such as a user
+// account or a client.
+type FailedUnwraps struct {
+	Count       uint64
+	LastFailure time.Time
+}
+
+func decodeFailedUnwraps(subject string, v []byte) (*FailedUnwraps, error) {
+	if len(v) != 16 {
+		return nil, &ErrCorruptRecord{
+			bucketName: bucketNameFailedUnwraps, key: subject}
+	}
+	return &FailedUnwraps{
+		Count: binary.BigEndian.Uint64(v[:8]),
+		LastFailure: time.Unix(
+			0, int64(binary.BigEndian.Uint64(v[8:]))).UTC()}, nil
+}
+
+func encodeFailedUnwraps(failedUnwraps *FailedUnwraps) []byte {
+	v := make([]byte, 16)
+	binary.BigEndian.PutUint64(v[:8], failedUnwraps.Count)
+	binary.BigEndian.PutUint64(v[8:],
+		uint64(failedUnwraps.LastFailure.UnixNano()))
+	return v
+}
+
+// RecordFailedUnwrap counts a failed unwrap of the subject at the given time
+// and returns the updated count. Failures older than resetBefore are
+// forgotten first.
+func (dda *DefaultDataAccess) RecordFailedUnwrap(subject string,
+	at, resetBefore time.Time) (*FailedUnwraps, error) {
+	var failedUnwraps *FailedUnwraps
+	err := dda.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucketNameFailedUnwraps))
+		if err != nil {
+			return err
+		}
+
+		failedUnwraps = &FailedUnwraps{}
+		if v := b.Get([]byte(subject)); v != nil {
+			if failedUnwraps, err = decodeFailedUnwraps(
+				subject, v); err != nil {
+				return err
+			}
+			if failedUnwraps.LastFailure.Before(resetBefore) {
+				failedUnwraps.Count = 0
+			}
+		}
+		failedUnwraps.Count++
+		failedUnwraps.LastFailure = at.UTC()
+
+		return b.Put([]byte(subject), encodeFailedUnwraps(failedUnwraps))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return failedUnwraps, nil
+}
+
+// ReadFailedUnwraps returns the failed unwraps of the subject, or nil if it
+// has none.
+func (dda *DefaultDataAccess) ReadFailedUnwraps(
+	subject string) (*FailedUnwraps, error) {
+	v, err := dda.read(bucketNameFailedUnwraps, subject)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return decodeFailedUnwraps(subject, v)
+}
+
+// ListFailedUnwraps returns the failed unwraps of every subject having some.
+func (dda *DefaultDataAccess) ListFailedUnwraps() (
+	map[string]*FailedUnwraps, error) {
+	failedUnwraps := make(map[string]*FailedUnwraps)
+	err := dda.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketNameFailedUnwraps))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			subjectFailedUnwraps, err := decodeFailedUnwraps(string(k), v)
+			if err != nil {
+				return err
+			}
+			failedUnwraps[string(k)] = subjectFailedUnwraps
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return failedUnwraps, nil
+}
+
+func (dda *DefaultDataAccess) DeleteFailedUnwraps(subject string) error {
+	return dda.db.Update(deleteFailedUnwraps(subject))
+}
+
+func deleteFailedUnwraps(subject string) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		return remove(tx, bucketNameFailedUnwraps, subject)
+	}
+}
+
+type defaultBatch struct {
+	db         *bolt.DB
+	operations []func(tx *bolt.Tx) error
+}
+
+func (dda *DefaultDataAccess) NewBatch() Batch {
+	return &defaultBatch{db: dda.db}
+}
+
+func (b *defaultBatch) SaveCipherRepositoryKey(
+	userUUID, repoUUID string, cipherRepositoryKey []byte) {
+	b.operations = append(b.operations,
+		saveCipherRepositoryKey(userUUID, repoUUID, cipherRepositoryKey))
+}
+
+func (b *defaultBatch) SaveCipherRepositoryIfRevision(
+	repoUUID string, cipherRepo []byte, revision uint64) {
+	b.operations = append(b.operations,
+		saveCipherRepositoryIfRevision(repoUUID, cipherRepo, revision))
+}
+
+func (b *defaultBatch) SaveUserAccountCredentials(userUUID string,
+	userSalt []byte, cipherRepositoryKeys map[string][]byte,
+	legacyCipherRepositoryKey []byte) {
+	b.operations = append(b.operations, saveUserAccountCredentials(userUUID,
+		userSalt, cipherRepositoryKeys, legacyCipherRepositoryKey))
+}
+
+func (b *defaultBatch) SaveSealedRepositoryKey(
+	userUUID, repoUUID string, sealedKey []byte) {
+	b.operations = append(b.operations,
+		saveSealedRepositoryKey(userUUID, repoUUID, sealedKey))
+}
+
+func (b *defaultBatch) SavePendingRepositoryKeysIfUnchanged(userUUID,
+	repoUUID string, pendingKeys, previousPendingKeys []byte) {
+	b.operations = append(b.operations, savePendingRepositoryKeysIfUnchanged(
+		userUUID, repoUUID, pendingKeys, previousPendingKeys))
+}
+
+func (b *defaultBatch) SaveKeyPair(
+	slot string, publicKey, cipherPrivateKey []byte) {
+	b.operations = append(b.operations,
+		saveKeyPair(slot, publicKey, cipherPrivateKey))
+}
+
+func (b *defaultBatch) SaveTOTPIfUnchanged(
+	userUUID string, cipherTOTP, previousCipherTOTP []byte) {
+	b.operations = append(b.operations,
+		saveTOTPIfUnchanged(userUUID, cipherTOTP, previousCipherTOTP))
+}
+
+func (b *defaultBatch) DeleteCipherRepositoryKey(userUUID, repoUUID string) {
+	b.operations = append(b.operations,
+		deleteCipherRepositoryKey(userUUID, repoUUID))
+}
+
+func (b *defaultBatch) DeleteUnusedUserAccountSalt(userUUID string) {
+	b.operations = append(b.operations,
+		deleteUnusedUserAccountSalt(userUUID))
+}
+
+func (b *defaultBatch) DeleteKeyPair(slot string) {
+	b.operations = append(b.operations, deleteKeyPair(slot))
+}
+
+func (b *defaultBatch) DeleteFailedUnwraps(subject string) {
+	b.operations = append(b.operations, deleteFailedUnwraps(subject))
+}
+
+func (b *defaultBatch) SaveAuditEntry(sequence uint64, entry []byte) {
+	b.operations = append(b.operations, saveAuditEntry(sequence, entry))
+}
+
+// Commit applies the collected writes in order in a single transaction,
+// rolled back as a whole on the first error.
+func (b *defaultBatch) Commit() error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, operation := range b.operations {
+			if err := operation(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (dda *DefaultDataAccess) Close() error {
 	return dda.db.Close()
 }
 
+// read returns a copy of the value, or nil if the key or its bucket is
+// missing.
 func (dda *DefaultDataAccess) read(bucketName, key string) ([]byte, error) {
 	var value []byte
 	err := dda.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucketName))
 		if b == nil {
-			return fmt.Errorf("Bucket '%s' not exists", bucketName)
+			return nil
 		}
-		value = b.Get([]byte(key))
-		return nil
+		value = copyValue(b.Get([]byte(key)))
+		return checkRecord(bucketName, key, value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (dda *DefaultDataAccess) readNested(
+	bucketName, nestedBucketName, key string) ([]byte, error) {
+	var value []byte
+	err := dda.db.View(func(tx *bolt.Tx) error {
+		b := nestedBucket(tx, bucketName, nestedBucketName)
+		if b == nil {
+			return nil
+		}
+		value = copyValue(b.Get([]byte(key)))
+		return checkRecord(bucketName, nestedBucketName+"/"+key, value)
 	})
 	if err != nil {
 		return nil, err
@@ -94,10 +1052,66 @@ func (dda *DefaultDataAccess) read(bucketName, key string) ([]byte, error) {
 
 func (dda *DefaultDataAccess) save(bucketName, key string, value []byte) error {
 	return dda.db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists([]byte(bucketName))
-		if err != nil {
-			return err
-		}
-		return b.Put([]byte(key), value)
+		return put(tx, bucketName, key, value)
 	})
 }
+
+func copyValue(v []byte) []byte {
+	if v == nil {
+		return nil
+	}
+	value := make([]byte, len(v))
+	copy(value, v)
+	return value
+}
+
+func nestedBucket(tx *bolt.Tx, bucketName, nestedBucketName string) *bolt.Bucket {
+	b := tx.Bucket([]byte(bucketName))
+	if b == nil {
+		return nil
+	}
+	return b.Bucket([]byte(nestedBucketName))
+}
+
+func put(tx *bolt.Tx, bucketName, key string, value []byte) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), value)
+}
+
+func putNested(tx *bolt.Tx,
+	bucketName, nestedBucketName, key string, value []byte) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+	if err != nil {
+		return err
+	}
+	nb, err := b.CreateBucketIfNotExists([]byte(nestedBucketName))
+	if err != nil {
+		return err
+	}
+	return nb.Put([]byte(key), value)
+}
+
+func remove(tx *bolt.Tx, bucketName, key string) error {
+	b := tx.Bucket([]byte(bucketName))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(key))
+}
+
+func removeNested(tx *bolt.Tx, bucketName, nestedBucketName, key string) error {
+	b := nestedBucket(tx, bucketName, nestedBucketName)
+	if b == nil {
+		return nil
+	}
+	if err := b.Delete([]byte(key)); err != nil {
+		return err
+	}
+	if k, _ := b.Cursor().First(); k != nil {
+		return nil
+	}
+	return tx.Bucket([]byte(bucketName)).DeleteBucket([]byte(nestedBucketName))
+}
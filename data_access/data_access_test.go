@@ -0,0 +1,265 @@
+package data_access
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setup(t *testing.T) (*assert.Assertions, *DefaultDataAccess, func()) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "himitsu")
+	assert.Nil(err)
+
+	dda, err := NewDefaultDataAccess(filepath.Join(dir, "himitsu.bin"))
+	assert.Nil(err)
+
+	return assert, dda, func() {
+		dda.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBatchCommit(t *testing.T) {
+	assert, dda, teardown := setup(t)
+	defer teardown()
+
+	batch := dda.NewBatch()
+	batch.SaveUserAccountCredentials("user", []byte("salt"),
+		map[string][]byte{"repo": []byte("key")}, nil)
+	batch.SaveCipherRepositoryIfRevision("repo", []byte("repository"), 0)
+	assert.Nil(batch.Commit())
+
+	salt, err := dda.ReadUserAccountSalt("user")
+	assert.Nil(err)
+	assert.Equal([]byte("salt"), salt)
+
+	key, err := dda.ReadCipherRepositoryKey("user", "repo")
+	assert.Nil(err)
+	assert.Equal([]byte("key"), key)
+
+	repository, err := dda.ReadCipherRepository("repo")
+	assert.Nil(err)
+	assert.Equal([]byte("repository"), repository)
+}
+
+func TestBatchRollsBackOnFailure(t *testing.T) {
+	assert, dda, teardown := setup(t)
+	defer teardown()
+
+	assert.Nil(dda.SaveCipherRepositoryIfRevision(
+		"repo", []byte("repository"), 0))
+
+	batch := dda.NewBatch()
+	batch.SaveUserAccountCredentials("user", []byte("salt"),
+		map[string][]byte{"repo": []byte("key")}, nil)
+	batch.SaveSealedRepositoryKey("other", "repo", []byte("sealed"))
+	batch.SaveAuditEntry(1, []byte("entry"))
+	// the repository is at revision 1 by now, so this write fails after
+	// the previous ones are applied.
+	batch.SaveCipherRepositoryIfRevision("repo", []byte("stale"), 0)
+	batch.SaveCipherRepositoryKey("admin", "repo", []byte("key"))
+
+	err := batch.Commit()
+	assert.IsType(&ErrRevisionConflict{}, err)
+
+	salt, _ := dda.ReadUserAccountSalt("user")
+	assert.Nil(salt)
+
+	key, err := dda.ReadCipherRepositoryKey("user", "repo")
+	assert.IsType(&ErrRepositoryKeyNotFound{}, err)
+	assert.Nil(key)
+
+	sealedKey, err := dda.ReadSealedRepositoryKey("other", "repo")
+	assert.Nil(err)
+	assert.Nil(sealedKey)
+
+	sequence, entry, err := dda.ReadLastAuditEntry()
+	assert.Nil(err)
+	assert.Equal(uint64(0), sequence)
+	assert.Nil(entry)
+
+	repository, err := dda.ReadCipherRepository("repo")
+	assert.Nil(err)
+	assert.Equal([]byte("repository"), repository)
+}
+
+func TestSaveCipherRepositoryIfRevision(t *testing.T) {
+	assert, dda, teardown := setup(t)
+	defer teardown()
+
+	assert.Nil(dda.SaveCipherRepositoryIfRevision("repo", []byte("r1"), 0))
+	assert.Nil(dda.SaveCipherRepositoryIfRevision("repo", []byte("r2"), 1))
+	assert.IsType(&ErrRevisionConflict{},
+		dda.SaveCipherRepositoryIfRevision("repo", []byte("r3"), 1))
+
+	repository, err := dda.ReadCipherRepository("repo")
+	assert.Nil(err)
+	assert.Equal([]byte("r2"), repository)
+}
+
+func TestCompletePendingRepositoryKeys(t *testing.T) {
+	assert, dda, teardown := setup(t)
+	defer teardown()
+
+	assert.Nil(dda.SavePendingRepositoryKeys("user", "repo", []byte("chain")))
+	batch := dda.NewBatch()
+	batch.SaveSealedRepositoryKey("user", "repo", []byte("sealed 1"))
+	assert.Nil(batch.Commit())
+
+	// a rotation sealed another key since "sealed 0" was read
+	err := dda.CompletePendingRepositoryKeys("user", "repo",
+		[]byte("key 0"), []byte("sealed 0"), []byte("chain"))
+	assert.IsType(&ErrSealedRepositoryKeyChanged{}, err)
+	key, _ := dda.ReadCipherRepositoryKey("user", "repo")
+	assert.Nil(key)
+
+	// a rotation extended the chain since it was read
+	batch = dda.NewBatch()
+	batch.SavePendingRepositoryKeysIfUnchanged(
+		"user", "repo", []byte("longer chain"), []byte("chain"))
+	assert.Nil(batch.Commit())
+	err = dda.CompletePendingRepositoryKeys("user", "repo",
+		[]byte("key 0"), []byte("sealed 1"), []byte("chain"))
+	assert.IsType(&ErrPendingRepositoryKeysChanged{}, err)
+	batch = dda.NewBatch()
+	batch.SavePendingRepositoryKeysIfUnchanged(
+		"user", "repo", []byte("other chain"), []byte("chain"))
+	assert.IsType(&ErrPendingRepositoryKeysChanged{}, batch.Commit())
+
+	assert.Nil(dda.CompletePendingRepositoryKeys("user", "repo",
+		[]byte("key 1"), []byte("sealed 1"), []byte("longer chain")))
+	key, err = dda.ReadCipherRepositoryKey("user", "repo")
+	assert.Nil(err)
+	assert.Equal([]byte("key 1"), key)
+
+	pendingKeys, err := dda.ReadPendingRepositoryKeys("user", "repo")
+	assert.Nil(err)
+	assert.Nil(pendingKeys)
+	sealedKey, err := dda.ReadSealedRepositoryKey("user", "repo")
+	assert.Nil(err)
+	assert.Nil(sealedKey)
+}
+
+func TestSaveKeyPair(t *testing.T) {
+	assert, dda, teardown := setup(t)
+	defer teardown()
+
+	batch := dda.NewBatch()
+	batch.SaveKeyPair("user", []byte("public"), []byte("private"))
+	assert.Nil(batch.Commit())
+
+	// re-wrapping keeps the public key
+	batch = dda.NewBatch()
+	batch.SaveKeyPair("user", []byte("public"), []byte("rewrapped"))
+	assert.Nil(batch.Commit())
+
+	batch = dda.NewBatch()
+	batch.SaveKeyPair("user", []byte("other"), []byte("private"))
+	assert.IsType(&ErrKeyPairExists{}, batch.Commit())
+
+	publicKey, cipherPrivateKey, err := dda.ReadKeyPair("user")
+	assert.Nil(err)
+	assert.Equal([]byte("public"), publicKey)
+	assert.Equal([]byte("rewrapped"), cipherPrivateKey)
+
+	assert.Nil(dda.DeleteKeyPair("user"))
+	publicKey, cipherPrivateKey, err = dda.ReadKeyPair("user")
+	assert.Nil(err)
+	assert.Nil(publicKey)
+	assert.Nil(cipherPrivateKey)
+}
+
+func TestSaveTOTPIfUnchanged(t *testing.T) {
+	assert, dda, teardown := setup(t)
+	defer teardown()
+
+	assert.Nil(dda.SaveTOTPIfUnchanged("user", []byte("first"), nil))
+	assert.IsType(&ErrTOTPChanged{},
+		dda.SaveTOTPIfUnchanged("user", []byte("second"), nil))
+	assert.Nil(dda.SaveTOTPIfUnchanged(
+		"user", []byte("second"), []byte("first")))
+	assert.IsType(&ErrTOTPChanged{},
+		dda.SaveTOTPIfUnchanged("user", []byte("third"), []byte("first")))
+
+	cipherTOTP, err := dda.ReadTOTP("user")
+	assert.Nil(err)
+	assert.Equal([]byte("second"), cipherTOTP)
+
+	assert.Nil(dda.SaveTOTPIfUnchanged("user", nil, []byte("second")))
+	cipherTOTP, err = dda.ReadTOTP("user")
+	assert.Nil(err)
+	assert.Nil(cipherTOTP)
+}
+
+func TestReadNotFound(t *testing.T) {
+	assert, dda, teardown := setup(t)
+	defer teardown()
+
+	salt, err := dda.ReadUserAccountSalt("user")
+	assert.IsType(&ErrUserAccountNotFound{}, err)
+	assert.Nil(salt)
+
+	repository, err := dda.ReadCipherRepository("repo")
+	assert.IsType(&ErrRepositoryNotFound{}, err)
+	assert.Nil(repository)
+
+	key, err := dda.ReadCipherRepositoryKey("user", "repo")
+	assert.IsType(&ErrRepositoryKeyNotFound{}, err)
+	assert.Nil(key)
+
+	// a missing key is told apart from a missing repository
+	assert.Nil(dda.SaveCipherRepositoryIfRevision(
+		"repo", []byte("repository"), 0))
+	key, err = dda.ReadCipherRepositoryKey("user", "repo")
+	assert.IsType(&ErrRepositoryKeyNotFound{}, err)
+	assert.Nil(key)
+}
+
+func TestReadCorruptRecord(t *testing.T) {
+	assert, dda, teardown := setup(t)
+	defer teardown()
+
+	assert.Nil(dda.SaveUserAccountSalt("user", []byte{}))
+
+	salt, err := dda.ReadUserAccountSalt("user")
+	assert.IsType(&ErrCorruptRecord{}, err)
+	assert.Nil(salt)
+}
+
+func TestRecordFailedUnwrap(t *testing.T) {
+	assert, dda, teardown := setup(t)
+	defer teardown()
+
+	start := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		failedUnwraps, err := dda.RecordFailedUnwrap("user:a",
+			start.Add(time.Duration(i)*time.Second), time.Unix(0, 0))
+		assert.Nil(err)
+		assert.Equal(uint64(i+1), failedUnwraps.Count)
+	}
+
+	failedUnwraps, err := dda.ReadFailedUnwraps("user:a")
+	assert.Nil(err)
+	assert.Equal(uint64(3), failedUnwraps.Count)
+	assert.True(failedUnwraps.LastFailure.Equal(start.Add(2 * time.Second)))
+
+	// failures before resetBefore are forgotten
+	failedUnwraps, err = dda.RecordFailedUnwrap("user:a",
+		start.Add(time.Hour), start.Add(time.Minute))
+	assert.Nil(err)
+	assert.Equal(uint64(1), failedUnwraps.Count)
+
+	all, err := dda.ListFailedUnwraps()
+	assert.Nil(err)
+	assert.Len(all, 1)
+
+	assert.Nil(dda.DeleteFailedUnwraps("user:a"))
+	failedUnwraps, err = dda.ReadFailedUnwraps("user:a")
+	assert.Nil(err)
+	assert.Nil(failedUnwraps)
+}
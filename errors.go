@@ -0,0 +1,100 @@
+package himitsu
+
+import (
+	"fmt"
+	"github.com/pagedegeek/himitsu/crypto_engine"
+	"github.com/pagedegeek/himitsu/data_access"
+)
+
+/*
+	Error taxonomy.
+
+	Whatever the operation, a failure falls in one of these classes, see
+	ClassifyError:
+	- ErrInvalidCredentials: every authentication failure, whether the user
+	  account is unknown, has no key for the repository, or the password,
+	  TOTP code, session token, API key or certificate credential is wrong.
+	  These are not told apart, in the error nor in the time taken: an
+	  unknown user account goes through the password derivation as well,
+	  see deriveUserPassword.
+	- ErrForbidden: the user account lacks the right for the operation.
+	- ErrNotFound: the repository, secret, version, policy, user account,
+	  session, API key, certificate binding or invitation operated on does
+	  not exist, or the invited user account has no key pair.
+	- ErrIntegrity: stored data fails to decrypt, decode or verify.
+
+	Other errors are either caused by the request itself, such as
+	ErrInvalidSecretName, ErrInvalidValidityWindow or ErrTOTPState, or
+	unexpected.
+*/
+
+type ErrInvalidCredentials struct {
+	userUUID string
+}
+
+func (e *ErrInvalidCredentials) Error() string {
+	return fmt.Sprintf("Invalid credentials for UserAccount '%s'", e.userUUID)
+}
+
+type ErrForbidden struct {
+	err error
+}
+
+func (e *ErrForbidden) Error() string {
+	return e.err.Error()
+}
+
+type ErrNotFound struct {
+	err error
+}
+
+func (e *ErrNotFound) Error() string {
+	return e.err.Error()
+}
+
+type ErrIntegrity struct {
+	err error
+}
+
+func (e *ErrIntegrity) Error() string {
+	return fmt.Sprintf("Integrity check failed: %s", e.err.Error())
+}
+
+type ErrUnknownUserAccount struct {
+	userUUID string
+}
+
+func (e *ErrUnknownUserAccount) Error() string {
+	return fmt.Sprintf("UserAccount '%s' not found", e.userUUID)
+}
+
+// ClassifyError returns err as one of ErrInvalidCredentials, ErrForbidden,
+// ErrNotFound or ErrIntegrity when it falls in one of these classes, and err
+// itself otherwise.
+func ClassifyError(err error) error {
+	switch err.(type) {
+	case *ErrInvalidCredentials, *ErrForbidden, *ErrNotFound, *ErrIntegrity:
+		return err
+	case *ErrUserAccountHasNoRight:
+		return &ErrForbidden{err: err}
+	case *ErrUnknownSecret, *ErrUnknownSecretVersion, *ErrUnknownPolicy,
+		*ErrUnknownUserAccount, *ErrUnknownSession, *ErrUnknownAPIKey,
+		*ErrUnknownCertificateBinding, *ErrUnknownInvitation, *ErrNoKeyPair,
+		*data_access.ErrRepositoryNotFound,
+		*data_access.ErrRepositoryKeyNotFound:
+		return &ErrNotFound{err: err}
+	case *ErrAuditLogTampered, *data_access.ErrCorruptRecord,
+		*crypto_engine.ErrInvalidHMAC:
+		return &ErrIntegrity{err: err}
+	}
+	return err
+}
+
+// unwrapError classifies the failure to decrypt a key wrapped under the
+// derived password of the user account: a wrong password fails the HMAC.
+func unwrapError(userUUID string, err error) error {
+	if _, isInvalidHMAC := err.(*crypto_engine.ErrInvalidHMAC); isInvalidHMAC {
+		return &ErrInvalidCredentials{userUUID: userUUID}
+	}
+	return &ErrIntegrity{err: err}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"github.com/pagedegeek/himitsu"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// totpCodeHeader carries the TOTP code of the routes checking the password
+// of an enrolled user account, see himitsu.EnrollTOTP.
+const totpCodeHeader = "X-Himitsu-TOTP-Code"
+
+// identity is the user account a v2 request acts as.
+type identity struct {
+	userUUID string
+	userPwd  string
+	totpCode string
+}
+
+// authenticate reads the identity from the Authorization header: HTTP Basic
+// with the user uuid and password, along with the TOTP code header, or a
+// Bearer session token, or else from the client certificate. It writes the
+// 401 response and returns nil when there is none.
+func authenticate(rw http.ResponseWriter, req *http.Request) *identity {
+	if userUUID, userPwd, ok := req.BasicAuth(); ok {
+		return &identity{userUUID: userUUID, userPwd: userPwd,
+			totpCode: req.Header.Get(totpCodeHeader)}
+	}
+
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) > len("Bearer ") &&
+		strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		id, err := authenticateBearer(authorization[len("Bearer "):])
+		if err == nil {
+			return id
+		}
+		writeError(rw, err)
+		return nil
+	}
+
+	id, err := authenticateCertificate(req)
+	if err != nil {
+		writeError(rw, err)
+		return nil
+	}
+	if id != nil {
+		return id
+	}
+
+	rw.Header().Set("WWW-Authenticate", `Basic realm="himitsu"`)
+	writeErrorBody(rw, http.StatusUnauthorized,
+		"invalid_credentials", "Missing credentials")
+	return nil
+}
+
+// authenticateBearer resolves a session token. The token stands for the
+// password on the repository of the session, see himitsu.Login.
+func authenticateBearer(token string) (*identity, error) {
+	session, err := h.ResolveSession(token)
+	if err != nil {
+		return nil, err
+	}
+	return &identity{userUUID: session.UserUUID, userPwd: token}, nil
+}
+
+// operatorTokenHeader carries the token of the server operator, who manages
+// what belongs to no repository, such as client lockouts.
+const operatorTokenHeader = "X-Himitsu-Operator-Token"
+
+// operatorTokenHash is the SHA-256 of the operator token, nil when none is
+// set up, see loadOperatorToken.
+var operatorTokenHash []byte
+
+// loadOperatorToken returns the SHA-256 of the operator token stored in the
+// file.
+func loadOperatorToken(filename string) ([]byte, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return nil, errors.New("empty operator token")
+	}
+	tokenHash := sha256.Sum256([]byte(token))
+	return tokenHash[:], nil
+}
+
+// authenticateOperator checks the operator token of the request. It writes
+// the 404 response when no operator token is set up, the 401 response when
+// the token is wrong, and returns false then.
+func authenticateOperator(rw http.ResponseWriter, req *http.Request) bool {
+	if operatorTokenHash == nil {
+		writeErrorBody(rw, http.StatusNotFound, "not_found", "Not found")
+		return false
+	}
+	tokenHash := sha256.Sum256([]byte(req.Header.Get(operatorTokenHeader)))
+	if !hmac.Equal(tokenHash[:], operatorTokenHash) {
+		writeError(rw, &himitsu.ErrInvalidCredentials{})
+		return false
+	}
+	return true
+}
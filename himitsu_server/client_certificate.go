@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+/*
+	With -client-ca, the server asks for a client certificate, verified
+	against the CA bundle, and authenticates requests without an
+	Authorization header with it. The identities of a certificate are its
+	subject and SANs:
+	- subject:<subject, as CN=ci,O=acme>
+	- dns:<DNS name>
+	- uri:<URI, such as a SPIFFE ID>
+	- email:<email address>
+	The client certificates file maps identities to user accounts. The
+	identity must also be bound to the user account in the repository, see
+	himitsu.BindCertificate.
+
+	The certificate key stands for the password of every bound identity. It
+	is never generated: it must be provisioned along with the CA bundle and
+	kept outside the data directory, so that a copy of the data is of no
+	use without it.
+*/
+
+// minCertificateKeySize is the size of the certificate key, in bytes.
+const minCertificateKeySize = 32
+
+// certificateMapping ties a client certificate identity to a user account.
+type certificateMapping struct {
+	Identity string `json:"identity"`
+	UserUUID string `json:"user_uuid"`
+}
+
+var certificateMappings []*certificateMapping
+
+// loadClientCAs returns a TLS config verifying the client certificates
+// given against the CA bundle. Clients may still authenticate otherwise.
+func loadClientCAs(filename string) (*tls.Config, error) {
+	bundle, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("no certificate in CA bundle")
+	}
+
+	return &tls.Config{
+		ClientCAs:  clientCAs,
+		ClientAuth: tls.VerifyClientCertIfGiven}, nil
+}
+
+// loadCertificateKey reads the provisioned certificate key from filename.
+// It fails if there is none or it is too short.
+func loadCertificateKey(filename string) ([]byte, error) {
+	key, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < minCertificateKeySize {
+		return nil, fmt.Errorf("%s holds %d bytes, at least %d are needed",
+			filename, len(key), minCertificateKeySize)
+	}
+	return key, nil
+}
+
+func loadCertificateMappings(
+	filename string) ([]*certificateMapping, error) {
+
+	mappings := make([]*certificateMapping, 0)
+	blob, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return mappings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(blob, &mappings); err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+func certificateIdentities(certificate *x509.Certificate) []string {
+	identities := []string{"subject:" + certificate.Subject.String()}
+	for _, dnsName := range certificate.DNSNames {
+		identities = append(identities, "dns:"+dnsName)
+	}
+	for _, uri := range certificate.URIs {
+		identities = append(identities, "uri:"+uri.String())
+	}
+	for _, emailAddress := range certificate.EmailAddresses {
+		identities = append(identities, "email:"+emailAddress)
+	}
+	return identities
+}
+
+// authenticateCertificate maps the verified client certificate of the
+// request to a user account, nil if there is none or it is not mapped.
+func authenticateCertificate(req *http.Request) (*identity, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+
+	identities := certificateIdentities(req.TLS.VerifiedChains[0][0])
+	for _, mapping := range certificateMappings {
+		for _, certificateIdentity := range identities {
+			if mapping.Identity != certificateIdentity {
+				continue
+			}
+			credential, err := h.CertificateCredential(certificateIdentity)
+			if err != nil {
+				return nil, err
+			}
+			return &identity{userUUID: mapping.UserUUID,
+				userPwd: credential}, nil
+		}
+	}
+	return nil, nil
+}
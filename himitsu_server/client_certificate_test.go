@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// doWithCertificate serves the request as sent with the verified client
+// certificate, without Authorization header, and returns its response.
+func (s *testServer) doWithCertificate(method, url string,
+	certificate *x509.Certificate) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(method, url, nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{certificate}}}
+
+	rw := httptest.NewRecorder()
+	s.router.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestCertificateBindAuthenticateUnbind(t *testing.T) {
+	s, teardown := setupServer(t)
+	defer teardown()
+
+	repoUUID, adminUUID := s.createRepository()
+	secretURL := "/v2/repositories/" + repoUUID + "/secrets/hello"
+	bindingsURL := "/v2/repositories/" + repoUUID + "/certificates"
+	identity := "uri:spiffe://acme/ci"
+	ciURL, err := url.Parse("spiffe://acme/ci")
+	s.Nil(err)
+	certificate := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "ci"},
+		URIs:    []*url.URL{ciURL}}
+
+	certificateMappings = []*certificateMapping{
+		{Identity: identity, UserUUID: adminUUID}}
+	defer func() { certificateMappings = nil }()
+
+	// bindings need the provisioned certificate key
+	binding := []byte(`{"identity": "` + identity + `", "user_uuid": "` +
+		adminUUID + `"}`)
+	rw := s.do("POST", bindingsURL, adminUUID, "password", binding, nil)
+	s.Equal(http.StatusBadRequest, rw.Code, rw.Body.String())
+
+	certificateKey := make([]byte, minCertificateKeySize)
+	certificateKey[0] = 1
+	h.SetCertificateKey(certificateKey)
+
+	// a mapped certificate is nothing without its binding
+	rw = s.doWithCertificate("GET", secretURL, certificate)
+	s.Equal(http.StatusUnauthorized, rw.Code, rw.Body.String())
+
+	rw = s.do("POST", bindingsURL, adminUUID, "password", binding, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+
+	rw = s.doWithCertificate("GET", secretURL, certificate)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	s.Equal("Hello World !", rw.Body.String())
+
+	// a certificate without mapped identity is not authenticated
+	rw = s.doWithCertificate("GET", secretURL,
+		&x509.Certificate{Subject: pkix.Name{CommonName: "other"}})
+	s.Equal(http.StatusUnauthorized, rw.Code, rw.Body.String())
+
+	rw = s.do("DELETE", bindingsURL+"?identity="+url.QueryEscape(identity),
+		adminUUID, "password", nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+
+	rw = s.doWithCertificate("GET", secretURL, certificate)
+	s.Equal(http.StatusUnauthorized, rw.Code, rw.Body.String())
+	rw = s.do("DELETE", bindingsURL+"?identity="+url.QueryEscape(identity),
+		adminUUID, "password", nil, nil)
+	s.Equal(http.StatusNotFound, rw.Code, rw.Body.String())
+}
+
+func TestLoadCertificateKeyIsNeverGenerated(t *testing.T) {
+	s, teardown := setupServer(t)
+	defer teardown()
+
+	dir, err := ioutil.TempDir("", "himitsu_server")
+	s.Nil(err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "certificate_key")
+
+	_, err = loadCertificateKey(filename)
+	s.True(os.IsNotExist(err))
+	_, err = os.Stat(filename)
+	s.True(os.IsNotExist(err))
+
+	s.Nil(ioutil.WriteFile(filename, []byte("short"), 0600))
+	_, err = loadCertificateKey(filename)
+	s.NotNil(err)
+
+	key := make([]byte, minCertificateKeySize)
+	s.Nil(ioutil.WriteFile(filename, key, 0600))
+	loadedKey, err := loadCertificateKey(filename)
+	s.Nil(err)
+	s.Equal(key, loadedKey)
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"crypto/sha256"
+	"crypto/tls"
+	"flag"
+	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/pagedegeek/himitsu"
 	"github.com/pagedegeek/himitsu/crypto_engine"
@@ -9,8 +12,10 @@ import (
 	"github.com/pagedegeek/himitsu/password_derivation"
 	"github.com/pagedegeek/himitsu/salt_generation"
 	"github.com/pagedegeek/himitsu/uuid_generation"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 )
 
 var (
@@ -18,10 +23,51 @@ var (
 )
 
 func main() {
+	legacyAPI := flag.Bool("legacy-api", false,
+		"also serve the deprecated query string API, which puts passwords "+
+			"and secrets in URLs")
+	flag.Int64Var(&maxBodySize, "max-body-size", maxBodySize,
+		"maximum size of a request body, in bytes")
+	sessionTTL := flag.Duration("session-ttl", himitsu.DefaultSessionTTL,
+		"lifetime of the sessions opened by POST /v2/sessions")
+	clientCAFile := flag.String("client-ca", "",
+		"CA bundle verifying client certificates, enables mutual TLS")
+	clientCertificatesFile := flag.String("client-certificates",
+		"../client_certificates.json",
+		"mapping of client certificate identities to user accounts")
+	certificateKeyFile := flag.String("certificate-key",
+		"../certificate_key",
+		"provisioned key certificate credentials derive from, kept outside "+
+			"the data directory; required by -client-ca")
+	lockoutThreshold := flag.Uint64("lockout-threshold",
+		himitsu.DefaultLockoutPolicy.LockoutThreshold,
+		"failed unwraps locking a user account or client out, 0 for never")
+	lockoutDuration := flag.Duration("lockout-duration",
+		himitsu.DefaultLockoutPolicy.LockoutDuration,
+		"how long a lockout lasts unless an admin clears it")
+	operatorTokenFile := flag.String("operator-token", "",
+		"file holding the token of the server operator, who manages client "+
+			"lockouts; none turns the operator routes off")
+	passwordMinLength := flag.Int("password-min-length", 12,
+		"minimum length of new passwords")
+	passwordMinEntropy := flag.Float64("password-min-entropy", 28,
+		"minimum estimated entropy of new passwords, in bits")
+	passwordDenylistFile := flag.String("password-denylist",
+		"../password_denylist.txt",
+		"breached passwords refused as new passwords, one per line")
+	passwordDerivation := flag.String("password-derivation", "argon2id",
+		"algorithm deriving new passwords: argon2id, scrypt or pbkdf2")
+	maxConcurrentDerivations := flag.Int("max-concurrent-derivations",
+		himitsu.DefaultMaxConcurrentDerivations,
+		"password derivations running at once, the others wait")
+	flag.Parse()
+
 	saltGenerator := salt_generation.NewDefaultSaltGenerator()
 	uuidGenerator := uuid_generation.NewDefaultUUIDGenerator()
-	pwdDerivator := password_derivation.NewPBKDF2PasswordDerivator(
-		32, 10000, sha256.New)
+	pwdDerivator, err := newPasswordDerivator(*passwordDerivation)
+	if err != nil {
+		log.Fatalf("Can't set up password derivation: %s", err.Error())
+	}
 	cryptoEngine := crypto_engine.NewAESCFBEngine()
 	dataAccess, err := data_access.NewDefaultDataAccess("/tmp/himitsu.bin")
 	if err != nil {
@@ -30,22 +76,194 @@ func main() {
 
 	h = himitsu.NewHimitsu(saltGenerator, uuidGenerator, pwdDerivator,
 		cryptoEngine, dataAccess)
+	// user accounts enrolled before the parameters were stored
+	h.SetLegacyPasswordDerivator(
+		password_derivation.NewPBKDF2PasswordDerivator(32, 10000, sha256.New))
+
+	auditKey, err := loadKey("../audit_key", saltGenerator)
+	if err != nil {
+		log.Fatalf("Can't load audit key: %s", err.Error())
+	}
+	if len(auditKey) == 0 {
+		log.Fatal("Can't start with an empty audit key")
+	}
+	h.SetAuditKey(auditKey)
+	h.SetSessionTTL(*sessionTTL)
+	h.SetMaxConcurrentDerivations(*maxConcurrentDerivations)
+
+	passwordPolicy := himitsu.PasswordPolicy{
+		MinLength:  *passwordMinLength,
+		MinEntropy: *passwordMinEntropy}
+	passwordPolicy.Denylist, err = himitsu.LoadPasswordDenylist(
+		*passwordDenylistFile)
+	if os.IsNotExist(err) {
+		log.Printf("No password denylist at %s", *passwordDenylistFile)
+	} else if err != nil {
+		log.Fatalf("Can't load password denylist: %s", err.Error())
+	}
+	h.SetPasswordPolicy(passwordPolicy)
+
+	lockoutPolicy := himitsu.DefaultLockoutPolicy
+	lockoutPolicy.LockoutThreshold = *lockoutThreshold
+	lockoutPolicy.LockoutDuration = *lockoutDuration
+	h.SetLockoutPolicy(lockoutPolicy)
+
+	if *operatorTokenFile != "" {
+		operatorTokenHash, err = loadOperatorToken(*operatorTokenFile)
+		if err != nil {
+			log.Fatalf("Can't load operator token: %s", err.Error())
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if *clientCAFile != "" {
+		tlsConfig, err = loadClientCAs(*clientCAFile)
+		if err != nil {
+			log.Fatalf("Can't load client CAs: %s", err.Error())
+		}
+		certificateKey, err := loadCertificateKey(*certificateKeyFile)
+		if err != nil {
+			log.Fatalf("Can't load certificate key: %s", err.Error())
+		}
+		h.SetCertificateKey(certificateKey)
+		certificateMappings, err = loadCertificateMappings(
+			*clientCertificatesFile)
+		if err != nil {
+			log.Fatalf("Can't load client certificates: %s", err.Error())
+		}
+	}
 
 	router := mux.NewRouter()
+	router.Use(throttleClients)
+	registerV2Routes(router)
+	if *legacyAPI {
+		log.Print("The query string API is deprecated, " +
+			"start without -legacy-api once clients use /v2")
+		registerLegacyRoutes(router)
+	}
+
+	certFile := "../public_key"
+	keyFile := "../private_key"
+	server := http.Server{Addr: ":8443", Handler: router,
+		TLSConfig: tlsConfig}
+	if err := server.ListenAndServeTLS(certFile, keyFile); err != nil {
+		log.Fatalf("Can't start server: %s", err.Error())
+		return
+	}
+}
+
+// newPasswordDerivator returns the derivator of new passwords. User
+// accounts keep the parameters they enrolled with until their password
+// changes.
+func newPasswordDerivator(
+	algorithm string) (password_derivation.PasswordDerivator, error) {
+
+	switch algorithm {
+	case "argon2id":
+		// RFC 9106 second recommended option
+		return password_derivation.NewArgon2idPasswordDerivator(
+			32, 3, 64*1024, 4), nil
+	case "scrypt":
+		pwdDerivator, err := password_derivation.NewScryptPasswordDerivator(
+			32, 32768, 8, 1)
+		if err != nil {
+			return nil, err
+		}
+		return pwdDerivator, nil
+	case "pbkdf2":
+		return password_derivation.NewPBKDF2PasswordDerivator(
+			32, 600000, sha256.New), nil
+	}
+	return nil, fmt.Errorf("unknown algorithm '%s'", algorithm)
+}
+
+// loadKey reads a server key, such as the audit key, from filename,
+// generating it on first start.
+func loadKey(filename string,
+	saltGenerator salt_generation.SaltGenerator) ([]byte, error) {
+
+	key, err := ioutil.ReadFile(filename)
+	if err == nil {
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err = saltGenerator.Call(32)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filename, key, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// registerLegacyRoutes registers the deprecated routes taking passwords and
+// secret values in the query string.
+func registerLegacyRoutes(parent *mux.Router) {
+	router := parent.NewRoute().Subrouter()
+	router.Use(deprecated)
 	router.HandleFunc("/repositories", handleCreateRepository).
 		Methods("POST", "PUT")
+	router.HandleFunc("/repositories/{repo_uuid}/users",
+		handleAddUserAccount).Methods("POST")
+	router.HandleFunc("/repositories/{repo_uuid}/users",
+		handleListUserAccounts).Methods("GET")
+	router.HandleFunc("/repositories/{repo_uuid}/users/{account_uuid}",
+		handleInviteUserAccount).Methods("POST")
+	router.HandleFunc("/repositories/{repo_uuid}/users/{account_uuid}",
+		handleUpdateUserAccountRights).Methods("PUT")
+	router.HandleFunc("/repositories/{repo_uuid}/users/{account_uuid}",
+		handleRemoveUserAccount).Methods("DELETE")
+	router.HandleFunc(
+		"/repositories/{repo_uuid}/users/{account_uuid}/policies",
+		handleSetUserAccountPolicies).Methods("PUT")
+	router.HandleFunc("/repositories/{repo_uuid}/policies",
+		handleListPolicies).Methods("GET")
+	router.HandleFunc("/repositories/{repo_uuid}/policies/{policy_name}",
+		handleSetPolicy).Methods("PUT")
+	router.HandleFunc("/repositories/{repo_uuid}/policies/{policy_name}",
+		handleDeletePolicy).Methods("DELETE")
+	router.HandleFunc("/repositories/{repo_uuid}/rotate_key",
+		handleRotateRepositoryKey).Methods("POST")
+	router.HandleFunc("/repositories/{repo_uuid}/audit",
+		handleListAuditEntries).Methods("GET")
+	router.HandleFunc("/users/{user_uuid}/repositories",
+		handleListRepositoriesForUser).Methods("GET")
+	router.HandleFunc("/users/{user_uuid}/password",
+		handleChangeUserPassword).Methods("POST", "PUT")
 	router.HandleFunc("/secrets", handleCreateSecret).
 		Methods("POST", "PUT")
 	router.HandleFunc("/secrets", handleListSecrets).
 		Methods("GET")
-	router.HandleFunc("/secrets/{secret_name}", handleReadSecret).
+	router.HandleFunc("/expiring_secrets", handleListExpiringSecrets).
 		Methods("GET")
+	router.HandleFunc("/batch", handleBatch).
+		Methods("POST")
+	// secret names may span several path segments, such as
+	// db/prod/password, so suffixed routes must come first.
+	router.HandleFunc("/secrets/{secret_name:.+}/rename",
+		handleRenameSecret).Methods("POST")
+	router.HandleFunc("/secrets/{secret_name:.+}/metadata",
+		handleReadSecretMetadata).Methods("GET")
+	router.HandleFunc("/secrets/{secret_name:.+}/versions",
+		handleListSecretVersions).Methods("GET")
+	router.HandleFunc("/secrets/{secret_name:.+}/rollback",
+		handleRollbackSecret).Methods("POST")
+	router.HandleFunc("/secrets/{secret_name:.+}", handleReadSecret).
+		Methods("GET")
+	router.HandleFunc("/secrets/{secret_name:.+}", handleDeleteSecret).
+		Methods("DELETE")
+}
 
-	certFile := "../public_key"
-	keyFile := "../private_key"
-	server := http.Server{Addr: ":8443", Handler: router}
-	if err := server.ListenAndServeTLS(certFile, keyFile); err != nil {
-		log.Fatal("Can't start server: %s", err.Error())
-		return
-	}
+// deprecated flags the responses of the legacy routes as such, pointing to
+// the v2 API.
+func deprecated(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Deprecation", "true")
+		rw.Header().Set("Link", `</v2>; rel="successor-version"`)
+		handler.ServeHTTP(rw, req)
+	})
 }
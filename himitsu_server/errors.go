@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/pagedegeek/himitsu"
+	"log"
+	"net/http"
+)
+
+// errorBody is the JSON body of every error response. Its message never
+// carries internal details: unexpected errors are logged, not returned.
+type errorBody struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	// FailedRules lists the password policy rules a weak password fails.
+	FailedRules []string `json:"failed_rules,omitempty"`
+}
+
+func writeErrorBody(rw http.ResponseWriter, status int, code, message string) {
+	writeErrorResponse(rw, status, &errorBody{Error: code, Message: message})
+}
+
+func writeErrorResponse(rw http.ResponseWriter, status int, body *errorBody) {
+	blob, err := json.Marshal(body)
+	if err != nil {
+		log.Print(err)
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(status)
+	rw.Write(blob)
+}
+
+func writeBadRequest(rw http.ResponseWriter, message string) {
+	writeErrorBody(rw, http.StatusBadRequest, "bad_request", message)
+}
+
+func writeError(rw http.ResponseWriter, err error) {
+	switch err := himitsu.ClassifyError(err).(type) {
+	case *himitsu.ErrInvalidCredentials:
+		markInvalidCredentials(rw)
+		writeErrorBody(rw, http.StatusUnauthorized,
+			"invalid_credentials", "Invalid credentials")
+	case *himitsu.ErrTooManyAttempts:
+		rw.Header().Set("Retry-After", retryAfterSeconds(err.RetryAfter()))
+		writeErrorBody(rw, http.StatusTooManyRequests,
+			"too_many_attempts", "Too many failed attempts")
+	case *himitsu.ErrWeakPassword:
+		writeErrorResponse(rw, http.StatusUnprocessableEntity, &errorBody{
+			Error:       "weak_password",
+			Message:     "Password is too weak",
+			FailedRules: err.FailedRules()})
+	case *himitsu.ErrForbidden:
+		writeErrorBody(rw, http.StatusForbidden, "forbidden", "Forbidden")
+	case *himitsu.ErrNotFound:
+		writeErrorBody(rw, http.StatusNotFound, "not_found", "Not found")
+	case *himitsu.ErrConflict, *himitsu.ErrSecretAlreadyExists:
+		writeErrorBody(rw, http.StatusConflict, "conflict", "Conflict")
+	case *himitsu.ErrSecretOutsideValidity:
+		writeErrorBody(rw, http.StatusGone,
+			"gone", "Secret is outside its validity window")
+	case *himitsu.ErrInvalidSecretName, *himitsu.ErrUnknownRight,
+		*himitsu.ErrLastAdminUserAccount, *himitsu.ErrInvalidPolicy,
+		*himitsu.ErrInvalidAPIKey, *himitsu.ErrNotServiceAccount,
+		*himitsu.ErrServiceAccountAdmin, *himitsu.ErrTOTPState,
+		*himitsu.ErrNoCertificateKey, *himitsu.ErrInvalidValidityWindow:
+		// these only describe the request
+		writeBadRequest(rw, err.Error())
+	default:
+		log.Print(err)
+		writeErrorBody(rw, http.StatusInternalServerError,
+			"internal_error", "Internal error")
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"github.com/gorilla/mux"
 	"github.com/pagedegeek/himitsu"
-	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func handleCreateRepository(rw http.ResponseWriter, req *http.Request) {
@@ -17,8 +19,7 @@ func handleCreateRepository(rw http.ResponseWriter, req *http.Request) {
 	repoUUID, userAccountUUID, err := h.CreateRepository(
 		repoLabel, userLabel, userPwd)
 	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		log.Print(err)
+		writeError(rw, err)
 		return
 	}
 
@@ -29,8 +30,7 @@ func handleCreateRepository(rw http.ResponseWriter, req *http.Request) {
 
 	blob, err := json.Marshal(data)
 	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		log.Print(err)
+		writeError(rw, err)
 		return
 	}
 
@@ -44,17 +44,19 @@ func handleListSecrets(rw http.ResponseWriter, req *http.Request) {
 	userUUID := req.URL.Query().Get("user_uuid")
 	userPwd := req.URL.Query().Get("user_pwd")
 
-	secretNames, err := h.ListSecretNames(repoUUID, userUUID, userPwd)
+	prefix := req.URL.Query().Get("prefix")
+	recursive := req.URL.Query().Get("recursive") == "true"
+
+	secretNames, err := h.ListSecretNames(
+		repoUUID, userUUID, userPwd, prefix, recursive)
 	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte(err.Error()))
+		writeError(rw, err)
 		return
 	}
 
 	blob, err := json.Marshal(secretNames)
 	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte(err.Error()))
+		writeError(rw, err)
 		return
 	}
 
@@ -70,19 +72,29 @@ func handleReadSecret(rw http.ResponseWriter, req *http.Request) {
 	userUUID := req.URL.Query().Get("user_uuid")
 	userPwd := req.URL.Query().Get("user_pwd")
 	format := req.URL.Query().Get("format")
+	version := req.URL.Query().Get("version")
 
-	secret, err := h.ReadSecret(
-		repoUUID, userUUID, userPwd, secretName)
-	defer himitsu.Zero(secret)
-	if err != nil {
-		if _, ok := err.(*himitsu.ErrUnknownSecret); ok {
-			rw.WriteHeader(http.StatusNotFound)
-			rw.Write([]byte(err.Error()))
+	var secret []byte
+	var err error
+	if version == "" {
+		var revision uint64
+		secret, revision, err = h.ReadSecretWithRevision(
+			repoUUID, userUUID, userPwd, secretName)
+		if err == nil {
+			rw.Header().Set("ETag", formatETag(revision))
+		}
+	} else {
+		v, convErr := strconv.Atoi(version)
+		if convErr != nil {
+			writeBadRequest(rw, "invalid version")
 			return
 		}
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte(err.Error()))
-		log.Print(err)
+		secret, err = h.ReadSecretVersion(
+			repoUUID, userUUID, userPwd, secretName, v)
+	}
+	defer himitsu.Zero(secret)
+	if err != nil {
+		writeError(rw, err)
 		return
 	}
 
@@ -95,8 +107,7 @@ func handleReadSecret(rw http.ResponseWriter, req *http.Request) {
 		rw.WriteHeader(http.StatusOK)
 		rw.Write([]byte(s))
 	} else {
-		rw.WriteHeader(http.StatusBadRequest)
-		rw.Write([]byte("unknow format"))
+		writeBadRequest(rw, "unknow format")
 	}
 }
 
@@ -107,10 +118,587 @@ func handleCreateSecret(rw http.ResponseWriter, req *http.Request) {
 	secretName := req.URL.Query().Get("secret_name")
 	secretValue := req.URL.Query().Get("secret_value")
 
-	err := h.WriteSecret(repoUUID, userUUID, userPwd, secretName, []byte(secretValue))
+	opts, ok := parseWriteSecretOptions(rw, req)
+	if !ok {
+		return
+	}
+
+	writeSecret(rw, req, repoUUID, userUUID, userPwd, secretName,
+		[]byte(secretValue), opts)
+}
+
+// parseWriteSecretOptions reads the secret metadata query parameters. The
+// options are nil, keeping the current metadata, when none is given.
+func parseWriteSecretOptions(rw http.ResponseWriter,
+	req *http.Request) (*himitsu.WriteSecretOptions, bool) {
+
+	query := req.URL.Query()
+	var opts *himitsu.WriteSecretOptions
+	for _, metadataParam := range []string{"description", "tags",
+		"content_type", "not_before", "not_after"} {
+		if _, ok := query[metadataParam]; ok {
+			opts = &himitsu.WriteSecretOptions{
+				Description: query.Get("description"),
+				Tags:        parseList(query.Get("tags")),
+				ContentType: query.Get("content_type")}
+			break
+		}
+	}
+	if opts != nil {
+		var err error
+		if opts.NotBefore, err = parseTime(query.Get("not_before")); err != nil {
+			writeBadRequest(rw, "invalid not_before")
+			return nil, false
+		}
+		if opts.NotAfter, err = parseTime(query.Get("not_after")); err != nil {
+			writeBadRequest(rw, "invalid not_after")
+			return nil, false
+		}
+	}
+	return opts, true
+}
+
+// writeSecret writes the secret, only if the repository is still at the
+// revision of the If-Match header when there is one.
+func writeSecret(rw http.ResponseWriter, req *http.Request,
+	repoUUID, userUUID, userPwd, secretName string, secretValue []byte,
+	opts *himitsu.WriteSecretOptions) {
+
+	ifMatch := req.Header.Get("If-Match")
+	var err error
+	if ifMatch == "" || ifMatch == "*" {
+		err = h.WriteSecret(repoUUID, userUUID, userPwd, secretName,
+			secretValue, opts)
+	} else {
+		revision, parseErr := parseETag(ifMatch)
+		if parseErr != nil {
+			writeBadRequest(rw, "invalid If-Match")
+			return
+		}
+		var newRevision uint64
+		newRevision, err = h.WriteSecretIfRevision(repoUUID, userUUID,
+			userPwd, secretName, secretValue, opts, revision)
+		if _, ok := err.(*himitsu.ErrConflict); ok {
+			writeErrorBody(rw, http.StatusPreconditionFailed,
+				"precondition_failed", "Repository revision does not match")
+			return
+		}
+		if err == nil {
+			rw.Header().Set("ETag", formatETag(newRevision))
+		}
+	}
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("OK"))
+}
+
+// The ETag of a secret is the revision of its repository.
+func formatETag(revision uint64) string {
+	return `"` + strconv.FormatUint(revision, 10) + `"`
+}
+
+func parseETag(etag string) (uint64, error) {
+	return strconv.ParseUint(strings.Trim(etag, `"`), 10, 64)
+}
+
+// batchOperation and batchResult carry secret values base64 encoded, as
+// encoding/json does with []byte, so that binary values go through intact.
+type batchOperation struct {
+	Op      string `json:"op"`
+	Name    string `json:"name"`
+	Value   []byte `json:"value,omitempty"`
+	NewName string `json:"new_name,omitempty"`
+}
+
+type batchResult struct {
+	Op    string `json:"op"`
+	Name  string `json:"name"`
+	Value []byte `json:"value,omitempty"`
+}
+
+func handleBatch(rw http.ResponseWriter, req *http.Request) {
+	repoUUID := req.URL.Query().Get("repo_uuid")
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+
+	applyBatch(rw, req, repoUUID, userUUID, userPwd)
+}
+
+// applyBatch applies a JSON list of read, write, delete and rename
+// operations to the repository at once: either all of them or none are
+// saved.
+func applyBatch(rw http.ResponseWriter, req *http.Request,
+	repoUUID, userUUID, userPwd string) {
+
+	operations := make([]*batchOperation, 0)
+	if !decodeJSON(rw, req, &operations) {
+		return
+	}
+	for _, operation := range operations {
+		switch operation.Op {
+		case "read", "write", "delete", "rename":
+		default:
+			writeBadRequest(rw, "unknown op '"+operation.Op+"'")
+			return
+		}
+	}
+
+	var results []*batchResult
+	err := h.Update(repoUUID, userUUID, userPwd,
+		func(tx *himitsu.RepositoryTx) error {
+			results = make([]*batchResult, 0, len(operations))
+			for _, operation := range operations {
+				result := &batchResult{Op: operation.Op, Name: operation.Name}
+				var err error
+				switch operation.Op {
+				case "read":
+					result.Value, err = tx.ReadSecret(operation.Name)
+				case "write":
+					err = tx.WriteSecret(operation.Name, operation.Value, nil)
+				case "delete":
+					err = tx.DeleteSecret(operation.Name)
+				case "rename":
+					err = tx.RenameSecret(operation.Name, operation.NewName)
+				}
+				if err != nil {
+					return err
+				}
+				results = append(results, result)
+			}
+			return nil
+		})
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	blob, err := json.Marshal(results)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(blob)
+}
+
+func handleDeleteSecret(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	secretName := vars["secret_name"]
+	repoUUID := req.URL.Query().Get("repo_uuid")
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+
+	err := h.DeleteSecret(repoUUID, userUUID, userPwd, secretName)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("OK"))
+}
+
+func handleRenameSecret(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	secretName := vars["secret_name"]
+	repoUUID := req.URL.Query().Get("repo_uuid")
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+	newSecretName := req.URL.Query().Get("new_secret_name")
+
+	err := h.RenameSecret(repoUUID, userUUID, userPwd,
+		secretName, newSecretName)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("OK"))
+}
+
+func handleListExpiringSecrets(rw http.ResponseWriter, req *http.Request) {
+	repoUUID := req.URL.Query().Get("repo_uuid")
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+
+	within, err := time.ParseDuration(req.URL.Query().Get("within"))
+	if err != nil {
+		writeBadRequest(rw, "invalid within")
+		return
+	}
+
+	expiringSecrets, err := h.ListExpiringSecrets(
+		repoUUID, userUUID, userPwd, within)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	blob, err := json.Marshal(expiringSecrets)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(blob)
+}
+
+func handleReadSecretMetadata(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	secretName := vars["secret_name"]
+	repoUUID := req.URL.Query().Get("repo_uuid")
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+
+	metadata, err := h.ReadSecretMetadata(
+		repoUUID, userUUID, userPwd, secretName)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	blob, err := json.Marshal(metadata)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(blob)
+}
+
+func handleListSecretVersions(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	secretName := vars["secret_name"]
+	repoUUID := req.URL.Query().Get("repo_uuid")
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+
+	versions, err := h.ListSecretVersions(
+		repoUUID, userUUID, userPwd, secretName)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	blob, err := json.Marshal(versions)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(blob)
+}
+
+func handleRollbackSecret(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	secretName := vars["secret_name"]
+	repoUUID := req.URL.Query().Get("repo_uuid")
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+
+	version, err := strconv.Atoi(req.URL.Query().Get("version"))
+	if err != nil {
+		writeBadRequest(rw, "invalid version")
+		return
+	}
+
+	err = h.RollbackSecret(repoUUID, userUUID, userPwd, secretName, version)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("OK"))
+}
+
+// parseTime parses an optional RFC 3339 query parameter, an empty one
+// gives the zero time.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseList splits a comma separated query parameter, such as rights or
+// tags, ignoring empty items.
+func parseList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func handleAddUserAccount(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	repoUUID := vars["repo_uuid"]
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+	newUserLabel := req.URL.Query().Get("new_user_label")
+	newUserPwd := req.URL.Query().Get("new_user_pwd")
+	rights := parseList(req.URL.Query().Get("rights"))
+
+	newUserUUID, err := h.AddUserAccount(repoUUID, userUUID, userPwd,
+		newUserLabel, newUserPwd, rights)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	data := make(map[string]string)
+	data["user_label"] = newUserLabel
+	data["user_uuid"] = newUserUUID
+
+	blob, err := json.Marshal(data)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(blob)
+}
+
+func handleInviteUserAccount(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	repoUUID := vars["repo_uuid"]
+	accountUUID := vars["account_uuid"]
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+	accountLabel := req.URL.Query().Get("account_label")
+	rights := parseList(req.URL.Query().Get("rights"))
+
+	err := h.InviteUserAccount(repoUUID, userUUID, userPwd,
+		accountUUID, accountLabel, rights)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("OK"))
+}
+
+func handleListUserAccounts(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	repoUUID := vars["repo_uuid"]
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+
+	userAccounts, err := h.ListUserAccounts(repoUUID, userUUID, userPwd)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	blob, err := json.Marshal(userAccounts)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(blob)
+}
+
+func handleUpdateUserAccountRights(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	repoUUID := vars["repo_uuid"]
+	accountUUID := vars["account_uuid"]
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+	rights := parseList(req.URL.Query().Get("rights"))
+
+	err := h.UpdateUserAccountRights(repoUUID, userUUID, userPwd,
+		accountUUID, rights)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("OK"))
+}
+
+func handleRemoveUserAccount(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	repoUUID := vars["repo_uuid"]
+	accountUUID := vars["account_uuid"]
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+
+	err := h.RemoveUserAccount(repoUUID, userUUID, userPwd, accountUUID)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("OK"))
+}
+
+func handleChangeUserPassword(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	userUUID := vars["user_uuid"]
+	userPwd := req.URL.Query().Get("user_pwd")
+	newUserPwd := req.URL.Query().Get("new_user_pwd")
+	totpCode := req.URL.Query().Get("totp_code")
+
+	err := h.ChangeUserPassword(userUUID, userPwd, newUserPwd, totpCode)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("OK"))
+}
+
+func handleRotateRepositoryKey(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	repoUUID := vars["repo_uuid"]
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+
+	err := h.RotateRepositoryKey(repoUUID, userUUID, userPwd)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("OK"))
+}
+
+func handleListAuditEntries(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	repoUUID := vars["repo_uuid"]
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+
+	entries, err := h.ListAuditEntries(repoUUID, userUUID, userPwd)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	blob, err := json.Marshal(entries)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(blob)
+}
+
+func handleListRepositoriesForUser(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	userUUID := vars["user_uuid"]
+	userPwd := req.URL.Query().Get("user_pwd")
+	totpCode := req.URL.Query().Get("totp_code")
+
+	repositories, err := h.ListRepositoriesForUser(userUUID, userPwd, totpCode)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	blob, err := json.Marshal(repositories)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(blob)
+}
+
+func handleSetPolicy(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	repoUUID := vars["repo_uuid"]
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+
+	policy := &himitsu.Policy{}
+	if err := json.NewDecoder(req.Body).Decode(policy); err != nil {
+		writeBadRequest(rw, "invalid JSON body")
+		return
+	}
+	policy.Name = vars["policy_name"]
+
+	err := h.SetPolicy(repoUUID, userUUID, userPwd, policy)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("OK"))
+}
+
+func handleListPolicies(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	repoUUID := vars["repo_uuid"]
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+
+	policies, err := h.ListPolicies(repoUUID, userUUID, userPwd)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	blob, err := json.Marshal(policies)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(blob)
+}
+
+func handleDeletePolicy(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	repoUUID := vars["repo_uuid"]
+	policyName := vars["policy_name"]
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+
+	err := h.DeletePolicy(repoUUID, userUUID, userPwd, policyName)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("OK"))
+}
+
+func handleSetUserAccountPolicies(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	repoUUID := vars["repo_uuid"]
+	accountUUID := vars["account_uuid"]
+	userUUID := req.URL.Query().Get("user_uuid")
+	userPwd := req.URL.Query().Get("user_pwd")
+	policies := parseList(req.URL.Query().Get("policies"))
+
+	err := h.SetUserAccountPolicies(repoUUID, userUUID, userPwd,
+		accountUUID, policies)
 	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte(err.Error()))
+		writeError(rw, err)
 		return
 	}
 	rw.WriteHeader(http.StatusOK)
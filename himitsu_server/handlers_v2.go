@@ -0,0 +1,1064 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/pagedegeek/himitsu"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	The v2 API never takes passwords or secret values in the URL, which
+	ends up in access logs and shell history: the user account comes from
+	the Authorization header, see authenticate, and values from the request
+	body, bounded by maxBodySize.
+*/
+
+// maxBodySize bounds the request bodies, secret values included.
+var maxBodySize int64 = 1 << 20
+
+// readBody reads the whole request body. It writes the error response and
+// returns false when the body is too large or cannot be read.
+func readBody(rw http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(rw, req.Body, maxBodySize))
+	if err != nil {
+		writeBodyError(rw, err)
+		return nil, false
+	}
+	return body, true
+}
+
+// decodeJSON decodes the JSON request body into v. It writes the error
+// response and returns false when it cannot.
+func decodeJSON(rw http.ResponseWriter, req *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxBodySize))
+	if err := decoder.Decode(v); err != nil {
+		writeBodyError(rw, err)
+		return false
+	}
+	return true
+}
+
+func writeBodyError(rw http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeErrorBody(rw, http.StatusRequestEntityTooLarge,
+			"payload_too_large", "Request body is too large")
+		return
+	}
+	writeBadRequest(rw, "invalid JSON body")
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	blob, err := json.Marshal(v)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(blob)
+}
+
+func writeOK(rw http.ResponseWriter) {
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("OK"))
+}
+
+// registerV2Routes registers the v2 API under /v2.
+func registerV2Routes(router *mux.Router) {
+	v2 := router.PathPrefix("/v2").Subrouter()
+	v2.HandleFunc("/repositories", handleV2CreateRepository).
+		Methods("POST")
+	v2.HandleFunc("/repositories", handleV2ListRepositories).
+		Methods("GET")
+	v2.HandleFunc("/password", handleV2ChangeUserPassword).
+		Methods("PUT")
+	v2.HandleFunc("/sessions", handleV2Login).Methods("POST")
+	v2.HandleFunc("/operator/lockouts", handleV2ListClientLockouts).
+		Methods("GET")
+	v2.HandleFunc("/operator/lockouts/clients/{client_ip}",
+		handleV2ClearClientLockout).Methods("DELETE")
+	v2.HandleFunc("/totp", handleV2EnrollTOTP).Methods("POST")
+	v2.HandleFunc("/totp/confirm", handleV2ConfirmTOTP).Methods("POST")
+	v2.HandleFunc("/totp/disable", handleV2DisableTOTP).Methods("POST")
+
+	repo := v2.PathPrefix("/repositories/{repo_uuid}").Subrouter()
+	repo.HandleFunc("/users", handleV2AddUserAccount).Methods("POST")
+	repo.HandleFunc("/users", handleV2ListUserAccounts).Methods("GET")
+	repo.HandleFunc("/users/{account_uuid}",
+		handleV2InviteUserAccount).Methods("POST")
+	repo.HandleFunc("/users/{account_uuid}",
+		handleV2UpdateUserAccountRights).Methods("PUT")
+	repo.HandleFunc("/users/{account_uuid}",
+		handleV2RemoveUserAccount).Methods("DELETE")
+	repo.HandleFunc("/users/{account_uuid}/policies",
+		handleV2SetUserAccountPolicies).Methods("PUT")
+	repo.HandleFunc("/invitation", handleV2AcceptInvitation).Methods("POST")
+	repo.HandleFunc("/invitations/{account_uuid}",
+		handleV2RevokeInvitation).Methods("DELETE")
+	repo.HandleFunc("/policies", handleV2ListPolicies).Methods("GET")
+	repo.HandleFunc("/policies/{policy_name}", handleV2SetPolicy).
+		Methods("PUT")
+	repo.HandleFunc("/policies/{policy_name}", handleV2DeletePolicy).
+		Methods("DELETE")
+	repo.HandleFunc("/rotate_key", handleV2RotateRepositoryKey).
+		Methods("POST")
+	repo.HandleFunc("/audit", handleV2ListAuditEntries).Methods("GET")
+	repo.HandleFunc("/sessions", handleV2ListSessions).Methods("GET")
+	repo.HandleFunc("/lockouts", handleV2ListLockouts).Methods("GET")
+	repo.HandleFunc("/lockouts/users/{account_uuid}",
+		handleV2ClearUserAccountLockout).Methods("DELETE")
+	repo.HandleFunc("/service_accounts", handleV2AddServiceAccount).
+		Methods("POST")
+	repo.HandleFunc("/service_accounts/{account_uuid}/api_keys",
+		handleV2CreateAPIKey).Methods("POST")
+	repo.HandleFunc("/api_keys", handleV2ListAPIKeys).Methods("GET")
+	repo.HandleFunc("/certificates", handleV2BindCertificate).
+		Methods("POST")
+	repo.HandleFunc("/certificates", handleV2ListCertificateBindings).
+		Methods("GET")
+	repo.HandleFunc("/certificates", handleV2UnbindCertificate).
+		Methods("DELETE")
+	repo.HandleFunc("/api_keys/{api_key_id}", handleV2RevokeAPIKey).
+		Methods("DELETE")
+	repo.HandleFunc("/sessions/{session_id}", handleV2RevokeSession).
+		Methods("DELETE")
+	repo.HandleFunc("/batch", handleV2Batch).Methods("POST")
+	repo.HandleFunc("/expiring_secrets", handleV2ListExpiringSecrets).
+		Methods("GET")
+	repo.HandleFunc("/secrets", handleV2ListSecrets).Methods("GET")
+	// as for the legacy routes, suffixed routes must come first.
+	repo.HandleFunc("/secrets/{secret_name:.+}/rename",
+		handleV2RenameSecret).Methods("POST")
+	repo.HandleFunc("/secrets/{secret_name:.+}/metadata",
+		handleV2ReadSecretMetadata).Methods("GET")
+	repo.HandleFunc("/secrets/{secret_name:.+}/versions",
+		handleV2ListSecretVersions).Methods("GET")
+	repo.HandleFunc("/secrets/{secret_name:.+}/rollback",
+		handleV2RollbackSecret).Methods("POST")
+	repo.HandleFunc("/secrets/{secret_name:.+}", handleV2ReadSecret).
+		Methods("GET")
+	repo.HandleFunc("/secrets/{secret_name:.+}", handleV2WriteSecret).
+		Methods("PUT")
+	repo.HandleFunc("/secrets/{secret_name:.+}", handleV2DeleteSecret).
+		Methods("DELETE")
+}
+
+type createRepositoryRequest struct {
+	RepositoryLabel string `json:"repository_label"`
+	UserLabel       string `json:"user_label"`
+	UserPassword    string `json:"user_password"`
+}
+
+func handleV2CreateRepository(rw http.ResponseWriter, req *http.Request) {
+	body := &createRepositoryRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	repoUUID, userAccountUUID, err := h.CreateRepository(
+		body.RepositoryLabel, body.UserLabel, body.UserPassword)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	writeJSON(rw, map[string]string{
+		"repository_label": body.RepositoryLabel,
+		"repository_uuid":  repoUUID,
+		"user_uuid":        userAccountUUID})
+}
+
+func handleV2ListRepositories(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+
+	repositories, err := h.ListRepositoriesForUser(
+		id.userUUID, id.userPwd, id.totpCode)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeJSON(rw, repositories)
+}
+
+type changeUserPasswordRequest struct {
+	NewPassword string `json:"new_password"`
+}
+
+func handleV2ChangeUserPassword(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	body := &changeUserPasswordRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	err := h.ChangeUserPassword(
+		id.userUUID, id.userPwd, body.NewPassword, id.totpCode)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+func handleV2ListSecrets(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	repoUUID := mux.Vars(req)["repo_uuid"]
+	prefix := req.URL.Query().Get("prefix")
+	recursive := req.URL.Query().Get("recursive") == "true"
+
+	secretNames, err := h.ListSecretNames(
+		repoUUID, id.userUUID, id.userPwd, prefix, recursive)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeJSON(rw, secretNames)
+}
+
+func handleV2ReadSecret(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+	repoUUID := vars["repo_uuid"]
+	secretName := vars["secret_name"]
+	format := req.URL.Query().Get("format")
+	version := req.URL.Query().Get("version")
+
+	if format != "" && format != "raw" && format != "base64" {
+		writeBadRequest(rw, "unknown format")
+		return
+	}
+
+	var secret []byte
+	var err error
+	if version == "" {
+		var revision uint64
+		secret, revision, err = h.ReadSecretWithRevision(
+			repoUUID, id.userUUID, id.userPwd, secretName)
+		if err == nil {
+			rw.Header().Set("ETag", formatETag(revision))
+		}
+	} else {
+		v, convErr := strconv.Atoi(version)
+		if convErr != nil {
+			writeBadRequest(rw, "invalid version")
+			return
+		}
+		secret, err = h.ReadSecretVersion(
+			repoUUID, id.userUUID, id.userPwd, secretName, v)
+	}
+	defer himitsu.Zero(secret)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	if format == "base64" {
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte(base64.StdEncoding.EncodeToString(secret)))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(secret)
+}
+
+// writeSecretRequest is the JSON body of a secret write. Value is text, a
+// binary value goes base64 encoded in ValueBase64 instead, or as the raw
+// body. Metadata fields left out keep their current value, as the legacy
+// query parameters.
+type writeSecretRequest struct {
+	Value       *string    `json:"value"`
+	ValueBase64 []byte     `json:"value_base64"`
+	Description *string    `json:"description"`
+	Tags        []string   `json:"tags"`
+	ContentType *string    `json:"content_type"`
+	NotBefore   *time.Time `json:"not_before"`
+	NotAfter    *time.Time `json:"not_after"`
+}
+
+// value returns the secret value of the request, false if it has none or
+// both fields.
+func (wsr *writeSecretRequest) value() ([]byte, bool) {
+	if wsr.Value != nil && wsr.ValueBase64 != nil {
+		return nil, false
+	}
+	if wsr.Value != nil {
+		return []byte(*wsr.Value), true
+	}
+	return wsr.ValueBase64, wsr.ValueBase64 != nil
+}
+
+func (wsr *writeSecretRequest) options() *himitsu.WriteSecretOptions {
+	if wsr.Description == nil && wsr.Tags == nil && wsr.ContentType == nil &&
+		wsr.NotBefore == nil && wsr.NotAfter == nil {
+		return nil
+	}
+
+	opts := &himitsu.WriteSecretOptions{Tags: wsr.Tags}
+	if wsr.Description != nil {
+		opts.Description = *wsr.Description
+	}
+	if wsr.ContentType != nil {
+		opts.ContentType = *wsr.ContentType
+	}
+	if wsr.NotBefore != nil {
+		opts.NotBefore = *wsr.NotBefore
+	}
+	if wsr.NotAfter != nil {
+		opts.NotAfter = *wsr.NotAfter
+	}
+	return opts
+}
+
+// handleV2WriteSecret writes the secret from a JSON body, or from the raw
+// body with the metadata as query parameters otherwise.
+func handleV2WriteSecret(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+	repoUUID := vars["repo_uuid"]
+	secretName := vars["secret_name"]
+
+	var secretValue []byte
+	var opts *himitsu.WriteSecretOptions
+	if isJSON(req) {
+		body := &writeSecretRequest{}
+		if !decodeJSON(rw, req, body) {
+			return
+		}
+		var ok bool
+		if secretValue, ok = body.value(); !ok {
+			writeBadRequest(rw, "either value or value_base64 is needed")
+			return
+		}
+		opts = body.options()
+	} else {
+		var ok bool
+		if opts, ok = parseWriteSecretOptions(rw, req); !ok {
+			return
+		}
+		if secretValue, ok = readBody(rw, req); !ok {
+			return
+		}
+	}
+	defer himitsu.Zero(secretValue)
+
+	writeSecret(rw, req, repoUUID, id.userUUID, id.userPwd,
+		secretName, secretValue, opts)
+}
+
+func isJSON(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/json")
+}
+
+func handleV2DeleteSecret(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+
+	err := h.DeleteSecret(vars["repo_uuid"], id.userUUID, id.userPwd,
+		vars["secret_name"])
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+type renameSecretRequest struct {
+	NewName string `json:"new_name"`
+}
+
+func handleV2RenameSecret(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+	body := &renameSecretRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	err := h.RenameSecret(vars["repo_uuid"], id.userUUID, id.userPwd,
+		vars["secret_name"], body.NewName)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+func handleV2ReadSecretMetadata(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+
+	metadata, err := h.ReadSecretMetadata(vars["repo_uuid"], id.userUUID,
+		id.userPwd, vars["secret_name"])
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeJSON(rw, metadata)
+}
+
+func handleV2ListSecretVersions(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+
+	versions, err := h.ListSecretVersions(vars["repo_uuid"], id.userUUID,
+		id.userPwd, vars["secret_name"])
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeJSON(rw, versions)
+}
+
+type rollbackSecretRequest struct {
+	Version int `json:"version"`
+}
+
+func handleV2RollbackSecret(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+	body := &rollbackSecretRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	err := h.RollbackSecret(vars["repo_uuid"], id.userUUID, id.userPwd,
+		vars["secret_name"], body.Version)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+func handleV2ListExpiringSecrets(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	repoUUID := mux.Vars(req)["repo_uuid"]
+
+	within, err := time.ParseDuration(req.URL.Query().Get("within"))
+	if err != nil {
+		writeBadRequest(rw, "invalid within")
+		return
+	}
+
+	expiringSecrets, err := h.ListExpiringSecrets(
+		repoUUID, id.userUUID, id.userPwd, within)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeJSON(rw, expiringSecrets)
+}
+
+func handleV2Batch(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	applyBatch(rw, req, mux.Vars(req)["repo_uuid"], id.userUUID, id.userPwd)
+}
+
+// userAccountRequest is the JSON body of the user account routes, each
+// using the fields it needs.
+type userAccountRequest struct {
+	Label    string   `json:"label"`
+	Password string   `json:"password"`
+	Rights   []string `json:"rights"`
+	Policies []string `json:"policies"`
+}
+
+func handleV2AddUserAccount(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	repoUUID := mux.Vars(req)["repo_uuid"]
+	body := &userAccountRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	newUserUUID, err := h.AddUserAccount(repoUUID, id.userUUID, id.userPwd,
+		body.Label, body.Password, body.Rights)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	writeJSON(rw, map[string]string{
+		"user_label": body.Label,
+		"user_uuid":  newUserUUID})
+}
+
+func handleV2InviteUserAccount(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+	body := &userAccountRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	err := h.InviteUserAccount(vars["repo_uuid"], id.userUUID, id.userPwd,
+		vars["account_uuid"], body.Label, body.Rights)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+func handleV2AcceptInvitation(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+
+	err := h.AcceptInvitation(
+		mux.Vars(req)["repo_uuid"], id.userUUID, id.userPwd, id.totpCode)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+func handleV2RevokeInvitation(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+
+	err := h.RevokeInvitation(vars["repo_uuid"], id.userUUID, id.userPwd,
+		vars["account_uuid"])
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+func handleV2ListUserAccounts(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+
+	userAccounts, err := h.ListUserAccounts(
+		mux.Vars(req)["repo_uuid"], id.userUUID, id.userPwd)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeJSON(rw, userAccounts)
+}
+
+func handleV2UpdateUserAccountRights(rw http.ResponseWriter,
+	req *http.Request) {
+
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+	body := &userAccountRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	err := h.UpdateUserAccountRights(vars["repo_uuid"], id.userUUID,
+		id.userPwd, vars["account_uuid"], body.Rights)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+func handleV2RemoveUserAccount(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+
+	err := h.RemoveUserAccount(vars["repo_uuid"], id.userUUID, id.userPwd,
+		vars["account_uuid"])
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+func handleV2SetUserAccountPolicies(rw http.ResponseWriter,
+	req *http.Request) {
+
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+	body := &userAccountRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	err := h.SetUserAccountPolicies(vars["repo_uuid"], id.userUUID,
+		id.userPwd, vars["account_uuid"], body.Policies)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+func handleV2ListPolicies(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+
+	policies, err := h.ListPolicies(
+		mux.Vars(req)["repo_uuid"], id.userUUID, id.userPwd)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeJSON(rw, policies)
+}
+
+func handleV2SetPolicy(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+	policy := &himitsu.Policy{}
+	if !decodeJSON(rw, req, policy) {
+		return
+	}
+	policy.Name = vars["policy_name"]
+
+	err := h.SetPolicy(vars["repo_uuid"], id.userUUID, id.userPwd, policy)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+func handleV2DeletePolicy(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+
+	err := h.DeletePolicy(vars["repo_uuid"], id.userUUID, id.userPwd,
+		vars["policy_name"])
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+func handleV2RotateRepositoryKey(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+
+	err := h.RotateRepositoryKey(
+		mux.Vars(req)["repo_uuid"], id.userUUID, id.userPwd)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+func handleV2ListAuditEntries(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+
+	entries, err := h.ListAuditEntries(
+		mux.Vars(req)["repo_uuid"], id.userUUID, id.userPwd)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeJSON(rw, entries)
+}
+
+type loginRequest struct {
+	RepositoryUUID string `json:"repository_uuid"`
+	TOTPCode       string `json:"totp_code"`
+}
+
+type loginResponse struct {
+	Token   string               `json:"token"`
+	Session *himitsu.SessionInfo `json:"session"`
+}
+
+func handleV2Login(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	body := &loginRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	token, session, err := h.Login(
+		body.RepositoryUUID, id.userUUID, id.userPwd, body.TOTPCode)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeJSON(rw, &loginResponse{Token: token, Session: session})
+}
+
+func handleV2ListSessions(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+
+	sessions, err := h.ListSessions(
+		mux.Vars(req)["repo_uuid"], id.userUUID, id.userPwd)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeJSON(rw, sessions)
+}
+
+func handleV2RevokeSession(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+
+	err := h.RevokeSession(vars["repo_uuid"], id.userUUID, id.userPwd,
+		vars["session_id"])
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+func handleV2ListLockouts(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+
+	lockouts, err := h.ListLockouts(
+		mux.Vars(req)["repo_uuid"], id.userUUID, id.userPwd)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeJSON(rw, lockouts)
+}
+
+func handleV2ClearUserAccountLockout(rw http.ResponseWriter,
+	req *http.Request) {
+
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+
+	err := h.ClearUserAccountLockout(vars["repo_uuid"], id.userUUID,
+		id.userPwd, vars["account_uuid"])
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+func handleV2ListClientLockouts(rw http.ResponseWriter, req *http.Request) {
+	if !authenticateOperator(rw, req) {
+		return
+	}
+
+	lockouts, err := h.ListClientLockouts()
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeJSON(rw, lockouts)
+}
+
+func handleV2ClearClientLockout(rw http.ResponseWriter, req *http.Request) {
+	if !authenticateOperator(rw, req) {
+		return
+	}
+
+	err := h.ClearClientLockout(mux.Vars(req)["client_ip"])
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+func handleV2EnrollTOTP(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+
+	enrollment, err := h.EnrollTOTP(id.userUUID, id.userPwd)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeJSON(rw, enrollment)
+}
+
+func handleV2ConfirmTOTP(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	body := &totpCodeRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	err := h.ConfirmTOTP(id.userUUID, id.userPwd, body.Code)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+func handleV2DisableTOTP(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	body := &totpCodeRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	err := h.DisableTOTP(id.userUUID, id.userPwd, body.Code)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+func handleV2AddServiceAccount(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	repoUUID := mux.Vars(req)["repo_uuid"]
+	body := &userAccountRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	serviceAccountUUID, err := h.AddServiceAccount(repoUUID, id.userUUID,
+		id.userPwd, body.Label, body.Rights)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	writeJSON(rw, map[string]string{
+		"user_label": body.Label,
+		"user_uuid":  serviceAccountUUID})
+}
+
+type createAPIKeyRequest struct {
+	Label      string    `json:"label"`
+	ReadOnly   bool      `json:"read_only"`
+	PathPrefix string    `json:"path_prefix"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type createAPIKeyResponse struct {
+	Key    string          `json:"key"`
+	APIKey *himitsu.APIKey `json:"api_key"`
+}
+
+func handleV2CreateAPIKey(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+	body := &createAPIKeyRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	apiKey := &himitsu.APIKey{
+		ServiceAccountUUID: vars["account_uuid"],
+		Label:              body.Label,
+		ReadOnly:           body.ReadOnly,
+		PathPrefix:         body.PathPrefix,
+		ExpiresAt:          body.ExpiresAt}
+	key, err := h.CreateAPIKey(vars["repo_uuid"], id.userUUID, id.userPwd,
+		apiKey)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeJSON(rw, &createAPIKeyResponse{Key: key, APIKey: apiKey})
+}
+
+func handleV2ListAPIKeys(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+
+	apiKeys, err := h.ListAPIKeys(
+		mux.Vars(req)["repo_uuid"], id.userUUID, id.userPwd)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeJSON(rw, apiKeys)
+}
+
+func handleV2RevokeAPIKey(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	vars := mux.Vars(req)
+
+	err := h.RevokeAPIKey(vars["repo_uuid"], id.userUUID, id.userPwd,
+		vars["api_key_id"])
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+type bindCertificateRequest struct {
+	Identity string `json:"identity"`
+	UserUUID string `json:"user_uuid"`
+}
+
+func handleV2BindCertificate(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+	body := &bindCertificateRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	err := h.BindCertificate(mux.Vars(req)["repo_uuid"], id.userUUID,
+		id.userPwd, body.Identity, body.UserUUID)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
+
+func handleV2ListCertificateBindings(rw http.ResponseWriter,
+	req *http.Request) {
+
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+
+	bindings, err := h.ListCertificateBindings(
+		mux.Vars(req)["repo_uuid"], id.userUUID, id.userPwd)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeJSON(rw, bindings)
+}
+
+// handleV2UnbindCertificate takes the identity as a query parameter, as it
+// spans several path segments.
+func handleV2UnbindCertificate(rw http.ResponseWriter, req *http.Request) {
+	id := authenticate(rw, req)
+	if id == nil {
+		return
+	}
+
+	err := h.UnbindCertificate(mux.Vars(req)["repo_uuid"], id.userUUID,
+		id.userPwd, req.URL.Query().Get("identity"))
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	writeOK(rw)
+}
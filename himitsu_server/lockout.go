@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// clientResponseWriter remembers whether the response refused the
+// credentials of the request.
+type clientResponseWriter struct {
+	http.ResponseWriter
+	invalidCredentials bool
+}
+
+// markInvalidCredentials records the refusal on rw for throttleClients.
+func markInvalidCredentials(rw http.ResponseWriter) {
+	if crw, ok := rw.(*clientResponseWriter); ok {
+		crw.invalidCredentials = true
+	}
+}
+
+// throttleClients holds back the clients whose credentials keep being
+// refused, see himitsu.CheckClientLockout.
+func throttleClients(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		clientIP := requestClientIP(req)
+		if err := h.CheckClientLockout(clientIP); err != nil {
+			writeError(rw, err)
+			return
+		}
+
+		crw := &clientResponseWriter{ResponseWriter: rw}
+		handler.ServeHTTP(crw, req)
+		if crw.invalidCredentials {
+			if err := h.RecordFailedClientUnwrap(clientIP); err != nil {
+				log.Print(err)
+			}
+		}
+	})
+}
+
+func requestClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// retryAfterSeconds rounds the delay up to the whole seconds of a
+// Retry-After header.
+func retryAfterSeconds(retryAfter time.Duration) string {
+	return strconv.FormatInt(
+		int64((retryAfter+time.Second-1)/time.Second), 10)
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/pagedegeek/himitsu"
+	"github.com/pagedegeek/himitsu/crypto_engine"
+	"github.com/pagedegeek/himitsu/data_access"
+	"github.com/pagedegeek/himitsu/password_derivation"
+	"github.com/pagedegeek/himitsu/salt_generation"
+	"github.com/pagedegeek/himitsu/uuid_generation"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type testServer struct {
+	*assert.Assertions
+	router *mux.Router
+}
+
+// setupServer sets h up on a fresh data access and returns the router of
+// both APIs.
+func setupServer(t *testing.T) (*testServer, func()) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "himitsu_server")
+	assert.Nil(err)
+
+	dataAccess, err := data_access.NewDefaultDataAccess(
+		filepath.Join(dir, "himitsu.bin"))
+	assert.Nil(err)
+
+	saltGenerator := salt_generation.NewDefaultSaltGenerator()
+	h = himitsu.NewHimitsu(saltGenerator,
+		uuid_generation.NewDefaultUUIDGenerator(),
+		password_derivation.NewPBKDF2PasswordDerivator(32, 10, sha256.New),
+		crypto_engine.NewAESCFBEngine(), dataAccess)
+	auditKey, err := saltGenerator.Call(32)
+	assert.Nil(err)
+	h.SetAuditKey(auditKey)
+
+	router := mux.NewRouter()
+	router.Use(throttleClients)
+	registerV2Routes(router)
+	registerLegacyRoutes(router)
+
+	return &testServer{Assertions: assert, router: router}, func() {
+		h.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// do serves the request, authenticated with HTTP Basic when userUUID is
+// set, and returns its response.
+func (s *testServer) do(method, url, userUUID, userPwd string, body []byte,
+	header http.Header) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(method, url, bytes.NewReader(body))
+	req.RemoteAddr = "192.0.2.1:1234"
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if userUUID != "" {
+		req.SetBasicAuth(userUUID, userPwd)
+	}
+
+	rw := httptest.NewRecorder()
+	s.router.ServeHTTP(rw, req)
+	return rw
+}
+
+// decode decodes the JSON body of the response into v.
+func (s *testServer) decode(rw *httptest.ResponseRecorder, v interface{}) {
+	s.Nil(json.Unmarshal(rw.Body.Bytes(), v), rw.Body.String())
+}
+
+// createRepository creates a repository and returns its UUID and the UUID
+// of its admin, whose password is "password".
+func (s *testServer) createRepository() (string, string) {
+	rw := s.do("POST", "/v2/repositories", "", "", []byte(
+		`{"repository_label": "repo", "user_label": "admin", `+
+			`"user_password": "password"}`), nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+
+	created := make(map[string]string)
+	s.decode(rw, &created)
+	return created["repository_uuid"], created["user_uuid"]
+}
+
+func TestBatchKeepsBinaryValues(t *testing.T) {
+	s, teardown := setupServer(t)
+	defer teardown()
+
+	repoUUID, adminUUID := s.createRepository()
+	binaryValue := []byte{0x00, 0xff, 0xfe, 0x80, '"'}
+
+	operations, err := json.Marshal([]*batchOperation{
+		{Op: "write", Name: "binary", Value: binaryValue},
+		{Op: "read", Name: "binary"}})
+	s.Nil(err)
+	rw := s.do("POST", "/v2/repositories/"+repoUUID+"/batch",
+		adminUUID, "password", operations, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+
+	results := make([]*batchResult, 0)
+	s.decode(rw, &results)
+	s.Len(results, 2)
+	s.Equal(binaryValue, results[1].Value)
+
+	secret, err := h.ReadSecret(repoUUID, adminUUID, "password", "binary")
+	s.Nil(err)
+	s.Equal(binaryValue, secret)
+
+	// values are base64 on the wire
+	rw = s.do("POST", "/v2/repositories/"+repoUUID+"/batch",
+		adminUUID, "password",
+		[]byte(`[{"op": "write", "name": "text", "value": "not base64!"}]`),
+		nil)
+	s.Equal(http.StatusBadRequest, rw.Code, rw.Body.String())
+}
+
+func TestWriteSecretKeepsBinaryValues(t *testing.T) {
+	s, teardown := setupServer(t)
+	defer teardown()
+
+	repoUUID, adminUUID := s.createRepository()
+	secretURL := "/v2/repositories/" + repoUUID + "/secrets/binary"
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+	binaryValue := []byte{0x00, 0xff, 0xfe, 0x80, '"'}
+
+	body, err := json.Marshal(&writeSecretRequest{ValueBase64: binaryValue})
+	s.Nil(err)
+	rw := s.do("PUT", secretURL, adminUUID, "password", body, jsonHeader)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+
+	rw = s.do("GET", secretURL, adminUUID, "password", nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	s.Equal(binaryValue, rw.Body.Bytes())
+
+	// text values as before
+	rw = s.do("PUT", secretURL, adminUUID, "password",
+		[]byte(`{"value": "Bye"}`), jsonHeader)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	rw = s.do("GET", secretURL, adminUUID, "password", nil, nil)
+	s.Equal("Bye", rw.Body.String())
+
+	for _, body := range []string{`{"value": "Bye", "value_base64": "QnllCg=="}`,
+		`{"description": "no value"}`, `{"value_base64": "not base64!"}`} {
+		rw = s.do("PUT", secretURL, adminUUID, "password", []byte(body),
+			jsonHeader)
+		s.Equal(http.StatusBadRequest, rw.Code, body)
+	}
+}
+
+// addUserAccount adds a user account to the repository as its admin and
+// returns its UUID.
+func (s *testServer) addUserAccount(repoUUID, adminUUID, label,
+	password string, rights ...string) string {
+
+	body, err := json.Marshal(&userAccountRequest{
+		Label: label, Password: password, Rights: rights})
+	s.Nil(err)
+	rw := s.do("POST", "/v2/repositories/"+repoUUID+"/users",
+		adminUUID, "password", body, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+
+	added := make(map[string]string)
+	s.decode(rw, &added)
+	return added["user_uuid"]
+}
+
+// errorCode returns the error code of the JSON error response.
+func (s *testServer) errorCode(rw *httptest.ResponseRecorder) string {
+	body := &errorBody{}
+	s.decode(rw, body)
+	return body.Error
+}
+
+func TestUserAccountRoutes(t *testing.T) {
+	s, teardown := setupServer(t)
+	defer teardown()
+
+	repoUUID, adminUUID := s.createRepository()
+	usersURL := "/v2/repositories/" + repoUUID + "/users"
+	bobUUID := s.addUserAccount(repoUUID, adminUUID, "bob", "bob password",
+		himitsu.RIGHT_READ_SECRET)
+
+	rw := s.do("GET", usersURL, adminUUID, "password", nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	userAccounts := make([]*himitsu.UserAccount, 0)
+	s.decode(rw, &userAccounts)
+	s.Len(userAccounts, 2)
+
+	// bob is no admin
+	rw = s.do("GET", usersURL, bobUUID, "bob password", nil, nil)
+	s.Equal(http.StatusForbidden, rw.Code, rw.Body.String())
+	s.Equal("forbidden", s.errorCode(rw))
+	rw = s.do("PUT", usersURL+"/"+bobUUID, bobUUID, "bob password",
+		[]byte(`{"rights": ["AdminUserAccounts"]}`), nil)
+	s.Equal(http.StatusForbidden, rw.Code, rw.Body.String())
+
+	rw = s.do("PUT", usersURL+"/"+bobUUID, adminUUID, "password",
+		[]byte(`{"rights": ["FlySecret"]}`), nil)
+	s.Equal(http.StatusBadRequest, rw.Code, rw.Body.String())
+	rw = s.do("DELETE", usersURL+"/"+adminUUID, adminUUID, "password",
+		nil, nil)
+	s.Equal(http.StatusBadRequest, rw.Code, rw.Body.String())
+
+	rw = s.do("DELETE", usersURL+"/"+bobUUID, adminUUID, "password", nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	rw = s.do("DELETE", usersURL+"/"+bobUUID, adminUUID, "password", nil, nil)
+	s.Equal(http.StatusNotFound, rw.Code, rw.Body.String())
+	s.Equal("not_found", s.errorCode(rw))
+}
+
+func TestChangeUserPasswordRoute(t *testing.T) {
+	s, teardown := setupServer(t)
+	defer teardown()
+
+	repoUUID, adminUUID := s.createRepository()
+
+	rw := s.do("PUT", "/v2/password", adminUUID, "wrong password",
+		[]byte(`{"new_password": "new password"}`), nil)
+	s.Equal(http.StatusUnauthorized, rw.Code, rw.Body.String())
+	s.Equal("invalid_credentials", s.errorCode(rw))
+
+	rw = s.do("PUT", "/v2/password", adminUUID, "password",
+		[]byte(`{"new_password": "short"}`), nil)
+	s.Equal(http.StatusUnprocessableEntity, rw.Code, rw.Body.String())
+	body := &errorBody{}
+	s.decode(rw, body)
+	s.Equal("weak_password", body.Error)
+	s.Equal([]string{"min_length"}, body.FailedRules)
+
+	rw = s.do("PUT", "/v2/password", adminUUID, "password",
+		[]byte(`{"new_password": "new password"}`), nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+
+	secretURL := "/v2/repositories/" + repoUUID + "/secrets/hello"
+	rw = s.do("GET", secretURL, adminUUID, "new password", nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	rw = s.do("GET", secretURL, adminUUID, "password", nil, nil)
+	s.Equal(http.StatusUnauthorized, rw.Code, rw.Body.String())
+}
+
+func TestDeleteAndRenameSecretRoutes(t *testing.T) {
+	s, teardown := setupServer(t)
+	defer teardown()
+
+	repoUUID, adminUUID := s.createRepository()
+	secretsURL := "/v2/repositories/" + repoUUID + "/secrets/"
+	rw := s.do("PUT", secretsURL+"db/bye", adminUUID, "password",
+		[]byte("Bye"), nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+
+	rw = s.do("POST", secretsURL+"hello/rename", adminUUID, "password",
+		[]byte(`{"new_name": "db/bye"}`), nil)
+	s.Equal(http.StatusConflict, rw.Code, rw.Body.String())
+	s.Equal("conflict", s.errorCode(rw))
+
+	rw = s.do("POST", secretsURL+"hello/rename", adminUUID, "password",
+		[]byte(`{"new_name": "db/hello"}`), nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	rw = s.do("GET", secretsURL+"db/hello", adminUUID, "password", nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	s.Equal("Hello World !", rw.Body.String())
+
+	rw = s.do("DELETE", secretsURL+"db/hello", adminUUID, "password",
+		nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	rw = s.do("DELETE", secretsURL+"db/hello", adminUUID, "password",
+		nil, nil)
+	s.Equal(http.StatusNotFound, rw.Code, rw.Body.String())
+	rw = s.do("GET", secretsURL+"db/hello", adminUUID, "password", nil, nil)
+	s.Equal(http.StatusNotFound, rw.Code, rw.Body.String())
+	s.Equal("not_found", s.errorCode(rw))
+}
+
+func TestSecretVersionRoutes(t *testing.T) {
+	s, teardown := setupServer(t)
+	defer teardown()
+
+	repoUUID, adminUUID := s.createRepository()
+	secretURL := "/v2/repositories/" + repoUUID + "/secrets/hello"
+	rw := s.do("PUT", secretURL, adminUUID, "password", []byte("Bye"), nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+
+	rw = s.do("GET", secretURL+"/versions", adminUUID, "password", nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	versions := make([]int, 0)
+	s.decode(rw, &versions)
+	s.Equal([]int{1, 2}, versions)
+
+	rw = s.do("GET", secretURL+"?version=1", adminUUID, "password", nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	s.Equal("Hello World !", rw.Body.String())
+	rw = s.do("GET", secretURL+"?version=7", adminUUID, "password", nil, nil)
+	s.Equal(http.StatusNotFound, rw.Code, rw.Body.String())
+	rw = s.do("GET", secretURL+"?version=last", adminUUID, "password",
+		nil, nil)
+	s.Equal(http.StatusBadRequest, rw.Code, rw.Body.String())
+
+	rw = s.do("POST", secretURL+"/rollback", adminUUID, "password",
+		[]byte(`{"version": 1}`), nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	rw = s.do("GET", secretURL, adminUUID, "password", nil, nil)
+	s.Equal("Hello World !", rw.Body.String())
+	rw = s.do("POST", secretURL+"/rollback", adminUUID, "password",
+		[]byte(`{"version": 7}`), nil)
+	s.Equal(http.StatusNotFound, rw.Code, rw.Body.String())
+}
+
+func TestSecretMetadataRoute(t *testing.T) {
+	s, teardown := setupServer(t)
+	defer teardown()
+
+	repoUUID, adminUUID := s.createRepository()
+	secretURL := "/v2/repositories/" + repoUUID + "/secrets/hello"
+	rw := s.do("PUT", secretURL, adminUUID, "password",
+		[]byte(`{"value": "Bye", "description": "greeting",
+			"tags": ["demo"]}`),
+		http.Header{"Content-Type": {"application/json"}})
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+
+	rw = s.do("GET", secretURL+"/metadata", adminUUID, "password", nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	metadata := &himitsu.SecretMetadata{}
+	s.decode(rw, metadata)
+	s.Equal("hello", metadata.Name)
+	s.Equal(2, metadata.Version)
+	s.Equal(adminUUID, metadata.UpdatedBy)
+	s.Equal("greeting", metadata.Description)
+	s.Equal([]string{"demo"}, metadata.Tags)
+	s.NotContains(rw.Body.String(), "Bye")
+
+	rw = s.do("GET", "/v2/repositories/"+repoUUID+"/secrets/unknown/metadata",
+		adminUUID, "password", nil, nil)
+	s.Equal(http.StatusNotFound, rw.Code, rw.Body.String())
+}
+
+func TestSecretValidityRoutes(t *testing.T) {
+	s, teardown := setupServer(t)
+	defer teardown()
+
+	repoUUID, adminUUID := s.createRepository()
+	repoURL := "/v2/repositories/" + repoUUID
+	rw := s.do("PUT", repoURL+"/secrets/hello", adminUUID, "password",
+		[]byte(`{"value": "Bye", "not_after": "2001-01-01T00:00:00Z"}`),
+		http.Header{"Content-Type": {"application/json"}})
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+
+	rw = s.do("GET", repoURL+"/secrets/hello", adminUUID, "password", nil, nil)
+	s.Equal(http.StatusGone, rw.Code, rw.Body.String())
+	s.Equal("gone", s.errorCode(rw))
+
+	rw = s.do("GET", repoURL+"/expiring_secrets?within=24h",
+		adminUUID, "password", nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	expiringSecrets := make([]*himitsu.ExpiringSecret, 0)
+	s.decode(rw, &expiringSecrets)
+	s.Len(expiringSecrets, 1)
+	s.Equal("hello", expiringSecrets[0].Name)
+	s.Equal(2, expiringSecrets[0].Version)
+
+	rw = s.do("GET", repoURL+"/expiring_secrets?within=tomorrow",
+		adminUUID, "password", nil, nil)
+	s.Equal(http.StatusBadRequest, rw.Code, rw.Body.String())
+
+	// a window ending before it starts is refused
+	rw = s.do("PUT", repoURL+"/secrets/hello", adminUUID, "password",
+		[]byte(`{"value": "Bye", "not_before": "2001-01-02T00:00:00Z",
+			"not_after": "2001-01-01T00:00:00Z"}`),
+		http.Header{"Content-Type": {"application/json"}})
+	s.Equal(http.StatusBadRequest, rw.Code, rw.Body.String())
+}
+
+func TestListSecretsRoute(t *testing.T) {
+	s, teardown := setupServer(t)
+	defer teardown()
+
+	repoUUID, adminUUID := s.createRepository()
+	secretsURL := "/v2/repositories/" + repoUUID + "/secrets"
+	for _, secretName := range []string{"db/password", "db/prod/password"} {
+		rw := s.do("PUT", secretsURL+"/"+secretName, adminUUID, "password",
+			[]byte("s3cr3t"), nil)
+		s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	}
+
+	for query, expectedNames := range map[string][]string{
+		"":                          {"db/", "hello"},
+		"?prefix=db":                {"db/password", "db/prod/"},
+		"?prefix=db&recursive=true": {"db/password", "db/prod/password"},
+	} {
+		rw := s.do("GET", secretsURL+query, adminUUID, "password", nil, nil)
+		s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+		secretNames := make([]string, 0)
+		s.decode(rw, &secretNames)
+		s.Equal(expectedNames, secretNames, query)
+	}
+}
+
+func TestWriteSecretIfMatch(t *testing.T) {
+	s, teardown := setupServer(t)
+	defer teardown()
+
+	repoUUID, adminUUID := s.createRepository()
+	secretURL := "/v2/repositories/" + repoUUID + "/secrets/hello"
+	rw := s.do("GET", secretURL, adminUUID, "password", nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	etag := rw.Header().Get("ETag")
+	s.NotEqual("", etag)
+
+	rw = s.do("PUT", secretURL, adminUUID, "password", []byte("first"),
+		http.Header{"If-Match": {etag}})
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	newETag := rw.Header().Get("ETag")
+	s.NotEqual(etag, newETag)
+
+	rw = s.do("PUT", secretURL, adminUUID, "password", []byte("second"),
+		http.Header{"If-Match": {etag}})
+	s.Equal(http.StatusPreconditionFailed, rw.Code, rw.Body.String())
+	s.Equal("precondition_failed", s.errorCode(rw))
+
+	rw = s.do("GET", secretURL, adminUUID, "password", nil, nil)
+	s.Equal("first", rw.Body.String())
+	s.Equal(newETag, rw.Header().Get("ETag"))
+
+	rw = s.do("PUT", secretURL, adminUUID, "password", []byte("second"),
+		http.Header{"If-Match": {"*"}})
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	rw = s.do("PUT", secretURL, adminUUID, "password", []byte("second"),
+		http.Header{"If-Match": {`"latest"`}})
+	s.Equal(http.StatusBadRequest, rw.Code, rw.Body.String())
+}
+
+func TestV2Authentication(t *testing.T) {
+	s, teardown := setupServer(t)
+	defer teardown()
+
+	repoUUID, adminUUID := s.createRepository()
+	secretURL := "/v2/repositories/" + repoUUID + "/secrets/hello"
+
+	rw := s.do("GET", secretURL, "", "", nil, nil)
+	s.Equal(http.StatusUnauthorized, rw.Code, rw.Body.String())
+	s.Equal("invalid_credentials", s.errorCode(rw))
+	s.Equal(`Basic realm="himitsu"`, rw.Header().Get("WWW-Authenticate"))
+
+	rw = s.do("GET", secretURL, adminUUID, "wrong password", nil, nil)
+	s.Equal(http.StatusUnauthorized, rw.Code, rw.Body.String())
+	s.Equal("invalid_credentials", s.errorCode(rw))
+	s.NotContains(rw.Body.String(), "wrong password")
+
+	rw = s.do("GET", secretURL, adminUUID, "password", nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	s.Equal("Hello World !", rw.Body.String())
+	s.Equal("", rw.Header().Get("Deprecation"))
+}
+
+func TestLegacyRoutesAreDeprecated(t *testing.T) {
+	s, teardown := setupServer(t)
+	defer teardown()
+
+	repoUUID, adminUUID := s.createRepository()
+	rw := s.do("GET", "/secrets/hello?repo_uuid="+repoUUID+
+		"&user_uuid="+adminUUID+"&user_pwd=password", "", "", nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	s.Equal("Hello World !", rw.Body.String())
+	s.Equal("true", rw.Header().Get("Deprecation"))
+	s.Equal(`</v2>; rel="successor-version"`, rw.Header().Get("Link"))
+}
+
+func TestSessionRoutes(t *testing.T) {
+	s, teardown := setupServer(t)
+	defer teardown()
+
+	repoUUID, adminUUID := s.createRepository()
+	repoURL := "/v2/repositories/" + repoUUID
+	rw := s.do("POST", "/v2/sessions", adminUUID, "password",
+		[]byte(`{"repository_uuid": "`+repoUUID+`"}`), nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	login := &loginResponse{}
+	s.decode(rw, login)
+	s.NotEqual("", login.Token)
+	bearer := http.Header{"Authorization": {"Bearer " + login.Token}}
+
+	rw = s.do("GET", repoURL+"/secrets/hello", "", "", nil, bearer)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	s.Equal("Hello World !", rw.Body.String())
+
+	rw = s.do("GET", repoURL+"/sessions", "", "", nil, bearer)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	sessions := make([]*himitsu.SessionInfo, 0)
+	s.decode(rw, &sessions)
+	s.Len(sessions, 1)
+	s.Equal(login.Session.ID, sessions[0].ID)
+
+	rw = s.do("DELETE", repoURL+"/sessions/"+login.Session.ID,
+		adminUUID, "password", nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	rw = s.do("DELETE", repoURL+"/sessions/"+login.Session.ID,
+		adminUUID, "password", nil, nil)
+	s.Equal(http.StatusNotFound, rw.Code, rw.Body.String())
+
+	// an ended session is as a wrong password
+	rw = s.do("GET", repoURL+"/secrets/hello", "", "", nil, bearer)
+	s.Equal(http.StatusUnauthorized, rw.Code, rw.Body.String())
+	s.Equal("invalid_credentials", s.errorCode(rw))
+}
+
+func TestAPIKeyRoutes(t *testing.T) {
+	s, teardown := setupServer(t)
+	defer teardown()
+
+	repoUUID, adminUUID := s.createRepository()
+	repoURL := "/v2/repositories/" + repoUUID
+	rw := s.do("POST", repoURL+"/service_accounts", adminUUID, "password",
+		[]byte(`{"label": "ci", "rights": ["ReadSecret", "WriteSecret"]}`),
+		nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	serviceAccount := make(map[string]string)
+	s.decode(rw, &serviceAccount)
+	ciUUID := serviceAccount["user_uuid"]
+
+	expiresAt, err := json.Marshal(time.Now().Add(time.Hour))
+	s.Nil(err)
+	rw = s.do("POST", repoURL+"/service_accounts/"+ciUUID+"/api_keys",
+		adminUUID, "password", []byte(`{"label": "deploy",
+			"read_only": true, "expires_at": `+string(expiresAt)+`}`), nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	created := &createAPIKeyResponse{}
+	s.decode(rw, created)
+	s.True(created.APIKey.ReadOnly)
+
+	rw = s.do("GET", repoURL+"/secrets/hello", ciUUID, created.Key, nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	rw = s.do("PUT", repoURL+"/secrets/hello", ciUUID, created.Key,
+		[]byte("Bye"), nil)
+	s.Equal(http.StatusForbidden, rw.Code, rw.Body.String())
+	s.Equal("forbidden", s.errorCode(rw))
+
+	// expired or for a user account with a password, a key is refused
+	rw = s.do("POST", repoURL+"/service_accounts/"+ciUUID+"/api_keys",
+		adminUUID, "password",
+		[]byte(`{"expires_at": "2001-01-01T00:00:00Z"}`), nil)
+	s.Equal(http.StatusBadRequest, rw.Code, rw.Body.String())
+	rw = s.do("POST", repoURL+"/service_accounts/"+adminUUID+"/api_keys",
+		adminUUID, "password",
+		[]byte(`{"expires_at": `+string(expiresAt)+`}`), nil)
+	s.Equal(http.StatusBadRequest, rw.Code, rw.Body.String())
+
+	rw = s.do("GET", repoURL+"/api_keys", adminUUID, "password", nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	apiKeys := make([]*himitsu.APIKey, 0)
+	s.decode(rw, &apiKeys)
+	s.Len(apiKeys, 1)
+	s.Equal("deploy", apiKeys[0].Label)
+	s.NotContains(rw.Body.String(), created.Key)
+
+	rw = s.do("DELETE", repoURL+"/api_keys/"+created.APIKey.ID,
+		adminUUID, "password", nil, nil)
+	s.Equal(http.StatusOK, rw.Code, rw.Body.String())
+	rw = s.do("GET", repoURL+"/secrets/hello", ciUUID, created.Key, nil, nil)
+	s.Equal(http.StatusUnauthorized, rw.Code, rw.Body.String())
+	rw = s.do("DELETE", repoURL+"/api_keys/"+created.APIKey.ID,
+		adminUUID, "password", nil, nil)
+	s.Equal(http.StatusNotFound, rw.Code, rw.Body.String())
+}
+
+func TestThrottledClients(t *testing.T) {
+	s, teardown := setupServer(t)
+	defer teardown()
+
+	repoUUID, adminUUID := s.createRepository()
+	h.SetLockoutPolicy(himitsu.LockoutPolicy{FreeAttempts: 1,
+		BaseDelay: time.Minute, MaxDelay: time.Minute, ResetAfter: time.Hour})
+	secretURL := "/v2/repositories/" + repoUUID + "/secrets/hello"
+
+	for i := 0; i < 2; i++ {
+		rw := s.do("GET", secretURL, adminUUID, "wrong", nil, nil)
+		s.Equal(http.StatusUnauthorized, rw.Code, rw.Body.String())
+	}
+
+	rw := s.do("GET", secretURL, adminUUID, "password", nil, nil)
+	s.Equal(http.StatusTooManyRequests, rw.Code, rw.Body.String())
+	s.Equal("too_many_attempts", s.errorCode(rw))
+	retryAfter, err := strconv.Atoi(rw.Header().Get("Retry-After"))
+	s.Nil(err)
+	s.True(retryAfter > 0 && retryAfter <= 60, retryAfter)
+
+	clientLockouts, err := h.ListClientLockouts()
+	s.Nil(err)
+	s.Len(clientLockouts, 1)
+	s.Equal("192.0.2.1", clientLockouts[0].ClientIP)
+}
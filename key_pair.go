@@ -0,0 +1,223 @@
+package himitsu
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/pagedegeek/himitsu/data_access"
+)
+
+/*
+	Key pairs.
+
+	Each key slot, that is a user account, an API key or a certificate
+	identity, has an X25519 key pair. The public key is stored in clear, the
+	private key wrapped as the repository keys of the slot are: under the
+	derived password, or what stands for it.
+
+	A key rotation seals the new repository key to the public key of every
+	slot of the repository, see RotateRepositoryKey, so that only the slot
+	itself can open it. Holding the previous repository key, as a removed
+	user account may, tells nothing of the next one.
+
+	Slots enrolled before key pairs existed get one the next time they
+	authenticate, see ensureKeyPair.
+*/
+
+const sealedKeyPublicKeySize = 32
+
+type ErrNoKeyPair struct {
+	slot string
+}
+
+func (e *ErrNoKeyPair) Error() string {
+	return fmt.Sprintf("Slot '%s' has no key pair", e.slot)
+}
+
+func (h *Himitsu) generatePrivateKey() (*ecdh.PrivateKey, error) {
+	seed, err := h.saltGenerator.Call(32)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(seed)
+	return ecdh.X25519().NewPrivateKey(seed)
+}
+
+// batchSaveNewKeyPair adds a fresh key pair of the slot, its private key
+// wrapped under the derived credential, to the batch.
+func (h *Himitsu) batchSaveNewKeyPair(batch data_access.Batch,
+	slot string, derivedCredential []byte) error {
+
+	privateKey, err := h.generatePrivateKey()
+	if err != nil {
+		return err
+	}
+
+	rawPrivateKey := privateKey.Bytes()
+	defer Zero(rawPrivateKey)
+
+	cipherPrivateKey, err := h.wrapRepositoryKey(
+		rawPrivateKey, derivedCredential)
+	if err != nil {
+		return err
+	}
+
+	batch.SaveKeyPair(
+		slot, privateKey.PublicKey().Bytes(), cipherPrivateKey)
+	return nil
+}
+
+// ensureKeyPair creates the key pair of a slot which has none yet, once the
+// derived credential is proven to unwrap one of its keys.
+func (h *Himitsu) ensureKeyPair(slot string, derivedCredential []byte) error {
+	publicKey, _, err := h.dataAccess.ReadKeyPair(slot)
+	if err != nil || publicKey != nil {
+		return err
+	}
+
+	batch := h.dataAccess.NewBatch()
+	if err := h.batchSaveNewKeyPair(
+		batch, slot, derivedCredential); err != nil {
+		return err
+	}
+
+	err = batch.Commit()
+	if _, exists := err.(*data_access.ErrKeyPairExists); exists {
+		// a concurrent authentication created it first
+		return nil
+	}
+	return err
+}
+
+// batchRewrapKeyPair adds the key pair of the slot, if any, re-wrapped under
+// the new derived credential to the batch.
+func (h *Himitsu) batchRewrapKeyPair(batch data_access.Batch, slot string,
+	derivedCredential, newDerivedCredential []byte) error {
+
+	publicKey, cipherPrivateKey, err := h.dataAccess.ReadKeyPair(slot)
+	if err != nil || publicKey == nil {
+		return err
+	}
+
+	rawPrivateKey, err := h.cryptoEngine.Decrypt(
+		cipherPrivateKey, derivedCredential)
+	if err != nil {
+		return &ErrIntegrity{err: err}
+	}
+	defer Zero(rawPrivateKey)
+
+	newCipherPrivateKey, err := h.wrapRepositoryKey(
+		rawPrivateKey, newDerivedCredential)
+	if err != nil {
+		return err
+	}
+
+	batch.SaveKeyPair(slot, publicKey, newCipherPrivateKey)
+	return nil
+}
+
+// unwrapPrivateKey returns the private key of the slot. The derived
+// credential is expected to be checked already, so that a failure to unwrap
+// is an integrity one.
+func (h *Himitsu) unwrapPrivateKey(
+	slot string, derivedCredential []byte) (*ecdh.PrivateKey, error) {
+
+	publicKey, cipherPrivateKey, err := h.dataAccess.ReadKeyPair(slot)
+	if err != nil {
+		return nil, err
+	}
+	if publicKey == nil {
+		return nil, &ErrNoKeyPair{slot: slot}
+	}
+
+	rawPrivateKey, err := h.cryptoEngine.Decrypt(
+		cipherPrivateKey, derivedCredential)
+	if err != nil {
+		return nil, &ErrIntegrity{err: err}
+	}
+	defer Zero(rawPrivateKey)
+
+	return ecdh.X25519().NewPrivateKey(rawPrivateKey)
+}
+
+// sealingKey derives the key a sealed key is encrypted under from the
+// shared secret of the ephemeral and recipient keys.
+func sealingKey(sharedSecret, ephemeralPublicKey, publicKey []byte) []byte {
+	mac := hmac.New(sha256.New, sharedSecret)
+	mac.Write([]byte("himitsu sealed key"))
+	mac.Write(ephemeralPublicKey)
+	mac.Write(publicKey)
+	return mac.Sum(nil)
+}
+
+/*
+	sealed key composition:
+	[EPHEMERAL PUBLIC KEY(32 bytes)|CIPHER KEY]
+*/
+
+// sealKey encrypts the key so that only the holder of the private key of
+// publicKey can decrypt it, see openSealedKey.
+func (h *Himitsu) sealKey(key, publicKey []byte) ([]byte, error) {
+	recipientPublicKey, err := ecdh.X25519().NewPublicKey(publicKey)
+	if err != nil {
+		return nil, &ErrIntegrity{err: err}
+	}
+
+	ephemeralPrivateKey, err := h.generatePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPublicKey := ephemeralPrivateKey.PublicKey().Bytes()
+
+	sharedSecret, err := ephemeralPrivateKey.ECDH(recipientPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(sharedSecret)
+
+	encryptionKey := sealingKey(sharedSecret, ephemeralPublicKey, publicKey)
+	defer Zero(encryptionKey)
+
+	keyIV, err := h.saltGenerator.Call(16)
+	if err != nil {
+		return nil, err
+	}
+	cipherKey, err := h.cryptoEngine.Encrypt(key, encryptionKey, keyIV)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(ephemeralPublicKey, cipherKey...), nil
+}
+
+func (h *Himitsu) openSealedKey(
+	sealedKey []byte, privateKey *ecdh.PrivateKey) ([]byte, error) {
+
+	if len(sealedKey) < sealedKeyPublicKeySize {
+		return nil, &ErrIntegrity{err: errors.New("sealed key too short")}
+	}
+	ephemeralPublicKey := sealedKey[:sealedKeyPublicKeySize]
+
+	publicKey, err := ecdh.X25519().NewPublicKey(ephemeralPublicKey)
+	if err != nil {
+		return nil, &ErrIntegrity{err: err}
+	}
+	sharedSecret, err := privateKey.ECDH(publicKey)
+	if err != nil {
+		return nil, &ErrIntegrity{err: err}
+	}
+	defer Zero(sharedSecret)
+
+	encryptionKey := sealingKey(sharedSecret, ephemeralPublicKey,
+		privateKey.PublicKey().Bytes())
+	defer Zero(encryptionKey)
+
+	key, err := h.cryptoEngine.Decrypt(
+		sealedKey[sealedKeyPublicKeySize:], encryptionKey)
+	if err != nil {
+		return nil, &ErrIntegrity{err: err}
+	}
+	return key, nil
+}
@@ -0,0 +1,319 @@
+package himitsu
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/pagedegeek/himitsu/data_access"
+)
+
+const (
+	AUDIT_OPERATION_ROTATE_REPOSITORY_KEY string = "RotateRepositoryKey"
+)
+
+// RotateRepositoryKey replaces the repository key with a fresh one and
+// re-encrypts the repository with it.
+//
+// The calling admin gets the new key wrapped under its password right away.
+// Other user accounts, API keys and certificate bindings get it sealed to
+// their public key, see sealKey, and re-wrap it under their password, or
+// what stands for it, the next time they load the repository key. A slot
+// without key pair, one which has not authenticated since key pairs exist,
+// gets the new key appended to its pending keys instead, encrypted under
+// the previous one. Everything is saved together with the re-encrypted
+// repository.
+//
+// The sessions of the repository hold the previous key and are revoked. An
+// admin rotating through a session or a certificate gets a sealed key as
+// well, lacking the password to wrap the new key.
+func (h *Himitsu) RotateRepositoryKey(
+	repoUUID, userUUID, userPwd string) (err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_ROTATE_REPOSITORY_KEY,
+		userUUID, repoUUID, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	userAccount, err := repository.findUserAccount(userUUID)
+	if err != nil {
+		return err
+	}
+
+	if err := repository.checkRight(
+		userAccount, RIGHT_ADMIN_USER_ACCOUNTS, ""); err != nil {
+		return err
+	}
+
+	batch := h.dataAccess.NewBatch()
+	newRepoKey, err := h.batchRotateRepositoryKey(
+		batch, repository, repoKey, userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(newRepoKey)
+
+	if err := h.batchSaveRepository(
+		batch, repository, newRepoKey); err != nil {
+		return err
+	}
+
+	if err := record.commit(batch); err != nil {
+		return err
+	}
+
+	h.revokeRepositorySessions(repoUUID)
+	return nil
+}
+
+// batchRotateRepositoryKey generates the key following repoKey and adds its
+// distribution to the key slots of the repository to the batch, see
+// RotateRepositoryKey. Saving the repository under the returned key is left
+// to the caller.
+func (h *Himitsu) batchRotateRepositoryKey(batch data_access.Batch,
+	repository *Repository, repoKey []byte,
+	userUUID, userPwd string) ([]byte, error) {
+
+	newRepoKey, err := h.saltGenerator.Call(32)
+	if err != nil {
+		return nil, err
+	}
+
+	fromPassword := h.isPassword(userUUID, repository.UUID, userPwd)
+	for _, slot := range repository.keySlots() {
+		if slot == userUUID && fromPassword {
+			continue
+		}
+		if err := h.batchSealRepositoryKey(batch,
+			slot, repository.UUID, repoKey, newRepoKey); err != nil {
+			Zero(newRepoKey)
+			return nil, err
+		}
+	}
+
+	_, isMember := repository.UserAccounts[userUUID]
+	if fromPassword && isMember {
+		// drops the sealed key of an earlier rotation as well
+		batch.DeleteCipherRepositoryKey(userUUID, repository.UUID)
+		if err := h.saveUserAccountRepositoryKey(batch,
+			userUUID, userPwd, repository.UUID, newRepoKey); err != nil {
+			Zero(newRepoKey)
+			return nil, err
+		}
+	}
+	return newRepoKey, nil
+}
+
+// keySlots returns the slots holding a key of the repository: its user
+// accounts, invited user accounts, API keys and certificate identities.
+func (r *Repository) keySlots() []string {
+	slots := make([]string, 0, len(r.UserAccounts)+len(r.Invitations)+
+		len(r.APIKeys)+len(r.CertificateBindings))
+	for userUUID := range r.UserAccounts {
+		slots = append(slots, userUUID)
+	}
+	for userUUID := range r.Invitations {
+		slots = append(slots, userUUID)
+	}
+	for apiKeyID := range r.APIKeys {
+		slots = append(slots, apiKeyID)
+	}
+	for identity := range r.CertificateBindings {
+		slots = append(slots, certificateKeySlot(identity))
+	}
+	return slots
+}
+
+// batchSealRepositoryKey adds the new repository key sealed to the public
+// key of the slot to the batch. A slot without key pair gets it appended to
+// its pending keys instead, and a key pair once it completes them, see
+// completePendingRepositoryKeys.
+func (h *Himitsu) batchSealRepositoryKey(batch data_access.Batch,
+	slot, repoUUID string, repoKey, newRepoKey []byte) error {
+
+	publicKey, _, err := h.dataAccess.ReadKeyPair(slot)
+	if err != nil {
+		return err
+	}
+	if publicKey == nil {
+		return h.batchAppendPendingRepositoryKey(
+			batch, slot, repoUUID, repoKey, newRepoKey)
+	}
+
+	sealedKey, err := h.sealKey(newRepoKey, publicKey)
+	if err != nil {
+		return err
+	}
+	batch.SaveSealedRepositoryKey(slot, repoUUID, sealedKey)
+	return nil
+}
+
+// batchAppendPendingRepositoryKey adds the new repository key, encrypted
+// under the current one, at the end of the pending keys of the slot to the
+// batch, unless they change in between.
+func (h *Himitsu) batchAppendPendingRepositoryKey(batch data_access.Batch,
+	slot, repoUUID string, repoKey, newRepoKey []byte) error {
+
+	encodedPendingKeys, err := h.dataAccess.ReadPendingRepositoryKeys(
+		slot, repoUUID)
+	if err != nil {
+		return err
+	}
+	pendingKeys, err := decodePendingRepositoryKeys(encodedPendingKeys)
+	if err != nil {
+		return err
+	}
+
+	pendingKey, err := h.wrapRepositoryKey(newRepoKey, repoKey)
+	if err != nil {
+		return err
+	}
+	var newEncodedPendingKeys bytes.Buffer
+	if err := gob.NewEncoder(&newEncodedPendingKeys).Encode(
+		append(pendingKeys, pendingKey)); err != nil {
+		return err
+	}
+
+	batch.SavePendingRepositoryKeysIfUnchanged(slot, repoUUID,
+		newEncodedPendingKeys.Bytes(), encodedPendingKeys)
+	return nil
+}
+
+func decodePendingRepositoryKeys(encodedPendingKeys []byte) ([][]byte, error) {
+	pendingKeys := make([][]byte, 0)
+	if encodedPendingKeys == nil {
+		return pendingKeys, nil
+	}
+
+	dec := gob.NewDecoder(bytes.NewBuffer(encodedPendingKeys))
+	if err := dec.Decode(&pendingKeys); err != nil {
+		return nil, err
+	}
+	return pendingKeys, nil
+}
+
+func (h *Himitsu) readPendingRepositoryKeys(
+	userUUID, repoUUID string) ([][]byte, error) {
+
+	encodedPendingKeys, err := h.dataAccess.ReadPendingRepositoryKeys(
+		userUUID, repoUUID)
+	if err != nil {
+		return nil, err
+	}
+	return decodePendingRepositoryKeys(encodedPendingKeys)
+}
+
+// walkPendingRepositoryKeys decrypts each pending key with the previous one,
+// starting from repoKey, and returns the last key. Every intermediate key,
+// repoKey included, is zeroed.
+func (h *Himitsu) walkPendingRepositoryKeys(
+	repoKey []byte, pendingKeys [][]byte) ([]byte, error) {
+
+	for _, pendingKey := range pendingKeys {
+		nextRepoKey, err := h.cryptoEngine.Decrypt(pendingKey, repoKey)
+		Zero(repoKey)
+		if err != nil {
+			return nil, err
+		}
+		repoKey = nextRepoKey
+	}
+	return repoKey, nil
+}
+
+// completePendingRepositoryKeys brings the repository key the slot could
+// unwrap up to date: it opens the key sealed by the last rotation, or walks
+// the pending chain of the rotations before sealed keys, and stores the
+// latest key wrapped under the derived credential. It returns the latest key.
+func (h *Himitsu) completePendingRepositoryKeys(slot, repoUUID string,
+	repoKey, derivedCredential []byte) ([]byte, error) {
+
+	// repoKey is kept to walk the pending keys again on retry
+	defer Zero(repoKey)
+	latestRepoKey := append([]byte{}, repoKey...)
+
+	for retry := 0; ; retry++ {
+		encodedPendingKeys, err := h.dataAccess.ReadPendingRepositoryKeys(
+			slot, repoUUID)
+		if err != nil {
+			Zero(latestRepoKey)
+			return nil, err
+		}
+		pendingKeys, err := decodePendingRepositoryKeys(encodedPendingKeys)
+		if err != nil {
+			Zero(latestRepoKey)
+			return nil, err
+		}
+		sealedKey, err := h.dataAccess.ReadSealedRepositoryKey(slot, repoUUID)
+		if err != nil {
+			Zero(latestRepoKey)
+			return nil, err
+		}
+		if sealedKey == nil && len(pendingKeys) == 0 {
+			break
+		}
+
+		Zero(latestRepoKey)
+		if sealedKey != nil {
+			latestRepoKey, err = h.openSealedRepositoryKey(
+				slot, sealedKey, derivedCredential)
+		} else {
+			latestRepoKey, err = h.walkPendingRepositoryKeys(
+				append([]byte{}, repoKey...), pendingKeys)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		cipherRepoKey, err := h.wrapRepositoryKey(
+			latestRepoKey, derivedCredential)
+		if err != nil {
+			Zero(latestRepoKey)
+			return nil, err
+		}
+
+		err = h.dataAccess.CompletePendingRepositoryKeys(
+			slot, repoUUID, cipherRepoKey, sealedKey, encodedPendingKeys)
+		_, isSealedChanged := err.(*data_access.ErrSealedRepositoryKeyChanged)
+		_, isPendingChanged :=
+			err.(*data_access.ErrPendingRepositoryKeysChanged)
+		if (isSealedChanged || isPendingChanged) && retry < MaxConflictRetries {
+			// a rotation sealed or appended a newer key meanwhile
+			continue
+		}
+		if err != nil {
+			Zero(latestRepoKey)
+			return nil, err
+		}
+		break
+	}
+
+	if err := h.ensureKeyPair(slot, derivedCredential); err != nil {
+		Zero(latestRepoKey)
+		return nil, err
+	}
+	return latestRepoKey, nil
+}
+
+// openSealedRepositoryKey opens the sealed key with the private key of the
+// slot.
+func (h *Himitsu) openSealedRepositoryKey(
+	slot string, sealedKey, derivedCredential []byte) ([]byte, error) {
+
+	privateKey, err := h.unwrapPrivateKey(slot, derivedCredential)
+	if err != nil {
+		return nil, err
+	}
+	return h.openSealedKey(sealedKey, privateKey)
+}
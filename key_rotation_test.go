@@ -0,0 +1,146 @@
+package himitsu
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func TestRotateRepositoryKey(t *testing.T) {
+	assert, h, _, _, dataAccess, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{RIGHT_READ_SECRET})
+	assert.Nil(err)
+
+	oldRepoKey, err := h.loadRepositoryKey(adminUUID, repoUUID, "password")
+	assert.Nil(err)
+
+	assert.Nil(h.RotateRepositoryKey(repoUUID, adminUUID, "password"))
+
+	// the previous key opens neither the repository nor the key of bob
+	cipherRepo, err := dataAccess.ReadCipherRepository(repoUUID)
+	assert.Nil(err)
+	_, err = h.cryptoEngine.Decrypt(cipherRepo, oldRepoKey)
+	assert.NotNil(err)
+
+	pendingKeys, err := dataAccess.ReadPendingRepositoryKeys(bobUUID, repoUUID)
+	assert.Nil(err)
+	assert.Nil(pendingKeys)
+	sealedKey, err := dataAccess.ReadSealedRepositoryKey(bobUUID, repoUUID)
+	assert.Nil(err)
+	assert.NotNil(sealedKey)
+	for _, cipherKey := range [][]byte{
+		sealedKey, sealedKey[sealedKeyPublicKeySize:]} {
+		_, err = h.cryptoEngine.Decrypt(cipherKey, oldRepoKey)
+		assert.NotNil(err)
+	}
+
+	secret, err := h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.Nil(err)
+	assert.Equal([]byte("Hello World !"), secret)
+
+	// bob re-wrapped the new key under his password
+	sealedKey, err = dataAccess.ReadSealedRepositoryKey(bobUUID, repoUUID)
+	assert.Nil(err)
+	assert.Nil(sealedKey)
+	_, err = h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.Nil(err)
+	_, err = h.ReadSecret(repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+}
+
+func TestRotateRepositoryKeyTwiceBeforeUse(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{RIGHT_READ_SECRET})
+	assert.Nil(err)
+
+	assert.Nil(h.RotateRepositoryKey(repoUUID, adminUUID, "password"))
+	assert.Nil(h.RotateRepositoryKey(repoUUID, adminUUID, "password"))
+
+	_, err = h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.Nil(err)
+}
+
+func TestRotateRepositoryKeyChainsSlotsWithoutKeyPair(t *testing.T) {
+	assert, h, _, _, dataAccess, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{RIGHT_READ_SECRET})
+	assert.Nil(err)
+
+	// bob enrolled before key pairs existed, and gets one once he
+	// authenticates
+	assert.Nil(dataAccess.DeleteKeyPair(bobUUID))
+	_, err = h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.Nil(err)
+	publicKey, _, err := dataAccess.ReadKeyPair(bobUUID)
+	assert.Nil(err)
+	assert.NotNil(publicKey)
+
+	// otherwise rotations append to his pending keys, which he completes
+	// the next time he authenticates
+	assert.Nil(dataAccess.DeleteKeyPair(bobUUID))
+	assert.Nil(h.RotateRepositoryKey(repoUUID, adminUUID, "password"))
+	assert.Nil(h.RotateRepositoryKey(repoUUID, adminUUID, "password"))
+	pendingKeys, err := h.readPendingRepositoryKeys(bobUUID, repoUUID)
+	assert.Nil(err)
+	assert.Len(pendingKeys, 2)
+
+	secretValue, err := h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.Nil(err)
+	assert.Equal([]byte("Hello World !"), secretValue)
+	encodedPendingKeys, err := dataAccess.ReadPendingRepositoryKeys(
+		bobUUID, repoUUID)
+	assert.Nil(err)
+	assert.Nil(encodedPendingKeys)
+	publicKey, _, err = dataAccess.ReadKeyPair(bobUUID)
+	assert.Nil(err)
+	assert.NotNil(publicKey)
+}
+
+func TestPendingChainIsStillWalked(t *testing.T) {
+	assert, h, _, _, dataAccess, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{RIGHT_READ_SECRET})
+	assert.Nil(err)
+
+	// a rotation of the previous layout left bob a pending chain
+	repository, repoKey, err := h.openRepository(
+		repoUUID, adminUUID, "password")
+	assert.Nil(err)
+	newRepoKey, err := h.saltGenerator.Call(32)
+	assert.Nil(err)
+	iv, err := h.saltGenerator.Call(16)
+	assert.Nil(err)
+	pendingKey, err := h.cryptoEngine.Encrypt(newRepoKey, repoKey, iv)
+	assert.Nil(err)
+
+	var pendingKeys bytes.Buffer
+	assert.Nil(gob.NewEncoder(&pendingKeys).Encode([][]byte{pendingKey}))
+	assert.Nil(dataAccess.SavePendingRepositoryKeys(
+		bobUUID, repoUUID, pendingKeys.Bytes()))
+	assert.Nil(h.saveRepository(repository, newRepoKey))
+
+	_, err = h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.Nil(err)
+	encodedPendingKeys, err := dataAccess.ReadPendingRepositoryKeys(
+		bobUUID, repoUUID)
+	assert.Nil(err)
+	assert.Nil(encodedPendingKeys)
+}
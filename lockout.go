@@ -0,0 +1,346 @@
+package himitsu
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	Brute-force protection.
+
+	Failed key unwraps, that is wrong passwords, unknown user accounts and
+	wrong TOTP codes, are counted in the data access per user account, and
+	per client for the clients reporting them, see RecordFailedClientUnwrap.
+	Past a few failures, each further attempt has to wait for an
+	exponentially growing delay after the last failure, and past the
+	lockout threshold for the lockout duration, unless cleared: a user
+	account by an admin of its repository, a client, which belongs to no
+	repository, by the server operator. Failures are forgotten a while after
+	the last one, and those of a user account when it opens a repository.
+
+	Sessions, API keys and client certificates are not held back: they
+	cannot be guessed.
+*/
+
+const (
+	AUDIT_OPERATION_CLEAR_LOCKOUT string = "ClearLockout"
+	AUDIT_OPERATION_LIST_LOCKOUTS string = "ListLockouts"
+)
+
+// AUDIT_ACTOR_OPERATOR is the actor of the operations of the server
+// operator, which acts on no repository.
+const AUDIT_ACTOR_OPERATOR string = "operator"
+
+const (
+	lockoutSubjectUserAccount = "user:"
+	lockoutSubjectClient      = "client:"
+)
+
+type LockoutPolicy struct {
+	// FreeAttempts is how many failures go without delay.
+	FreeAttempts uint64
+	// BaseDelay is the delay after the first failure past FreeAttempts,
+	// doubled on each further one up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutThreshold is how many failures lock the subject out for
+	// LockoutDuration, zero for never.
+	LockoutThreshold uint64
+	LockoutDuration  time.Duration
+	// ResetAfter is how long after the last failure they are forgotten.
+	ResetAfter time.Duration
+}
+
+var DefaultLockoutPolicy = LockoutPolicy{
+	FreeAttempts:     5,
+	BaseDelay:        time.Second,
+	MaxDelay:         5 * time.Minute,
+	LockoutThreshold: 20,
+	LockoutDuration:  time.Hour,
+	ResetAfter:       24 * time.Hour,
+}
+
+// LockoutState tells how many failed unwraps a user account or client has,
+// and until when it is held back.
+type LockoutState struct {
+	UserUUID    string     `json:"user_uuid,omitempty"`
+	ClientIP    string     `json:"client_ip,omitempty"`
+	Failures    uint64     `json:"failures"`
+	LastFailure time.Time  `json:"last_failure"`
+	RetryAt     *time.Time `json:"retry_at,omitempty"`
+	LockedOut   bool       `json:"locked_out"`
+}
+
+type ErrTooManyAttempts struct {
+	subject    string
+	retryAfter time.Duration
+}
+
+func (e *ErrTooManyAttempts) Error() string {
+	return fmt.Sprintf("Too many failed attempts for '%s', retry in %s",
+		e.subject, e.retryAfter)
+}
+
+// RetryAfter is how long to wait before the next attempt.
+func (e *ErrTooManyAttempts) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// SetLockoutPolicy sets the brute-force protection policy.
+func (h *Himitsu) SetLockoutPolicy(lockoutPolicy LockoutPolicy) {
+	h.lockoutPolicy = lockoutPolicy
+}
+
+// retryAt returns when the next attempt is allowed after the failures, and
+// whether they lock the subject out.
+func (lp *LockoutPolicy) retryAt(
+	failures uint64, lastFailure time.Time) (time.Time, bool) {
+
+	if lp.LockoutThreshold > 0 && failures >= lp.LockoutThreshold {
+		return lastFailure.Add(lp.LockoutDuration), true
+	}
+	if failures <= lp.FreeAttempts {
+		return lastFailure, false
+	}
+
+	delay := lp.BaseDelay
+	for i := lp.FreeAttempts + 1; i < failures && delay < lp.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > lp.MaxDelay {
+		delay = lp.MaxDelay
+	}
+	return lastFailure.Add(delay), false
+}
+
+// checkLockout refuses an attempt of the subject until its failures allow
+// it.
+func (h *Himitsu) checkLockout(subject string) error {
+	failedUnwraps, err := h.dataAccess.ReadFailedUnwraps(subject)
+	if err != nil || failedUnwraps == nil {
+		return err
+	}
+
+	now := time.Now()
+	resetAt := failedUnwraps.LastFailure.Add(h.lockoutPolicy.ResetAfter)
+	if !now.Before(resetAt) {
+		return nil
+	}
+
+	retryAt, _ := h.lockoutPolicy.retryAt(
+		failedUnwraps.Count, failedUnwraps.LastFailure)
+	if now.Before(retryAt) {
+		return &ErrTooManyAttempts{
+			subject:    subject,
+			retryAfter: retryAt.Sub(now)}
+	}
+	return nil
+}
+
+// failedUnwrap counts the failure of the subject, then returns err, or the
+// error counting it failed with.
+func (h *Himitsu) failedUnwrap(subject string, err error) error {
+	now := time.Now()
+	if _, recordErr := h.dataAccess.RecordFailedUnwrap(subject,
+		now, now.Add(-h.lockoutPolicy.ResetAfter)); recordErr != nil {
+		return recordErr
+	}
+	return err
+}
+
+// passwordUnwrapError is unwrapError for keys wrapped under the derived
+// password of the user account, counting wrong passwords.
+func (h *Himitsu) passwordUnwrapError(userUUID string, err error) error {
+	err = unwrapError(userUUID, err)
+	if _, isInvalid := err.(*ErrInvalidCredentials); isInvalid {
+		return h.failedUnwrap(lockoutSubjectUserAccount+userUUID, err)
+	}
+	return err
+}
+
+// clearFailedUnwraps forgets the failures of the subject, if any.
+func (h *Himitsu) clearFailedUnwraps(subject string) error {
+	failedUnwraps, err := h.dataAccess.ReadFailedUnwraps(subject)
+	if err != nil || failedUnwraps == nil {
+		return err
+	}
+	return h.dataAccess.DeleteFailedUnwraps(subject)
+}
+
+// CheckClientLockout refuses an attempt from the client until its failures
+// allow it, see RecordFailedClientUnwrap.
+func (h *Himitsu) CheckClientLockout(clientIP string) error {
+	return h.checkLockout(lockoutSubjectClient + clientIP)
+}
+
+// RecordFailedClientUnwrap counts a failed unwrap from the client, which
+// Himitsu cannot tell apart by itself.
+func (h *Himitsu) RecordFailedClientUnwrap(clientIP string) error {
+	return h.failedUnwrap(lockoutSubjectClient+clientIP, nil)
+}
+
+// ListLockouts returns the lockout state of the user accounts of the
+// repository.
+func (h *Himitsu) ListLockouts(repoUUID, userUUID, userPwd string) (
+	lockouts []*LockoutState, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_LIST_LOCKOUTS,
+		userUUID, repoUUID, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			lockouts = nil
+		}
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if err := repository.checkAdminRight(userUUID); err != nil {
+		return nil, err
+	}
+
+	return h.lockoutStates(lockoutSubjectUserAccount,
+		func(state *LockoutState, lockedUserUUID string) bool {
+			state.UserUUID = lockedUserUUID
+			_, exists := repository.UserAccounts[lockedUserUUID]
+			return exists
+		})
+}
+
+// ListClientLockouts returns the lockout state of the clients having failed
+// unwraps. Clients belong to no repository: their lockouts are left to the
+// server operator, whom the caller authenticates.
+func (h *Himitsu) ListClientLockouts() (lockouts []*LockoutState,
+	err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_LIST_LOCKOUTS,
+		AUDIT_ACTOR_OPERATOR, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			lockouts = nil
+		}
+	}()
+	return h.lockoutStates(lockoutSubjectClient,
+		func(state *LockoutState, clientIP string) bool {
+			state.ClientIP = clientIP
+			return true
+		})
+}
+
+// lockoutStates returns the lockout state of the subjects of the kind
+// prefix with failed unwraps, those which keep accepts.
+func (h *Himitsu) lockoutStates(prefix string,
+	keep func(state *LockoutState, id string) bool) ([]*LockoutState, error) {
+
+	allFailedUnwraps, err := h.dataAccess.ListFailedUnwraps()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	states := make([]*LockoutState, 0)
+	for subject, failedUnwraps := range allFailedUnwraps {
+		if !strings.HasPrefix(subject, prefix) ||
+			!now.Before(failedUnwraps.LastFailure.Add(
+				h.lockoutPolicy.ResetAfter)) {
+			continue
+		}
+
+		state := &LockoutState{
+			Failures:    failedUnwraps.Count,
+			LastFailure: failedUnwraps.LastFailure}
+		if !keep(state, subject[len(prefix):]) {
+			continue
+		}
+
+		retryAt, lockedOut := h.lockoutPolicy.retryAt(
+			failedUnwraps.Count, failedUnwraps.LastFailure)
+		if now.Before(retryAt) {
+			state.RetryAt = &retryAt
+			state.LockedOut = lockedOut
+		}
+		states = append(states, state)
+	}
+	sort.Sort(byLastFailure(states))
+	return states, nil
+}
+
+type byLastFailure []*LockoutState
+
+func (s byLastFailure) Len() int      { return len(s) }
+func (s byLastFailure) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byLastFailure) Less(i, j int) bool {
+	return s[i].LastFailure.After(s[j].LastFailure)
+}
+
+// ClearUserAccountLockout forgets the failed unwraps of a user account of
+// the repository.
+func (h *Himitsu) ClearUserAccountLockout(repoUUID, userUUID, userPwd,
+	lockedUserUUID string) (err error) {
+
+	subject := lockoutSubjectUserAccount + lockedUserUUID
+	record, err := h.beginAudit(AUDIT_OPERATION_CLEAR_LOCKOUT,
+		userUUID, repoUUID, subject)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if err := repository.checkAdminRight(userUUID); err != nil {
+		return err
+	}
+	if _, err := repository.findUserAccount(lockedUserUUID); err != nil {
+		return err
+	}
+
+	batch := h.dataAccess.NewBatch()
+	batch.DeleteFailedUnwraps(subject)
+	return record.commit(batch)
+}
+
+// ClearClientLockout forgets the failed unwraps of a client, see
+// ListClientLockouts.
+func (h *Himitsu) ClearClientLockout(clientIP string) (err error) {
+	subject := lockoutSubjectClient + clientIP
+	record, err := h.beginAudit(AUDIT_OPERATION_CLEAR_LOCKOUT,
+		AUDIT_ACTOR_OPERATOR, "", subject)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	batch := h.dataAccess.NewBatch()
+	batch.DeleteFailedUnwraps(subject)
+	return record.commit(batch)
+}
@@ -0,0 +1,129 @@
+package himitsu
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestListLockoutsIsScopedToTheRepository(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+	h.SetLockoutPolicy(LockoutPolicy{FreeAttempts: 100,
+		ResetAfter: DefaultLockoutPolicy.ResetAfter})
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	otherRepoUUID, otherUUID, err := h.CreateRepository(
+		"other", "other", "password")
+	assert.Nil(err)
+
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{RIGHT_READ_SECRET})
+	assert.Nil(err)
+
+	_, err = h.ReadSecret(repoUUID, bobUUID, "wrong", "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	_, err = h.ReadSecret(otherRepoUUID, otherUUID, "wrong", "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	assert.Nil(h.RecordFailedClientUnwrap("192.0.2.1"))
+
+	// the admin of a repository, which anyone may create, sees the user
+	// accounts of its repository only, and no client
+	lockouts, err := h.ListLockouts(otherRepoUUID, otherUUID, "password")
+	assert.Nil(err)
+	assert.Len(lockouts, 0)
+	err = h.ClearUserAccountLockout(
+		otherRepoUUID, otherUUID, "password", bobUUID)
+	assert.IsType(&ErrUnknownUserAccount{}, err)
+
+	lockouts, err = h.ListLockouts(repoUUID, adminUUID, "password")
+	assert.Nil(err)
+	assert.Len(lockouts, 1)
+	assert.Equal(bobUUID, lockouts[0].UserUUID)
+	assert.Equal("", lockouts[0].ClientIP)
+	assert.Nil(h.ClearUserAccountLockout(
+		repoUUID, adminUUID, "password", bobUUID))
+	lockouts, err = h.ListLockouts(repoUUID, adminUUID, "password")
+	assert.Nil(err)
+	assert.Len(lockouts, 0)
+
+	clientLockouts, err := h.ListClientLockouts()
+	assert.Nil(err)
+	assert.Len(clientLockouts, 1)
+	assert.Equal("192.0.2.1", clientLockouts[0].ClientIP)
+	assert.Equal("", clientLockouts[0].UserUUID)
+
+	assert.Nil(h.ClearClientLockout("192.0.2.1"))
+	clientLockouts, err = h.ListClientLockouts()
+	assert.Nil(err)
+	assert.Len(clientLockouts, 0)
+}
+
+func TestLockoutPolicyRetryAt(t *testing.T) {
+	assert := assert.New(t)
+
+	lockoutPolicy := &LockoutPolicy{FreeAttempts: 2, BaseDelay: time.Second,
+		MaxDelay: 4 * time.Second, LockoutThreshold: 10,
+		LockoutDuration: time.Hour}
+	lastFailure := time.Now()
+
+	for failures, delay := range map[uint64]time.Duration{
+		1: 0, 2: 0, 3: time.Second, 4: 2 * time.Second,
+		5: 4 * time.Second, 9: 4 * time.Second} {
+		retryAt, lockedOut := lockoutPolicy.retryAt(failures, lastFailure)
+		assert.Equal(lastFailure.Add(delay), retryAt, failures)
+		assert.False(lockedOut, failures)
+	}
+
+	retryAt, lockedOut := lockoutPolicy.retryAt(10, lastFailure)
+	assert.Equal(lastFailure.Add(time.Hour), retryAt)
+	assert.True(lockedOut)
+}
+
+func TestFailedUnwrapsHoldTheUserAccountBack(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+	h.SetLockoutPolicy(LockoutPolicy{FreeAttempts: 1, BaseDelay: time.Minute,
+		MaxDelay: time.Minute, ResetAfter: time.Hour})
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{RIGHT_READ_SECRET})
+	assert.Nil(err)
+
+	// a success forgets the failures
+	_, err = h.ReadSecret(repoUUID, bobUUID, "wrong", "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	_, err = h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.Nil(err)
+	lockouts, err := h.ListLockouts(repoUUID, adminUUID, "password")
+	assert.Nil(err)
+	assert.Len(lockouts, 0)
+
+	for i := 0; i < 2; i++ {
+		_, err = h.ReadSecret(repoUUID, bobUUID, "wrong", "hello")
+		assert.IsType(&ErrInvalidCredentials{}, err)
+	}
+
+	// even the right password waits, the other user accounts do not
+	_, err = h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.IsType(&ErrTooManyAttempts{}, err)
+	retryAfter := err.(*ErrTooManyAttempts).RetryAfter()
+	assert.True(retryAfter > 0 && retryAfter <= time.Minute, retryAfter)
+	_, err = h.ReadSecret(repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+
+	lockouts, err = h.ListLockouts(repoUUID, adminUUID, "password")
+	assert.Nil(err)
+	assert.Len(lockouts, 1)
+	assert.Equal(uint64(2), lockouts[0].Failures)
+	assert.NotNil(lockouts[0].RetryAt)
+	assert.False(lockouts[0].LockedOut)
+
+	assert.Nil(h.ClearUserAccountLockout(
+		repoUUID, adminUUID, "password", bobUUID))
+	_, err = h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.Nil(err)
+}
@@ -0,0 +1,39 @@
+package password_derivation
+
+import (
+	"fmt"
+	"golang.org/x/crypto/argon2"
+)
+
+type Argon2idPasswordDerivator struct {
+	keyLen  uint32
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+// NewArgon2idPasswordDerivator returns an Argon2id derivator running time
+// passes over memory KiB with threads lanes.
+func NewArgon2idPasswordDerivator(keyLen int, time, memory uint32,
+	threads uint8) *Argon2idPasswordDerivator {
+
+	return &Argon2idPasswordDerivator{
+		keyLen:  uint32(keyLen),
+		time:    time,
+		memory:  memory,
+		threads: threads,
+	}
+}
+
+func (pd *Argon2idPasswordDerivator) Call(pwd, salt []byte) []byte {
+	return argon2.IDKey(pwd, salt, pd.time, pd.memory, pd.threads, pd.keyLen)
+}
+
+func (pd *Argon2idPasswordDerivator) Parameters() string {
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d,l=%d", algorithmArgon2id,
+		argon2.Version, pd.memory, pd.time, pd.threads, pd.keyLen)
+}
+
+func (pd *Argon2idPasswordDerivator) Close() error {
+	return nil
+}
@@ -0,0 +1,20 @@
+package password_derivation
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestArgon2idCall(t *testing.T) {
+	pwd := []byte("secret password")
+	salt := []byte("saltsalt")
+	assert := assert.New(t)
+
+	var pd PasswordDerivator = NewArgon2idPasswordDerivator(8, 1, 64, 1)
+	assert.NotNil(pd)
+
+	expectedDerivatedPwd, _ := hex.DecodeString("56c09a7b694edb08")
+	assert.Equal(expectedDerivatedPwd, pd.Call(pwd, salt))
+	assert.Nil(pd.Close())
+}
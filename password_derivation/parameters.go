@@ -0,0 +1,177 @@
+package password_derivation
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"strconv"
+	"strings"
+)
+
+/*
+	Stored parameters.
+
+	Salts are stored along with the algorithm and parameters of the
+	derivator they were derived with, in the style of the PHC string
+	format, so that a deployment can change its derivator without locking
+	out the user accounts enrolled with the previous one:
+
+	$argon2id$v=19$m=65536,t=3,p=4,l=32$<base64 salt>
+	$scrypt$n=32768,r=8,p=1,l=32$<base64 salt>
+	$pbkdf2-sha256$i=10000,l=32$<base64 salt>
+
+	Salts stored before, or by a derivator without parameters, are bare.
+*/
+
+const (
+	algorithmArgon2id = "argon2id"
+	algorithmScrypt   = "scrypt"
+	algorithmPBKDF2   = "pbkdf2"
+)
+
+var saltEncoding = base64.RawStdEncoding
+
+// ParameterizedPasswordDerivator is a derivator whose algorithm and
+// parameters can be stored along with the salts, see EncodeSalt.
+type ParameterizedPasswordDerivator interface {
+	PasswordDerivator
+	// Parameters returns the algorithm and parameters, empty when they
+	// cannot be stored.
+	Parameters() string
+}
+
+type ErrInvalidParameters struct {
+	parameters string
+	reason     string
+}
+
+func (e *ErrInvalidParameters) Error() string {
+	return fmt.Sprintf("Invalid password derivation parameters '%s': %s",
+		e.parameters, e.reason)
+}
+
+// EncodeSalt returns the salt along with the algorithm and parameters of
+// the derivator, or the bare salt when it has none.
+func EncodeSalt(pd PasswordDerivator, salt []byte) []byte {
+	parameterized, isParameterized := pd.(ParameterizedPasswordDerivator)
+	if !isParameterized {
+		return salt
+	}
+	parameters := parameterized.Parameters()
+	if parameters == "" {
+		return salt
+	}
+	return []byte(parameters + "$" + saltEncoding.EncodeToString(salt))
+}
+
+// DecodeSalt returns the salt and the derivator it is to be derived with,
+// nil for a bare salt.
+func DecodeSalt(encodedSalt []byte) (PasswordDerivator, []byte, error) {
+	fields := strings.Split(string(encodedSalt), "$")
+	// "", algorithm, [version,] parameters, salt
+	if len(fields) < 4 || fields[0] != "" || !isAlgorithm(fields[1]) {
+		return nil, encodedSalt, nil
+	}
+
+	parameters := strings.Join(fields[:len(fields)-1], "$")
+	salt, err := saltEncoding.DecodeString(fields[len(fields)-1])
+	if err != nil {
+		return nil, nil, &ErrInvalidParameters{
+			parameters: parameters, reason: "malformed salt"}
+	}
+
+	pd, err := newPasswordDerivator(fields[1], fields[2:len(fields)-1])
+	if err != nil {
+		return nil, nil, &ErrInvalidParameters{
+			parameters: parameters, reason: err.Error()}
+	}
+	return pd, salt, nil
+}
+
+func isAlgorithm(algorithm string) bool {
+	if algorithm == algorithmArgon2id || algorithm == algorithmScrypt {
+		return true
+	}
+	if !strings.HasPrefix(algorithm, algorithmPBKDF2+"-") {
+		return false
+	}
+	_, exists := pbkdf2Hashes[algorithm[len(algorithmPBKDF2)+1:]]
+	return exists
+}
+
+func newPasswordDerivator(
+	algorithm string, fields []string) (PasswordDerivator, error) {
+
+	switch algorithm {
+	case algorithmArgon2id:
+		if len(fields) != 2 ||
+			fields[0] != fmt.Sprintf("v=%d", argon2.Version) {
+			return nil, errors.New("unsupported version")
+		}
+		values, err := parseParameters(fields[1], "m", "t", "p", "l")
+		if err != nil {
+			return nil, err
+		}
+		memory, time, threads, keyLen := values[0], values[1], values[2],
+			values[3]
+		if time < 1 || threads < 1 || threads > 255 || keyLen < 1 ||
+			memory < 8*threads {
+			return nil, errors.New("out of range")
+		}
+		return NewArgon2idPasswordDerivator(int(keyLen), uint32(time),
+			uint32(memory), uint8(threads)), nil
+
+	case algorithmScrypt:
+		if len(fields) != 1 {
+			return nil, errors.New("unexpected fields")
+		}
+		values, err := parseParameters(fields[0], "n", "r", "p", "l")
+		if err != nil {
+			return nil, err
+		}
+		pd, err := NewScryptPasswordDerivator(int(values[3]),
+			int(values[0]), int(values[1]), int(values[2]))
+		if err != nil {
+			return nil, err
+		}
+		return pd, nil
+
+	default:
+		if len(fields) != 1 {
+			return nil, errors.New("unexpected fields")
+		}
+		values, err := parseParameters(fields[0], "i", "l")
+		if err != nil {
+			return nil, err
+		}
+		if values[0] < 1 || values[1] < 1 {
+			return nil, errors.New("out of range")
+		}
+		hashFunc := pbkdf2Hashes[algorithm[len(algorithmPBKDF2)+1:]]
+		return NewPBKDF2PasswordDerivator(
+			int(values[1]), int(values[0]), hashFunc), nil
+	}
+}
+
+// parseParameters parses "name=value,..." holding exactly the names, in
+// order.
+func parseParameters(field string, names ...string) ([]uint64, error) {
+	pairs := strings.Split(field, ",")
+	if len(pairs) != len(names) {
+		return nil, fmt.Errorf("expected %s", strings.Join(names, ", "))
+	}
+
+	values := make([]uint64, len(names))
+	for i, pair := range pairs {
+		if !strings.HasPrefix(pair, names[i]+"=") {
+			return nil, fmt.Errorf("expected %s", strings.Join(names, ", "))
+		}
+		value, err := strconv.ParseUint(pair[len(names[i])+1:], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed %s", names[i])
+		}
+		values[i] = value
+	}
+	return values, nil
+}
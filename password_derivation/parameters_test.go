@@ -0,0 +1,66 @@
+package password_derivation
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"github.com/stretchr/testify/assert"
+	"hash"
+	"testing"
+)
+
+func TestEncodeSalt(t *testing.T) {
+	pwd := []byte("secret password")
+	salt := []byte("0123456789abcdef0123456789abcdef")
+	assert := assert.New(t)
+
+	scryptDerivator, err := NewScryptPasswordDerivator(32, 16, 1, 1)
+	assert.Nil(err)
+
+	argon2idDerivator := NewArgon2idPasswordDerivator(32, 1, 64, 1)
+	pbkdf2Derivator := NewPBKDF2PasswordDerivator(32, 10, sha256.New)
+	pbkdf2SHA512Derivator := NewPBKDF2PasswordDerivator(32, 10, sha512.New)
+
+	for expected, pd := range map[string]PasswordDerivator{
+		"$argon2id$v=19$m=64,t=1,p=1,l=32$": argon2idDerivator,
+		"$scrypt$n=16,r=1,p=1,l=32$":        scryptDerivator,
+		"$pbkdf2-sha256$i=10,l=32$":         pbkdf2Derivator,
+		"$pbkdf2-sha512$i=10,l=32$":         pbkdf2SHA512Derivator,
+	} {
+		encodedSalt := EncodeSalt(pd, salt)
+		assert.Equal(expected+saltEncoding.EncodeToString(salt),
+			string(encodedSalt))
+
+		decodedPd, decodedSalt, err := DecodeSalt(encodedSalt)
+		assert.Nil(err, expected)
+		assert.Equal(salt, decodedSalt)
+		assert.Equal(pd.Call(pwd, salt), decodedPd.Call(pwd, decodedSalt))
+	}
+
+	// salts of derivators without parameters are stored bare
+	pd := NewPBKDF2PasswordDerivator(32, 10, func() hash.Hash {
+		return sha256.New()
+	})
+	assert.Equal(salt, EncodeSalt(pd, salt))
+	decodedPd, decodedSalt, err := DecodeSalt(salt)
+	assert.Nil(err)
+	assert.Nil(decodedPd)
+	assert.Equal(salt, decodedSalt)
+}
+
+func TestDecodeSaltRefusesInvalidParameters(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, encodedSalt := range []string{
+		"$argon2id$v=16$m=64,t=1,p=1,l=32$c2FsdA",
+		"$argon2id$v=19$m=64,t=0,p=1,l=32$c2FsdA",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+		"$scrypt$n=15,r=1,p=1,l=32$c2FsdA",
+		"$scrypt$n=16,p=1,r=1,l=32$c2FsdA",
+		"$pbkdf2-sha256$i=10,l=32$c2FsdA==",
+		"$pbkdf2-sha256$i=-1,l=32$c2FsdA",
+		"$pbkdf2-sha256$v=1$i=10,l=32$c2FsdA",
+	} {
+		_, _, err := DecodeSalt([]byte(encodedSalt))
+		assert.IsType(&ErrInvalidParameters{}, err, encodedSalt)
+	}
+}
@@ -1,8 +1,13 @@
 package password_derivation
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
 	"golang.org/x/crypto/pbkdf2"
 	"hash"
+	"reflect"
 )
 
 type PBKDF2PasswordDerivator struct {
@@ -11,6 +16,13 @@ type PBKDF2PasswordDerivator struct {
 	hashFunc func() hash.Hash
 }
 
+// pbkdf2Hashes are the hash functions PBKDF2 parameters can name.
+var pbkdf2Hashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
 func NewPBKDF2PasswordDerivator(keyLen int, iter int,
 	hf func() hash.Hash) *PBKDF2PasswordDerivator {
 
@@ -25,6 +37,19 @@ func (pd *PBKDF2PasswordDerivator) Call(pwd, salt []byte) []byte {
 	return pbkdf2.Key(pwd, salt, pd.iter, pd.keyLen, pd.hashFunc)
 }
 
+// Parameters is empty when the hash function is not one of pbkdf2Hashes,
+// the salts then being stored bare.
+func (pd *PBKDF2PasswordDerivator) Parameters() string {
+	hashFuncPointer := reflect.ValueOf(pd.hashFunc).Pointer()
+	for name, hashFunc := range pbkdf2Hashes {
+		if reflect.ValueOf(hashFunc).Pointer() == hashFuncPointer {
+			return fmt.Sprintf("$%s-%s$i=%d,l=%d",
+				algorithmPBKDF2, name, pd.iter, pd.keyLen)
+		}
+	}
+	return ""
+}
+
 func (pd *PBKDF2PasswordDerivator) Close() error {
 	return nil
 }
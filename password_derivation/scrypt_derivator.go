@@ -0,0 +1,48 @@
+package password_derivation
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+)
+
+type ScryptPasswordDerivator struct {
+	keyLen int
+	n      int
+	r      int
+	p      int
+}
+
+// NewScryptPasswordDerivator returns a scrypt derivator of cost n, a power
+// of two, block size r and parallelization p.
+func NewScryptPasswordDerivator(
+	keyLen, n, r, p int) (*ScryptPasswordDerivator, error) {
+
+	// the checks of scrypt.Key, which cannot fail past them
+	const maxInt = int(^uint(0) >> 1)
+	if n <= 1 || n&(n-1) != 0 {
+		return nil, errors.New("scrypt: n must be > 1 and a power of 2")
+	}
+	if r <= 0 || p <= 0 || keyLen <= 0 {
+		return nil, errors.New("scrypt: r, p and keyLen must be > 0")
+	}
+	if uint64(r)*uint64(p) >= 1<<30 || r > maxInt/128/p ||
+		r > maxInt/256 || n > maxInt/128/r {
+		return nil, errors.New("scrypt: parameters are too large")
+	}
+	return &ScryptPasswordDerivator{keyLen: keyLen, n: n, r: r, p: p}, nil
+}
+
+func (pd *ScryptPasswordDerivator) Call(pwd, salt []byte) []byte {
+	key, _ := scrypt.Key(pwd, salt, pd.n, pd.r, pd.p, pd.keyLen)
+	return key
+}
+
+func (pd *ScryptPasswordDerivator) Parameters() string {
+	return fmt.Sprintf("$%s$n=%d,r=%d,p=%d,l=%d",
+		algorithmScrypt, pd.n, pd.r, pd.p, pd.keyLen)
+}
+
+func (pd *ScryptPasswordDerivator) Close() error {
+	return nil
+}
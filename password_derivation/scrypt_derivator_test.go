@@ -0,0 +1,26 @@
+package password_derivation
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestScryptCall(t *testing.T) {
+	assert := assert.New(t)
+
+	pd, err := NewScryptPasswordDerivator(8, 16, 1, 1)
+	assert.Nil(err)
+
+	// RFC 7914 test vector, truncated
+	expectedDerivatedPwd, _ := hex.DecodeString("77d6576238657b20")
+	assert.Equal(expectedDerivatedPwd, pd.Call([]byte{}, []byte{}))
+	assert.Nil(pd.Close())
+
+	for _, params := range [][3]int{{15, 1, 1}, {1, 1, 1}, {16, 0, 1},
+		{16, 1, 0}, {16, 1 << 15, 1 << 15}} {
+		_, err := NewScryptPasswordDerivator(
+			8, params[0], params[1], params[2])
+		assert.NotNil(err, "%v", params)
+	}
+}
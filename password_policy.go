@@ -0,0 +1,380 @@
+package himitsu
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+)
+
+/*
+	Password policy.
+
+	The password of a user account is all that protects its repository
+	keys, so new passwords are checked against the policy, see
+	SetPasswordPolicy: a minimum length, a minimum entropy, and a denylist
+	of breached passwords.
+
+	The entropy is estimated in the style of zxcvbn: the password is split
+	into the patterns an attacker would try first, that is dictionary words
+	(common passwords and the denylist, by rank, with uppercase and l33t
+	variations), repeats, sequences, keyboard walks and years, the rest
+	being brute forced. The estimate is the log2 of the guesses the
+	cheapest split takes.
+*/
+
+const (
+	PASSWORD_RULE_MIN_LENGTH string = "min_length"
+	PASSWORD_RULE_ENTROPY    string = "entropy"
+	PASSWORD_RULE_DENYLIST   string = "denylist"
+)
+
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters.
+	MinLength int
+	// MinEntropy is the minimum estimated entropy, in bits, zero to skip.
+	MinEntropy float64
+	// Denylist holds the passwords refused whatever their strength, nil to
+	// skip, see LoadPasswordDenylist.
+	Denylist *PasswordDenylist
+}
+
+// DefaultPasswordPolicy only refuses short passwords. Deployments should
+// set an entropy and a denylist as well.
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: 8}
+
+type ErrWeakPassword struct {
+	failedRules []string
+}
+
+func (e *ErrWeakPassword) Error() string {
+	return fmt.Sprintf("Password fails the policy rules: %s",
+		strings.Join(e.failedRules, ", "))
+}
+
+// FailedRules returns the PASSWORD_RULE_* the password fails.
+func (e *ErrWeakPassword) FailedRules() []string {
+	return append([]string{}, e.failedRules...)
+}
+
+// PasswordDenylist is a list of breached passwords, most common first.
+type PasswordDenylist struct {
+	ranks map[string]int
+}
+
+// LoadPasswordDenylist reads a denylist file holding one password per line,
+// most common first. Passwords are refused whatever their case.
+func LoadPasswordDenylist(filename string) (*PasswordDenylist, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	denylist := &PasswordDenylist{ranks: make(map[string]int)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		password := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if _, exists := denylist.ranks[password]; password != "" && !exists {
+			denylist.ranks[password] = len(denylist.ranks) + 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return denylist, nil
+}
+
+func (d *PasswordDenylist) contains(password string) bool {
+	_, exists := d.ranks[strings.ToLower(password)]
+	return exists
+}
+
+// SetPasswordPolicy sets the policy the passwords of new user accounts and
+// changed passwords are checked against.
+func (h *Himitsu) SetPasswordPolicy(passwordPolicy PasswordPolicy) {
+	h.passwordPolicy = passwordPolicy
+}
+
+// Check returns ErrWeakPassword listing the rules the password fails, if
+// any.
+func (pp *PasswordPolicy) Check(password string) error {
+	failedRules := make([]string, 0)
+	if len([]rune(password)) < pp.MinLength {
+		failedRules = append(failedRules, PASSWORD_RULE_MIN_LENGTH)
+	}
+	if pp.MinEntropy > 0 &&
+		EstimatePasswordEntropy(password, pp.Denylist) < pp.MinEntropy {
+		failedRules = append(failedRules, PASSWORD_RULE_ENTROPY)
+	}
+	if pp.Denylist != nil && pp.Denylist.contains(password) {
+		failedRules = append(failedRules, PASSWORD_RULE_DENYLIST)
+	}
+
+	if len(failedRules) > 0 {
+		return &ErrWeakPassword{failedRules: failedRules}
+	}
+	return nil
+}
+
+// maxEstimatedLength bounds the work of the estimate: the characters past
+// it only make the password stronger.
+const maxEstimatedLength = 256
+
+// maxPatternLength bounds the length of the patterns looked for.
+const maxPatternLength = 64
+
+var commonPasswords = []string{
+	"password", "123456", "12345678", "qwerty", "123456789", "12345",
+	"1234", "111111", "1234567", "dragon", "123123", "baseball", "abc123",
+	"football", "monkey", "letmein", "shadow", "master", "696969",
+	"mustang", "666666", "qwertyuiop", "123321", "1234567890", "michael",
+	"654321", "superman", "1qaz2wsx", "7777777", "121212", "000000",
+	"qazwsx", "123qwe", "killer", "trustno1", "jordan", "jennifer",
+	"zxcvbnm", "asdfgh", "hunter", "buster", "soccer", "harley", "batman",
+	"andrew", "tigger", "sunshine", "iloveyou", "2000", "charlie",
+	"robert", "thomas", "hockey", "ranger", "daniel", "starwars",
+	"112233", "george", "computer", "michelle", "jessica",
+	"pepper", "1111", "zxcvbn", "555555", "11111111", "131313", "freedom",
+	"777777", "pass", "maggie", "159753", "aaaaaa", "ginger", "princess",
+	"joshua", "cheese", "amanda", "summer", "love", "ashley", "6969",
+	"nicole", "chelsea", "biteme", "matthew", "access", "yankees",
+	"987654321", "dallas", "austin", "thunder", "taylor", "matrix",
+	"admin", "welcome", "login", "secret", "passw0rd", "whatever",
+	"himitsu", "changeme", "root", "default", "guest", "test",
+}
+
+var commonPasswordRanks = func() map[string]int {
+	ranks := make(map[string]int, len(commonPasswords))
+	for i, password := range commonPasswords {
+		ranks[password] = i + 1
+	}
+	return ranks
+}()
+
+var l33tSubstitutions = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '@': 'a',
+	'$': 's', '!': 'i', '|': 'l', '+': 't',
+}
+
+var keyboardRows = []string{
+	"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./",
+}
+
+// EstimatePasswordEntropy estimates the entropy of the password, in bits,
+// taking the denylist, if any, as a dictionary.
+func EstimatePasswordEntropy(
+	password string, denylist *PasswordDenylist) float64 {
+
+	runes := []rune(password)
+	if len(runes) > maxEstimatedLength {
+		runes = runes[:maxEstimatedLength]
+	}
+	if len(runes) == 0 {
+		return 0
+	}
+
+	bruteForceBits := math.Log2(float64(cardinality(runes)))
+
+	// best[j] is the entropy of the cheapest split of runes[:j]
+	best := make([]float64, len(runes)+1)
+	for j := 1; j <= len(runes); j++ {
+		best[j] = best[j-1] + bruteForceBits
+		for i := j - 2; i >= 0 && j-i <= maxPatternLength; i-- {
+			if bits, ok := patternEntropy(runes[i:j], denylist); ok &&
+				best[i]+bits < best[j] {
+				best[j] = best[i] + bits
+			}
+		}
+	}
+	return best[len(runes)]
+}
+
+// cardinality returns the size of the character classes the password uses.
+func cardinality(runes []rune) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	size := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			size += class.size
+		}
+	}
+	return size
+}
+
+// patternEntropy returns the entropy of the cheapest pattern matching the
+// whole segment, ok being false when none does.
+func patternEntropy(
+	segment []rune, denylist *PasswordDenylist) (bits float64, ok bool) {
+
+	bits = math.Inf(1)
+	for _, estimate := range []func() (float64, bool){
+		func() (float64, bool) { return dictionaryEntropy(segment, denylist) },
+		func() (float64, bool) { return repeatEntropy(segment) },
+		func() (float64, bool) { return sequenceEntropy(segment) },
+		func() (float64, bool) { return keyboardEntropy(segment) },
+		func() (float64, bool) { return yearEntropy(segment) },
+	} {
+		if patternBits, matches := estimate(); matches && patternBits < bits {
+			bits, ok = patternBits, true
+		}
+	}
+	return bits, ok
+}
+
+func dictionaryRank(word string, denylist *PasswordDenylist) int {
+	rank := commonPasswordRanks[word]
+	if denylist != nil {
+		if denylistRank, exists := denylist.ranks[word]; exists &&
+			(rank == 0 || denylistRank < rank) {
+			rank = denylistRank
+		}
+	}
+	return rank
+}
+
+func dictionaryEntropy(
+	segment []rune, denylist *PasswordDenylist) (float64, bool) {
+
+	lowered := []rune(strings.ToLower(string(segment)))
+	bits := 0.0
+	rank := dictionaryRank(string(lowered), denylist)
+	if rank == 0 {
+		substituted := false
+		for i, r := range lowered {
+			if plain, isL33t := l33tSubstitutions[r]; isL33t {
+				lowered[i] = plain
+				substituted = true
+			}
+		}
+		if !substituted {
+			return 0, false
+		}
+		if rank = dictionaryRank(string(lowered), denylist); rank == 0 {
+			return 0, false
+		}
+		bits++
+	}
+
+	uppers := 0
+	for _, r := range segment {
+		if unicode.IsUpper(r) {
+			uppers++
+		}
+	}
+	switch {
+	case uppers == 0:
+	case uppers == len(segment) || (uppers == 1 && unicode.IsUpper(segment[0])):
+		bits++
+	default:
+		bits += float64(uppers)
+	}
+
+	return math.Log2(float64(rank)) + bits, true
+}
+
+func repeatEntropy(segment []rune) (float64, bool) {
+	if len(segment) < 3 {
+		return 0, false
+	}
+	for _, r := range segment[1:] {
+		if r != segment[0] {
+			return 0, false
+		}
+	}
+	return math.Log2(
+		float64(cardinality(segment[:1]) * len(segment))), true
+}
+
+func sequenceEntropy(segment []rune) (float64, bool) {
+	if len(segment) < 3 {
+		return 0, false
+	}
+	delta := segment[1] - segment[0]
+	if delta != 1 && delta != -1 {
+		return 0, false
+	}
+	for i := 2; i < len(segment); i++ {
+		if segment[i]-segment[i-1] != delta {
+			return 0, false
+		}
+	}
+
+	startGuesses := 26.0
+	switch {
+	case strings.ContainsRune("aAzZ019", segment[0]):
+		startGuesses = 4
+	case unicode.IsDigit(segment[0]):
+		startGuesses = 10
+	}
+	if delta < 0 {
+		startGuesses *= 2
+	}
+	return math.Log2(startGuesses * float64(len(segment))), true
+}
+
+func keyboardEntropy(segment []rune) (float64, bool) {
+	if len(segment) < 3 {
+		return 0, false
+	}
+	lowered := []rune(strings.ToLower(string(segment)))
+	for _, row := range keyboardRows {
+		keys := []rune(row)
+		position := func(r rune) int {
+			for i, key := range keys {
+				if key == r {
+					return i
+				}
+			}
+			return -1
+		}
+
+		walk := true
+		for i := 1; i < len(lowered) && walk; i++ {
+			from, to := position(lowered[i-1]), position(lowered[i])
+			walk = from >= 0 && to >= 0 && (to-from == 1 || from-to == 1)
+		}
+		if walk && position(lowered[0]) >= 0 {
+			// starting key, direction and length
+			return math.Log2(47 * 2 * float64(len(segment))), true
+		}
+	}
+	return 0, false
+}
+
+func yearEntropy(segment []rune) (float64, bool) {
+	if len(segment) != 4 {
+		return 0, false
+	}
+	year := 0
+	for _, r := range segment {
+		if r < '0' || r > '9' {
+			return 0, false
+		}
+		year = year*10 + int(r-'0')
+	}
+	if year < 1900 || year > 2099 {
+		return 0, false
+	}
+	return math.Log2(200), true
+}
@@ -0,0 +1,78 @@
+package himitsu
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEstimatePasswordEntropy(t *testing.T) {
+	assert := assert.New(t)
+
+	// patterns are much cheaper than their length suggests
+	for _, weak := range []string{"password", "P@ssw0rd", "aaaaaaaaaaaa",
+		"abcdefghijkl", "qwertyuiop", "1234567890", "Password2019"} {
+		assert.True(EstimatePasswordEntropy(weak, nil) < 28, weak)
+	}
+
+	for _, strong := range []string{"correct horse battery staple",
+		"x7#Kp2!vQ9zL", "tram-ribbon-oyster-56"} {
+		assert.True(EstimatePasswordEntropy(strong, nil) >= 28, strong)
+	}
+
+	assert.Equal(0.0, EstimatePasswordEntropy("", nil))
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "himitsu")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	denylistFile := filepath.Join(dir, "denylist.txt")
+	assert.Nil(ioutil.WriteFile(denylistFile,
+		[]byte("tram-ribbon-oyster-56\nhunter2\n"), 0600))
+	denylist, err := LoadPasswordDenylist(denylistFile)
+	assert.Nil(err)
+
+	policy := &PasswordPolicy{MinLength: 12, MinEntropy: 28,
+		Denylist: denylist}
+
+	assert.Nil(policy.Check("correct horse battery staple"))
+
+	err = policy.Check("")
+	assert.IsType(&ErrWeakPassword{}, err)
+	assert.Equal([]string{PASSWORD_RULE_MIN_LENGTH, PASSWORD_RULE_ENTROPY},
+		err.(*ErrWeakPassword).FailedRules())
+
+	err = policy.Check("Tram-Ribbon-Oyster-56")
+	assert.Equal([]string{PASSWORD_RULE_ENTROPY, PASSWORD_RULE_DENYLIST},
+		err.(*ErrWeakPassword).FailedRules())
+
+	err = policy.Check("hunter2")
+	assert.Equal([]string{PASSWORD_RULE_MIN_LENGTH, PASSWORD_RULE_ENTROPY,
+		PASSWORD_RULE_DENYLIST}, err.(*ErrWeakPassword).FailedRules())
+}
+
+func TestWeakPasswordsAreRefused(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	_, _, err := h.CreateRepository("repo", "admin", "")
+	assert.IsType(&ErrWeakPassword{}, err)
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+
+	_, err = h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "short", []string{RIGHT_READ_SECRET})
+	assert.IsType(&ErrWeakPassword{}, err)
+
+	assert.IsType(&ErrWeakPassword{},
+		h.ChangeUserPassword(adminUUID, "password", "short", ""))
+	_, err = h.ReadSecret(repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+}
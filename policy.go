@@ -0,0 +1,487 @@
+package himitsu
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+	Access to secrets is granted by policies stored in the repository.
+
+	A policy is a list of allow/deny rules, each matching secret paths with
+	a glob and a set of capabilities. '*' matches within a path segment and
+	'**' across segments, so 'ci/*' matches 'ci/token' and 'ci/**' matches
+	'ci/deploy/token' too.
+
+	A user account is bound to an ordered list of policies, its personal
+	policy granting its rights on '**' among them. Rules are evaluated in
+	order, policy after policy: the first rule matching both the secret path
+	and the capability decides, and nothing matching means deny. Setting the
+	rights of a user account moves its personal policy last, after the
+	policies which may deny some paths.
+*/
+
+const (
+	CAPABILITY_READ   string = "read"
+	CAPABILITY_WRITE  string = "write"
+	CAPABILITY_LIST   string = "list"
+	CAPABILITY_DELETE string = "delete"
+	CAPABILITY_RENAME string = "rename"
+
+	POLICY_EFFECT_ALLOW string = "allow"
+	POLICY_EFFECT_DENY  string = "deny"
+
+	AUDIT_OPERATION_SET_POLICY                string = "SetPolicy"
+	AUDIT_OPERATION_DELETE_POLICY             string = "DeletePolicy"
+	AUDIT_OPERATION_SET_USER_ACCOUNT_POLICIES string = "SetUserAccountPolicies"
+	AUDIT_OPERATION_LIST_POLICIES             string = "ListPolicies"
+)
+
+var rightCapabilities = map[string]string{
+	RIGHT_READ_SECRET:   CAPABILITY_READ,
+	RIGHT_WRITE_SECRET:  CAPABILITY_WRITE,
+	RIGHT_LIST_SECRET:   CAPABILITY_LIST,
+	RIGHT_DELETE_SECRET: CAPABILITY_DELETE,
+	RIGHT_RENAME_SECRET: CAPABILITY_RENAME,
+}
+
+type PolicyRule struct {
+	Effect       string   `json:"effect"`
+	Path         string   `json:"path"`
+	Capabilities []string `json:"capabilities"`
+
+	// pathRegexp is Path compiled when the policy is set or decoded, see
+	// compile.
+	pathRegexp *regexp.Regexp
+}
+
+type Policy struct {
+	Name  string        `json:"name"`
+	Rules []*PolicyRule `json:"rules"`
+}
+
+type ErrInvalidPolicy struct {
+	policyName string
+	reason     string
+}
+
+func (e *ErrInvalidPolicy) Error() string {
+	return fmt.Sprintf("Invalid policy '%s': %s", e.policyName, e.reason)
+}
+
+type ErrUnknownPolicy struct {
+	policyName string
+}
+
+func (e *ErrUnknownPolicy) Error() string {
+	return fmt.Sprintf("Policy '%s' not found", e.policyName)
+}
+
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	pattern := regexp.QuoteMeta(glob)
+	pattern = strings.Replace(pattern, `\*\*`, ".*", -1)
+	pattern = strings.Replace(pattern, `\*`, "[^/]*", -1)
+	pattern = strings.Replace(pattern, `\?`, "[^/]", -1)
+	return regexp.Compile("^" + pattern + "$")
+}
+
+func (pr *PolicyRule) matches(secretName, capability string) bool {
+	hasCapability := false
+	for _, c := range pr.Capabilities {
+		if c == capability {
+			hasCapability = true
+			break
+		}
+	}
+	if !hasCapability {
+		return false
+	}
+
+	// a rule which did not compile matches nothing
+	return pr.pathRegexp != nil && pr.pathRegexp.MatchString(secretName)
+}
+
+// compile compiles the path of the rule, see matches.
+func (pr *PolicyRule) compile() error {
+	pathRegexp, err := globToRegexp(pr.Path)
+	if err != nil {
+		return err
+	}
+	pr.pathRegexp = pathRegexp
+	return nil
+}
+
+// compilePolicies compiles the paths of the decoded policies. Those stored
+// were checked when set, see Policy.check.
+func (r *Repository) compilePolicies() {
+	for _, policy := range r.Policies {
+		for _, rule := range policy.Rules {
+			rule.compile()
+		}
+	}
+}
+
+func (p *Policy) check() error {
+	if p.Name == "" {
+		return &ErrInvalidPolicy{policyName: p.Name, reason: "empty name"}
+	}
+
+	for _, rule := range p.Rules {
+		if rule.Effect != POLICY_EFFECT_ALLOW &&
+			rule.Effect != POLICY_EFFECT_DENY {
+			return &ErrInvalidPolicy{policyName: p.Name,
+				reason: fmt.Sprintf("unknown effect '%s'", rule.Effect)}
+		}
+		if rule.Path == "" {
+			return &ErrInvalidPolicy{policyName: p.Name, reason: "empty path"}
+		}
+		if err := rule.compile(); err != nil {
+			return &ErrInvalidPolicy{policyName: p.Name,
+				reason: fmt.Sprintf("invalid path '%s'", rule.Path)}
+		}
+		for _, capability := range rule.Capabilities {
+			switch capability {
+			case CAPABILITY_READ, CAPABILITY_WRITE,
+				CAPABILITY_LIST, CAPABILITY_DELETE, CAPABILITY_RENAME:
+			default:
+				return &ErrInvalidPolicy{policyName: p.Name, reason: fmt.Sprintf(
+					"unknown capability '%s'", capability)}
+			}
+		}
+	}
+	return nil
+}
+
+// isAllowed evaluates the policies of the user account for the capability on
+// the secret path, in order: the first matching rule decides.
+func (r *Repository) isAllowed(
+	userAccount *UserAccount, capability, secretName string) bool {
+
+	if r.apiKey != nil && !r.apiKey.allows(capability, secretName) {
+		return false
+	}
+
+	for _, policyName := range userAccount.Policies {
+		policy, exists := r.Policies[policyName]
+		if !exists {
+			continue
+		}
+		for _, rule := range policy.Rules {
+			if rule.matches(secretName, capability) {
+				return rule.Effect == POLICY_EFFECT_ALLOW
+			}
+		}
+	}
+	return false
+}
+
+func personalPolicyName(userUUID string) string {
+	return "user:" + userUUID
+}
+
+// parseRights translates right names into the capabilities of the personal
+// policy of a user account and its admin flag.
+func parseRights(rights []string) ([]string, bool, error) {
+	capabilitySet := make(map[string]bool)
+	canAdminUserAccounts := false
+
+	for _, rightName := range rights {
+		switch rightName {
+		case RIGHT_READ_SECRET:
+			capabilitySet[CAPABILITY_READ] = true
+			capabilitySet[CAPABILITY_LIST] = true
+		case RIGHT_WRITE_SECRET:
+			capabilitySet[CAPABILITY_WRITE] = true
+		case RIGHT_LIST_SECRET:
+			capabilitySet[CAPABILITY_LIST] = true
+		case RIGHT_DELETE_SECRET:
+			capabilitySet[CAPABILITY_DELETE] = true
+		case RIGHT_RENAME_SECRET:
+			capabilitySet[CAPABILITY_RENAME] = true
+		case RIGHT_ADMIN_USER_ACCOUNTS:
+			canAdminUserAccounts = true
+		default:
+			return nil, false, &ErrUnknownRight{rightName: rightName}
+		}
+	}
+
+	capabilities := make([]string, 0, len(capabilitySet))
+	for capability := range capabilitySet {
+		capabilities = append(capabilities, capability)
+	}
+	sort.Strings(capabilities)
+	return capabilities, canAdminUserAccounts, nil
+}
+
+// applyRights replaces the personal policy of the user account, which allows
+// the capabilities on every secret, and its admin flag.
+func (r *Repository) applyRights(userAccount *UserAccount,
+	capabilities []string, canAdminUserAccounts bool) {
+
+	if r.Policies == nil {
+		r.Policies = make(map[string]*Policy)
+	}
+
+	policyName := personalPolicyName(userAccount.UUID)
+	userAccount.unbindPolicy(policyName)
+	delete(r.Policies, policyName)
+
+	if len(capabilities) > 0 {
+		rule := &PolicyRule{
+			Effect:       POLICY_EFFECT_ALLOW,
+			Path:         "**",
+			Capabilities: capabilities}
+		rule.compile()
+		r.Policies[policyName] = &Policy{
+			Name:  policyName,
+			Rules: []*PolicyRule{rule}}
+		userAccount.Policies = append(userAccount.Policies, policyName)
+	}
+
+	userAccount.CanAdminUserAccounts = canAdminUserAccounts
+}
+
+func (ua *UserAccount) unbindPolicy(policyName string) {
+	policies := make([]string, 0, len(ua.Policies))
+	for _, name := range ua.Policies {
+		if name != policyName {
+			policies = append(policies, name)
+		}
+	}
+	ua.Policies = policies
+}
+
+// migratePolicies turns the boolean secret rights of repositories stored
+// before policies existed into equivalent personal policies. The rename
+// right becomes the rename capability alone, granting neither writing nor
+// deleting.
+func (r *Repository) migratePolicies() {
+	if r.Policies != nil {
+		return
+	}
+	r.Policies = make(map[string]*Policy)
+
+	for _, userAccount := range r.UserAccounts {
+		rights := make([]string, 0)
+		if userAccount.CanReadSecret {
+			rights = append(rights, RIGHT_READ_SECRET)
+		}
+		if userAccount.CanWriteSecret {
+			rights = append(rights, RIGHT_WRITE_SECRET)
+		}
+		if userAccount.CanDeleteSecret {
+			rights = append(rights, RIGHT_DELETE_SECRET)
+		}
+		if userAccount.CanRenameSecret {
+			rights = append(rights, RIGHT_RENAME_SECRET)
+		}
+
+		capabilities, _, _ := parseRights(rights)
+		r.applyRights(
+			userAccount, capabilities, userAccount.CanAdminUserAccounts)
+
+		userAccount.CanReadSecret = false
+		userAccount.CanWriteSecret = false
+		userAccount.CanDeleteSecret = false
+		userAccount.CanRenameSecret = false
+	}
+}
+
+func (r *Repository) checkAdminRight(userUUID string) error {
+	userAccount, err := r.findUserAccount(userUUID)
+	if err != nil {
+		return err
+	}
+	return r.checkRight(userAccount, RIGHT_ADMIN_USER_ACCOUNTS, "")
+}
+
+func (r *Repository) SetPolicy(userUUID string, policy *Policy) error {
+	if err := r.checkAdminRight(userUUID); err != nil {
+		return err
+	}
+
+	if err := policy.check(); err != nil {
+		return err
+	}
+
+	r.Policies[policy.Name] = policy
+
+	return nil
+}
+
+func (r *Repository) DeletePolicy(userUUID, policyName string) error {
+	if err := r.checkAdminRight(userUUID); err != nil {
+		return err
+	}
+
+	if _, exists := r.Policies[policyName]; !exists {
+		return &ErrUnknownPolicy{policyName: policyName}
+	}
+
+	delete(r.Policies, policyName)
+	for _, userAccount := range r.UserAccounts {
+		userAccount.unbindPolicy(policyName)
+	}
+
+	return nil
+}
+
+func (r *Repository) ListPolicies(userUUID string) ([]*Policy, error) {
+	if err := r.checkAdminRight(userUUID); err != nil {
+		return nil, err
+	}
+
+	policyNames := make([]string, 0, len(r.Policies))
+	for policyName := range r.Policies {
+		policyNames = append(policyNames, policyName)
+	}
+	sort.Strings(policyNames)
+
+	policies := make([]*Policy, 0, len(policyNames))
+	for _, policyName := range policyNames {
+		policies = append(policies, r.Policies[policyName])
+	}
+	return policies, nil
+}
+
+// SetUserAccountPolicies binds the user account to the policies.
+func (r *Repository) SetUserAccountPolicies(
+	userUUID, targetUserUUID string, policyNames []string) error {
+
+	if err := r.checkAdminRight(userUUID); err != nil {
+		return err
+	}
+
+	targetUserAccount, err := r.findUserAccount(targetUserUUID)
+	if err != nil {
+		return err
+	}
+
+	for _, policyName := range policyNames {
+		if _, exists := r.Policies[policyName]; !exists {
+			return &ErrUnknownPolicy{policyName: policyName}
+		}
+	}
+
+	targetUserAccount.Policies = append([]string{}, policyNames...)
+
+	return nil
+}
+
+func (h *Himitsu) SetPolicy(
+	repoUUID, userUUID, userPwd string, policy *Policy) (err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_SET_POLICY,
+		userUUID, repoUUID, policy.Name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if err := repository.SetPolicy(userUUID, policy); err != nil {
+		return err
+	}
+
+	return record.saveRepository(repository, repoKey)
+}
+
+func (h *Himitsu) DeletePolicy(
+	repoUUID, userUUID, userPwd, policyName string) (err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_DELETE_POLICY,
+		userUUID, repoUUID, policyName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if err := repository.DeletePolicy(userUUID, policyName); err != nil {
+		return err
+	}
+
+	return record.saveRepository(repository, repoKey)
+}
+
+func (h *Himitsu) ListPolicies(repoUUID, userUUID, userPwd string) (
+	policies []*Policy, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_LIST_POLICIES,
+		userUUID, repoUUID, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			policies = nil
+		}
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	return repository.ListPolicies(userUUID)
+}
+
+func (h *Himitsu) SetUserAccountPolicies(repoUUID, userUUID, userPwd,
+	targetUserUUID string, policyNames []string) (err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_SET_USER_ACCOUNT_POLICIES,
+		userUUID, repoUUID, targetUserUUID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if err := repository.SetUserAccountPolicies(
+		userUUID, targetUserUUID, policyNames); err != nil {
+		return err
+	}
+
+	return record.saveRepository(repository, repoKey)
+}
@@ -0,0 +1,130 @@
+package himitsu
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFirstMatchingRuleDecides(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	for _, secretName := range []string{"prod/db", "prod/public"} {
+		assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", secretName,
+			[]byte("s3cr3t"), nil))
+	}
+
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{RIGHT_READ_SECRET})
+	assert.Nil(err)
+	assert.Nil(h.SetPolicy(repoUUID, adminUUID, "password", &Policy{
+		Name: "no-prod",
+		Rules: []*PolicyRule{
+			{Effect: POLICY_EFFECT_ALLOW, Path: "prod/public",
+				Capabilities: []string{CAPABILITY_READ}},
+			{Effect: POLICY_EFFECT_DENY, Path: "prod/**",
+				Capabilities: []string{CAPABILITY_READ}}}}))
+	canRead := func(secretName string) bool {
+		_, err := h.ReadSecret(repoUUID, bobUUID, "bob password", secretName)
+		return err == nil
+	}
+
+	// the personal policy, which allows every path, comes first
+	assert.Nil(h.SetUserAccountPolicies(repoUUID, adminUUID, "password",
+		bobUUID, []string{personalPolicyName(bobUUID), "no-prod"}))
+	assert.True(canRead("prod/db"))
+
+	// setting the rights moves it last
+	assert.Nil(h.UpdateUserAccountRights(repoUUID, adminUUID, "password",
+		bobUUID, []string{RIGHT_READ_SECRET}))
+	assert.True(canRead("prod/public"))
+	assert.False(canRead("prod/db"))
+	assert.True(canRead("hello"))
+
+	// nothing matching means deny
+	assert.Nil(h.SetUserAccountPolicies(repoUUID, adminUUID, "password",
+		bobUUID, []string{"no-prod"}))
+	assert.True(canRead("prod/public"))
+	assert.False(canRead("hello"))
+}
+
+func TestPolicyPathsAreCompiledWhenDecoded(t *testing.T) {
+	assert := assert.New(t)
+
+	policy := &Policy{Name: "ci", Rules: []*PolicyRule{{
+		Effect: POLICY_EFFECT_ALLOW, Path: "ci/*",
+		Capabilities: []string{CAPABILITY_READ}}}}
+	assert.Nil(policy.check())
+	assert.NotNil(policy.Rules[0].pathRegexp)
+
+	userAccount := &UserAccount{UUID: "uuid-1", Policies: []string{"ci"}}
+	var encodedRepo bytes.Buffer
+	assert.Nil(gob.NewEncoder(&encodedRepo).Encode(&Repository{
+		UserAccounts: map[string]*UserAccount{"uuid-1": userAccount},
+		Policies:     map[string]*Policy{"ci": policy}}))
+
+	repository, err := decodeRepository(encodedRepo.Bytes())
+	assert.Nil(err)
+	assert.NotNil(repository.Policies["ci"].Rules[0].pathRegexp)
+
+	userAccount = repository.UserAccounts["uuid-1"]
+	assert.True(repository.isAllowed(userAccount, CAPABILITY_READ, "ci/token"))
+	assert.False(repository.isAllowed(
+		userAccount, CAPABILITY_READ, "ci/deploy/token"))
+}
+
+func TestMigratePoliciesFromBooleanRights(t *testing.T) {
+	assert := assert.New(t)
+
+	// repositories stored before policies had no policy at all
+	var encodedRepo bytes.Buffer
+	assert.Nil(gob.NewEncoder(&encodedRepo).Encode(&Repository{
+		UserAccounts: map[string]*UserAccount{
+			"admin": {UUID: "admin", CanReadSecret: true,
+				CanWriteSecret: true, CanDeleteSecret: true,
+				CanRenameSecret: true, CanAdminUserAccounts: true},
+			"reader":  {UUID: "reader", CanReadSecret: true},
+			"renamer": {UUID: "renamer", CanRenameSecret: true},
+			"nobody":  {UUID: "nobody"}}}))
+
+	repository, err := decodeRepository(encodedRepo.Bytes())
+	assert.Nil(err)
+
+	hasRight := func(userUUID, rightName string) bool {
+		return repository.checkRight(repository.UserAccounts[userUUID],
+			rightName, "db/password") == nil
+	}
+
+	for _, rightName := range []string{RIGHT_READ_SECRET, RIGHT_WRITE_SECRET,
+		RIGHT_LIST_SECRET, RIGHT_DELETE_SECRET, RIGHT_ADMIN_USER_ACCOUNTS} {
+		assert.True(hasRight("admin", rightName), rightName)
+		assert.False(hasRight("nobody", rightName), rightName)
+	}
+
+	assert.True(hasRight("reader", RIGHT_READ_SECRET))
+	assert.True(hasRight("reader", RIGHT_LIST_SECRET))
+	assert.False(hasRight("reader", RIGHT_WRITE_SECRET))
+	assert.False(hasRight("reader", RIGHT_ADMIN_USER_ACCOUNTS))
+
+	// renaming grants neither writing nor deleting
+	assert.False(hasRight("renamer", RIGHT_WRITE_SECRET))
+	assert.False(hasRight("renamer", RIGHT_DELETE_SECRET))
+	assert.False(hasRight("renamer", RIGHT_READ_SECRET))
+	assert.True(repository.isAllowed(repository.UserAccounts["renamer"],
+		CAPABILITY_RENAME, "db/password"))
+	assert.True(repository.isAllowed(repository.UserAccounts["admin"],
+		CAPABILITY_RENAME, "db/password"))
+
+	// the booleans are gone once migrated
+	for _, userAccount := range repository.UserAccounts {
+		assert.False(userAccount.CanReadSecret || userAccount.CanWriteSecret ||
+			userAccount.CanDeleteSecret || userAccount.CanRenameSecret)
+	}
+	assert.Equal([]string{personalPolicyName("reader")},
+		repository.UserAccounts["reader"].Policies)
+	assert.Len(repository.UserAccounts["nobody"].Policies, 0)
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package himitsu
+
+// allocateProtected falls back to the Go heap where memory cannot be mapped
+// and locked.
+func allocateProtected(size int) ([]byte, error) {
+	return make([]byte, size), nil
+}
+
+func freeProtected(buffer []byte) error {
+	Zero(buffer)
+	return nil
+}
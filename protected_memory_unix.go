@@ -0,0 +1,32 @@
+//go:build unix
+
+package himitsu
+
+import (
+	"syscall"
+)
+
+// allocateProtected maps size bytes outside of the Go heap, so that the
+// garbage collector never copies them around, and locks them in memory so
+// that they are never swapped out.
+func allocateProtected(size int) ([]byte, error) {
+	buffer, err := syscall.Mmap(-1, 0, size,
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Mlock(buffer); err != nil {
+		syscall.Munmap(buffer)
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// freeProtected zeroes and unmaps a buffer from allocateProtected.
+func freeProtected(buffer []byte) error {
+	Zero(buffer)
+	syscall.Munlock(buffer)
+	return syscall.Munmap(buffer)
+}
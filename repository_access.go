@@ -0,0 +1,545 @@
+package himitsu
+
+import (
+	"fmt"
+	"time"
+)
+
+type RepositoryInfo struct {
+	UUID  string `json:"uuid"`
+	Label string `json:"label"`
+}
+
+// unwrapLegacyRepositoryKey returns the repository key stored in the legacy
+// layout for the user account, with its legacy pending keys applied, or nil
+// if the user account has no legacy key.
+func (h *Himitsu) unwrapLegacyRepositoryKey(
+	userUUID string, derivedUserPwd []byte) ([]byte, error) {
+
+	legacyCipherRepoKey, err := h.dataAccess.ReadLegacyCipherRepositoryKey(
+		userUUID)
+	if err != nil {
+		return nil, err
+	}
+	if legacyCipherRepoKey == nil {
+		return nil, nil
+	}
+
+	repoKey, err := h.cryptoEngine.Decrypt(legacyCipherRepoKey, derivedUserPwd)
+	if err != nil {
+		return nil, h.passwordUnwrapError(userUUID, err)
+	}
+
+	encodedPendingKeys, err := h.dataAccess.ReadLegacyPendingRepositoryKeys(
+		userUUID)
+	if err != nil {
+		Zero(repoKey)
+		return nil, err
+	}
+	pendingKeys, err := decodePendingRepositoryKeys(encodedPendingKeys)
+	if err != nil {
+		Zero(repoKey)
+		return nil, err
+	}
+
+	return h.walkPendingRepositoryKeys(repoKey, pendingKeys)
+}
+
+// migrateLegacyRepositoryKey moves the legacy key of the user account to the
+// current layout once it is proven to open the repository.
+func (h *Himitsu) migrateLegacyRepositoryKey(
+	userUUID, repoUUID string, derivedUserPwd []byte) ([]byte, error) {
+
+	repoKey, err := h.unwrapLegacyRepositoryKey(userUUID, derivedUserPwd)
+	if err != nil {
+		return nil, err
+	}
+	if repoKey == nil {
+		return nil, fmt.Errorf(
+			"UserAccount '%s' has no key for repository '%s'",
+			userUUID, repoUUID)
+	}
+
+	pendingKeys, err := h.readPendingRepositoryKeys(userUUID, repoUUID)
+	if err != nil {
+		Zero(repoKey)
+		return nil, err
+	}
+	repoKey, err = h.walkPendingRepositoryKeys(repoKey, pendingKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	cipherRepo, err := h.dataAccess.ReadCipherRepository(repoUUID)
+	if err != nil {
+		Zero(repoKey)
+		return nil, err
+	}
+	encodedRepo, err := h.cryptoEngine.Decrypt(cipherRepo, repoKey)
+	if err != nil {
+		// the legacy key belongs to another repository
+		Zero(repoKey)
+		return nil, &ErrNotFound{err: err}
+	}
+	Zero(encodedRepo)
+
+	cipherRepoKey, err := h.wrapRepositoryKey(repoKey, derivedUserPwd)
+	if err != nil {
+		Zero(repoKey)
+		return nil, err
+	}
+
+	if err := h.dataAccess.MigrateLegacyCipherRepositoryKey(
+		userUUID, repoUUID, cipherRepoKey); err != nil {
+		Zero(repoKey)
+		return nil, err
+	}
+	if err := h.ensureKeyPair(userUUID, derivedUserPwd); err != nil {
+		Zero(repoKey)
+		return nil, err
+	}
+	return repoKey, nil
+}
+
+// verifyUserPassword checks the derived password against any repository key
+// of the user account.
+func (h *Himitsu) verifyUserPassword(
+	userUUID string, derivedUserPwd []byte) error {
+
+	repoUUIDs, err := h.dataAccess.ListRepositoryUUIDs(userUUID)
+	if err != nil {
+		return err
+	}
+
+	var repoKey []byte
+	if len(repoUUIDs) > 0 {
+		repoKey, err = h.unwrapRepositoryKey(
+			userUUID, repoUUIDs[0], derivedUserPwd)
+	} else {
+		repoKey, err = h.unwrapLegacyRepositoryKey(userUUID, derivedUserPwd)
+	}
+	if err != nil {
+		return err
+	}
+	if repoKey == nil {
+		// the password could not be checked
+		return &ErrInvalidCredentials{userUUID: userUUID}
+	}
+	Zero(repoKey)
+	return nil
+}
+
+// authenticateUserAccountPassword derives the password of the user account
+// and checks it against its keys, leaving its TOTP aside.
+func (h *Himitsu) authenticateUserAccountPassword(
+	userUUID, userPwd string) ([]byte, error) {
+
+	derivedUserPwd, err := h.deriveUserPassword(userUUID, userPwd)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.verifyUserPassword(userUUID, derivedUserPwd); err != nil {
+		Zero(derivedUserPwd)
+		return nil, err
+	}
+	return derivedUserPwd, nil
+}
+
+// authenticateUserAccount derives the password of the user account and
+// checks it, along with its TOTP code when it is enrolled.
+func (h *Himitsu) authenticateUserAccount(
+	userUUID, userPwd, totpCode string) ([]byte, error) {
+
+	derivedUserPwd, err := h.authenticateUserAccountPassword(
+		userUUID, userPwd)
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.checkTOTP(userUUID, derivedUserPwd, totpCode)
+	if err == nil {
+		err = h.clearFailedUnwraps(lockoutSubjectUserAccount + userUUID)
+	}
+	if err != nil {
+		Zero(derivedUserPwd)
+		return nil, err
+	}
+	return derivedUserPwd, nil
+}
+
+/*
+	Invitations.
+
+	An existing user account reaches a new repository with the same UUID and
+	password as its other repositories. Wrapping the repository key under
+	its password takes the password, which the admin must not learn, so the
+	access is granted in two steps: the admin invites the user account,
+	sealing the repository key to its public key, see key pairs, and the
+	user account accepts with its own credentials, which open the sealed key
+	and wrap it under its password.
+
+	Until it accepts, the invited user account is no member of the
+	repository, and key rotations seal their new key to it as to members.
+*/
+
+const (
+	AUDIT_OPERATION_INVITE_USER_ACCOUNT string = "InviteUserAccount"
+	AUDIT_OPERATION_ACCEPT_INVITATION   string = "AcceptInvitation"
+	AUDIT_OPERATION_REVOKE_INVITATION   string = "RevokeInvitation"
+	AUDIT_OPERATION_LIST_REPOSITORIES   string = "ListRepositories"
+)
+
+type Invitation struct {
+	UserUUID  string    `json:"user_uuid"`
+	Label     string    `json:"label"`
+	Rights    []string  `json:"rights"`
+	InvitedBy string    `json:"invited_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ErrUnknownInvitation struct {
+	userUUID string
+}
+
+func (e *ErrUnknownInvitation) Error() string {
+	return fmt.Sprintf("No invitation for UserAccount '%s'", e.userUUID)
+}
+
+func (r *Repository) AddInvitation(
+	userUUID string, invitation *Invitation) error {
+
+	if err := r.checkAdminRight(userUUID); err != nil {
+		return err
+	}
+
+	if _, exists := r.UserAccounts[invitation.UserUUID]; exists {
+		return fmt.Errorf("UserAccount '%s' already exists",
+			invitation.UserUUID)
+	}
+
+	if _, _, err := parseRights(invitation.Rights); err != nil {
+		return err
+	}
+
+	if r.Invitations == nil {
+		r.Invitations = make(map[string]*Invitation)
+	}
+	r.Invitations[invitation.UserUUID] = invitation
+
+	return nil
+}
+
+func (r *Repository) RemoveInvitation(
+	userUUID, invitedUserUUID string) error {
+
+	if err := r.checkAdminRight(userUUID); err != nil {
+		return err
+	}
+
+	if _, exists := r.Invitations[invitedUserUUID]; !exists {
+		return &ErrUnknownInvitation{userUUID: invitedUserUUID}
+	}
+	delete(r.Invitations, invitedUserUUID)
+
+	return nil
+}
+
+// acceptInvitation adds the invited user account with the rights of its
+// invitation.
+func (r *Repository) acceptInvitation(userUUID string) error {
+	invitation, exists := r.Invitations[userUUID]
+	if !exists {
+		return &ErrUnknownInvitation{userUUID: userUUID}
+	}
+
+	capabilities, canAdminUserAccounts, err := parseRights(invitation.Rights)
+	if err != nil {
+		return err
+	}
+
+	userAccount := &UserAccount{UUID: userUUID, Label: invitation.Label}
+	r.applyRights(userAccount, capabilities, canAdminUserAccounts)
+	r.UserAccounts[userUUID] = userAccount
+	delete(r.Invitations, userUUID)
+
+	return nil
+}
+
+// InviteUserAccount invites an existing user account to the repository with
+// the rights given, see AcceptInvitation. The user account must have a key
+// pair, that is have authenticated since key pairs exist.
+func (h *Himitsu) InviteUserAccount(repoUUID, userUUID, userPwd,
+	invitedUserUUID, invitedUserLabel string, rights []string) (err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_INVITE_USER_ACCOUNT,
+		userUUID, repoUUID, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if err := repository.AddInvitation(userUUID, &Invitation{
+		UserUUID:  invitedUserUUID,
+		Label:     invitedUserLabel,
+		Rights:    rights,
+		InvitedBy: userUUID,
+		CreatedAt: time.Now().UTC()}); err != nil {
+		return err
+	}
+
+	publicKey, _, err := h.dataAccess.ReadKeyPair(invitedUserUUID)
+	if err != nil {
+		return err
+	}
+	if publicKey == nil {
+		return &ErrNoKeyPair{slot: invitedUserUUID}
+	}
+
+	sealedKey, err := h.sealKey(repoKey, publicKey)
+	if err != nil {
+		return err
+	}
+
+	batch := h.dataAccess.NewBatch()
+	batch.SaveSealedRepositoryKey(invitedUserUUID, repoUUID, sealedKey)
+	if err := h.batchSaveRepository(batch, repository, repoKey); err != nil {
+		return err
+	}
+
+	return record.commit(batch)
+}
+
+// AcceptInvitation adds the user account to the repository it was invited
+// to, wrapping the repository key under its password. It takes a TOTP code
+// when the user account is enrolled, see EnrollTOTP.
+func (h *Himitsu) AcceptInvitation(
+	repoUUID, userUUID, userPwd, totpCode string) (err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_ACCEPT_INVITATION,
+		userUUID, repoUUID, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	derivedUserPwd, err := h.authenticateUserAccount(
+		userUUID, userPwd, totpCode)
+	if err != nil {
+		return err
+	}
+	defer Zero(derivedUserPwd)
+
+	sealedKey, err := h.dataAccess.ReadSealedRepositoryKey(userUUID, repoUUID)
+	if err != nil {
+		return err
+	}
+	if sealedKey == nil {
+		return &ErrUnknownInvitation{userUUID: userUUID}
+	}
+
+	privateKey, err := h.unwrapPrivateKey(userUUID, derivedUserPwd)
+	if err != nil {
+		return err
+	}
+	repoKey, err := h.openSealedKey(sealedKey, privateKey)
+	if err != nil {
+		return err
+	}
+	defer Zero(repoKey)
+
+	repository, err := h.loadRepository(repoUUID, repoKey)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if err := repository.acceptInvitation(userUUID); err != nil {
+		return err
+	}
+
+	cipherRepoKey, err := h.wrapRepositoryKey(repoKey, derivedUserPwd)
+	if err != nil {
+		return err
+	}
+
+	batch := h.dataAccess.NewBatch()
+	batch.DeleteCipherRepositoryKey(userUUID, repoUUID)
+	batch.SaveCipherRepositoryKey(userUUID, repoUUID, cipherRepoKey)
+	if err := h.batchSaveRepository(batch, repository, repoKey); err != nil {
+		return err
+	}
+
+	return record.commit(batch)
+}
+
+// GrantRepositoryAccess adds an existing user account to the repository with
+// the rights given, inviting it and accepting in its name, for a caller
+// holding the credentials of both user accounts, as someone bringing their
+// own user account into a repository they administer. The invitation is
+// withdrawn if it cannot be accepted. Otherwise, InviteUserAccount and
+// AcceptInvitation keep the password of the user account away from the
+// admin.
+func (h *Himitsu) GrantRepositoryAccess(repoUUID, userUUID, userPwd,
+	grantedUserUUID, grantedUserPwd, grantedTOTPCode,
+	grantedUserLabel string, rights []string) error {
+
+	if err := h.InviteUserAccount(repoUUID, userUUID, userPwd,
+		grantedUserUUID, grantedUserLabel, rights); err != nil {
+		return err
+	}
+
+	err := h.AcceptInvitation(
+		repoUUID, grantedUserUUID, grantedUserPwd, grantedTOTPCode)
+	if err != nil {
+		h.RevokeInvitation(repoUUID, userUUID, userPwd, grantedUserUUID)
+		return err
+	}
+	return nil
+}
+
+// RevokeInvitation withdraws the invitation of the user account, along with
+// its sealed repository key.
+func (h *Himitsu) RevokeInvitation(
+	repoUUID, userUUID, userPwd, invitedUserUUID string) (err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_REVOKE_INVITATION,
+		userUUID, repoUUID, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if err := repository.RemoveInvitation(
+		userUUID, invitedUserUUID); err != nil {
+		return err
+	}
+
+	batch := h.dataAccess.NewBatch()
+	batch.DeleteCipherRepositoryKey(invitedUserUUID, repoUUID)
+	if err := h.batchSaveRepository(batch, repository, repoKey); err != nil {
+		return err
+	}
+
+	return record.commit(batch)
+}
+
+// migrateLegacyRepositoryKeys moves the legacy key of the user account, if
+// any, to the current layout without waiting for it to open its repository,
+// which is looked up among every repository.
+func (h *Himitsu) migrateLegacyRepositoryKeys(
+	userUUID string, derivedUserPwd []byte) error {
+
+	legacyRepoKey, err := h.unwrapLegacyRepositoryKey(
+		userUUID, derivedUserPwd)
+	if err != nil || legacyRepoKey == nil {
+		return err
+	}
+	defer Zero(legacyRepoKey)
+
+	repoUUIDs, err := h.dataAccess.ListCipherRepositoryUUIDs()
+	if err != nil {
+		return err
+	}
+	for _, repoUUID := range repoUUIDs {
+		repoKey, err := h.migrateLegacyRepositoryKey(
+			userUUID, repoUUID, derivedUserPwd)
+		if _, isNotFound := err.(*ErrNotFound); isNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		Zero(repoKey)
+		return nil
+	}
+	return nil
+}
+
+// ListRepositoriesForUser returns the repositories the user account holds a
+// key for, its legacy key included. It takes a TOTP code when the user
+// account is enrolled, see EnrollTOTP.
+func (h *Himitsu) ListRepositoriesForUser(userUUID, userPwd,
+	totpCode string) (repositories []*RepositoryInfo, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_LIST_REPOSITORIES,
+		userUUID, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			repositories = nil
+		}
+	}()
+
+	derivedUserPwd, err := h.authenticateUserAccount(
+		userUUID, userPwd, totpCode)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(derivedUserPwd)
+
+	if err := h.migrateLegacyRepositoryKeys(
+		userUUID, derivedUserPwd); err != nil {
+		return nil, err
+	}
+
+	repoUUIDs, err := h.dataAccess.ListRepositoryUUIDs(userUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	repositories = make([]*RepositoryInfo, 0, len(repoUUIDs))
+	for _, repoUUID := range repoUUIDs {
+		repoKey, err := h.unwrapRepositoryKey(
+			userUUID, repoUUID, derivedUserPwd)
+		if err != nil {
+			return nil, err
+		}
+
+		repository, err := h.loadRepository(repoUUID, repoKey)
+		Zero(repoKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := repository.findUserAccount(userUUID); err == nil {
+			repositories = append(repositories, &RepositoryInfo{
+				UUID:  repository.UUID,
+				Label: repository.Label})
+		}
+		Clear(repository)
+	}
+
+	return repositories, nil
+}
@@ -0,0 +1,187 @@
+package himitsu
+
+import (
+	"testing"
+)
+
+func TestInviteUserAccount(t *testing.T) {
+	assert, h, _, _, dataAccess, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	otherRepoUUID, bobUUID, err := h.CreateRepository(
+		"other", "bob", "bob password")
+	assert.Nil(err)
+
+	assert.Nil(h.InviteUserAccount(repoUUID, adminUUID, "password",
+		bobUUID, "bob", []string{RIGHT_READ_SECRET}))
+
+	// bob is no member until he accepts
+	_, err = h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	repositories, err := h.ListRepositoriesForUser(bobUUID, "bob password", "")
+	assert.Nil(err)
+	assert.Len(repositories, 1)
+
+	// and only he can accept
+	err = h.AcceptInvitation(repoUUID, bobUUID, "wrong password", "")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	err = h.AcceptInvitation(repoUUID, adminUUID, "password", "")
+	assert.IsType(&ErrUnknownInvitation{}, err)
+
+	assert.Nil(h.AcceptInvitation(repoUUID, bobUUID, "bob password", ""))
+	secret, err := h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.Nil(err)
+	assert.Equal([]byte("Hello World !"), secret)
+	err = h.WriteSecret(repoUUID, bobUUID, "bob password", "hello",
+		[]byte("Bye"), nil)
+	assert.IsType(&ErrUserAccountHasNoRight{}, err)
+
+	sealedKey, err := dataAccess.ReadSealedRepositoryKey(bobUUID, repoUUID)
+	assert.Nil(err)
+	assert.Nil(sealedKey)
+	repositories, err = h.ListRepositoriesForUser(bobUUID, "bob password", "")
+	assert.Nil(err)
+	assert.Len(repositories, 2)
+
+	err = h.AcceptInvitation(repoUUID, bobUUID, "bob password", "")
+	assert.IsType(&ErrUnknownInvitation{}, err)
+	err = h.InviteUserAccount(repoUUID, adminUUID, "password",
+		bobUUID, "bob", nil)
+	assert.NotNil(err)
+
+	// bob is no admin of the repository he was invited to
+	err = h.InviteUserAccount(repoUUID, bobUUID, "bob password",
+		"uuid-9", "carol", nil)
+	assert.IsType(&ErrUserAccountHasNoRight{}, err)
+	_, err = h.ReadSecret(otherRepoUUID, bobUUID, "bob password", "hello")
+	assert.Nil(err)
+}
+
+func TestInviteUserAccountWithoutKeyPair(t *testing.T) {
+	assert, h, _, _, dataAccess, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	_, bobUUID, err := h.CreateRepository("other", "bob", "bob password")
+	assert.Nil(err)
+	assert.Nil(dataAccess.DeleteKeyPair(bobUUID))
+
+	err = h.InviteUserAccount(repoUUID, adminUUID, "password",
+		bobUUID, "bob", nil)
+	assert.IsType(&ErrNoKeyPair{}, err)
+	assert.IsType(&ErrNotFound{}, ClassifyError(err))
+	err = h.AcceptInvitation(repoUUID, bobUUID, "bob password", "")
+	assert.IsType(&ErrUnknownInvitation{}, err)
+}
+
+func TestGrantRepositoryAccess(t *testing.T) {
+	assert, h, _, _, dataAccess, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	_, bobUUID, err := h.CreateRepository("other", "bob", "bob password")
+	assert.Nil(err)
+
+	// nothing is left behind when bob cannot accept
+	err = h.GrantRepositoryAccess(repoUUID, adminUUID, "password",
+		bobUUID, "wrong password", "", "bob", []string{RIGHT_READ_SECRET})
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	sealedKey, err := dataAccess.ReadSealedRepositoryKey(bobUUID, repoUUID)
+	assert.Nil(err)
+	assert.Nil(sealedKey)
+	err = h.AcceptInvitation(repoUUID, bobUUID, "bob password", "")
+	assert.IsType(&ErrUnknownInvitation{}, err)
+
+	assert.Nil(h.GrantRepositoryAccess(repoUUID, adminUUID, "password",
+		bobUUID, "bob password", "", "bob", []string{RIGHT_READ_SECRET}))
+	secret, err := h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.Nil(err)
+	assert.Equal([]byte("Hello World !"), secret)
+	repositories, err := h.ListRepositoriesForUser(bobUUID, "bob password", "")
+	assert.Nil(err)
+	assert.Len(repositories, 2)
+
+	err = h.GrantRepositoryAccess(repoUUID, adminUUID, "password",
+		bobUUID, "bob password", "", "bob", nil)
+	assert.NotNil(err)
+}
+
+func TestRevokeInvitation(t *testing.T) {
+	assert, h, _, _, dataAccess, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	_, bobUUID, err := h.CreateRepository("other", "bob", "bob password")
+	assert.Nil(err)
+
+	assert.Nil(h.InviteUserAccount(repoUUID, adminUUID, "password",
+		bobUUID, "bob", nil))
+	assert.Nil(h.RevokeInvitation(repoUUID, adminUUID, "password", bobUUID))
+
+	sealedKey, err := dataAccess.ReadSealedRepositoryKey(bobUUID, repoUUID)
+	assert.Nil(err)
+	assert.Nil(sealedKey)
+	err = h.AcceptInvitation(repoUUID, bobUUID, "bob password", "")
+	assert.IsType(&ErrUnknownInvitation{}, err)
+	err = h.RevokeInvitation(repoUUID, adminUUID, "password", bobUUID)
+	assert.IsType(&ErrUnknownInvitation{}, err)
+}
+
+func TestRotationReachesInvitedUserAccounts(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	_, bobUUID, err := h.CreateRepository("other", "bob", "bob password")
+	assert.Nil(err)
+
+	assert.Nil(h.InviteUserAccount(repoUUID, adminUUID, "password",
+		bobUUID, "bob", []string{RIGHT_READ_SECRET}))
+	assert.Nil(h.RotateRepositoryKey(repoUUID, adminUUID, "password"))
+
+	assert.Nil(h.AcceptInvitation(repoUUID, bobUUID, "bob password", ""))
+	_, err = h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.Nil(err)
+}
+
+func TestListRepositoriesForUserMigratesLegacyKey(t *testing.T) {
+	assert, h, _, _, dataAccess, teardown := setupHimitsu(t)
+	defer teardown()
+
+	_, _, err := h.CreateRepository("first", "admin", "password")
+	assert.Nil(err)
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+
+	// the key of the admin is stored in the single repository layout
+	cipherRepoKey, err := dataAccess.ReadCipherRepositoryKey(
+		adminUUID, repoUUID)
+	assert.Nil(err)
+	salt, err := dataAccess.ReadUserAccountSalt(adminUUID)
+	assert.Nil(err)
+	assert.Nil(dataAccess.DeleteCipherRepositoryKey(adminUUID, repoUUID))
+	assert.Nil(dataAccess.SaveUserAccountCredentials(
+		adminUUID, salt, nil, cipherRepoKey))
+
+	_, err = h.ListRepositoriesForUser(adminUUID, "wrong password", "")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+
+	repositories, err := h.ListRepositoriesForUser(adminUUID, "password", "")
+	assert.Nil(err)
+	assert.Len(repositories, 1)
+	assert.Equal(repoUUID, repositories[0].UUID)
+
+	legacyCipherRepoKey, err := dataAccess.ReadLegacyCipherRepositoryKey(
+		adminUUID)
+	assert.Nil(err)
+	assert.Nil(legacyCipherRepoKey)
+	repoUUIDs, err := dataAccess.ListRepositoryUUIDs(adminUUID)
+	assert.Nil(err)
+	assert.Equal([]string{repoUUID}, repoUUIDs)
+}
@@ -0,0 +1,240 @@
+package himitsu
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+)
+
+const (
+	AUDIT_OPERATION_READ_SECRET_METADATA string = "ReadSecretMetadata"
+)
+
+type Secret struct {
+	Versions    []*SecretVersion `json:"versions"`
+	CreatedAt   time.Time        `json:"created_at"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+	UpdatedBy   string           `json:"updated_by"`
+	Description string           `json:"description"`
+	Tags        []string         `json:"tags"`
+	ContentType string           `json:"content_type"`
+}
+
+// value returns the value of the current version of the secret, that is the
+// last one.
+func (s *Secret) value() []byte {
+	if len(s.Versions) == 0 {
+		return nil
+	}
+	return s.Versions[len(s.Versions)-1].Value
+}
+
+// WriteSecretOptions replaces the description, tags and content type of a
+// written secret. A nil *WriteSecretOptions keeps them as they are.
+// NotBefore and NotAfter only apply to the written version, zero values
+// leave the window open on that side.
+type WriteSecretOptions struct {
+	Description string
+	Tags        []string
+	ContentType string
+	NotBefore   time.Time
+	NotAfter    time.Time
+}
+
+type ErrInvalidValidityWindow struct {
+	secretName string
+}
+
+func (e *ErrInvalidValidityWindow) Error() string {
+	return fmt.Sprintf("Secret '%s' validity window ends before it starts",
+		e.secretName)
+}
+
+// check rejects a validity window whose end comes before its start.
+func (opts *WriteSecretOptions) check(secretName string) error {
+	if opts == nil || opts.NotBefore.IsZero() || opts.NotAfter.IsZero() {
+		return nil
+	}
+	if opts.NotAfter.Before(opts.NotBefore) {
+		return &ErrInvalidValidityWindow{secretName: secretName}
+	}
+	return nil
+}
+
+// SecretMetadata describes a secret without revealing its value.
+type SecretMetadata struct {
+	Name        string    `json:"name"`
+	Version     int       `json:"version"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	UpdatedBy   string    `json:"updated_by"`
+	Description string    `json:"description"`
+	Tags        []string  `json:"tags"`
+	ContentType string    `json:"content_type"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+}
+
+func (h *Himitsu) ReadSecretMetadata(repoUUID, userUUID, userPwd,
+	secretName string) (metadata *SecretMetadata, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_READ_SECRET_METADATA,
+		userUUID, repoUUID, secretName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			metadata = nil
+		}
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	return repository.ReadSecretMetadata(userUUID, secretName)
+}
+
+func (r *Repository) ReadSecretMetadata(
+	userUUID, secretName string) (*SecretMetadata, error) {
+
+	userAccount, err := r.findUserAccount(userUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.checkRight(
+		userAccount, RIGHT_READ_SECRET, secretName); err != nil {
+		return nil, err
+	}
+
+	secret, exists := r.Secrets[secretName]
+	if !exists {
+		return nil, &ErrUnknownSecret{secretName: secretName}
+	}
+
+	metadata := &SecretMetadata{
+		Name:        secretName,
+		CreatedAt:   secret.CreatedAt,
+		UpdatedAt:   secret.UpdatedAt,
+		UpdatedBy:   secret.UpdatedBy,
+		Description: secret.Description,
+		Tags:        append([]string{}, secret.Tags...),
+		ContentType: secret.ContentType}
+	if len(secret.Versions) > 0 {
+		secretVersion := secret.Versions[len(secret.Versions)-1]
+		metadata.Version = secretVersion.Version
+		metadata.NotBefore = secretVersion.NotBefore
+		metadata.NotAfter = secretVersion.NotAfter
+	}
+	return metadata, nil
+}
+
+// writeSecret adds a version to the secret, creating it if needed, and drops
+// the oldest versions beyond the maximum history depth.
+func (r *Repository) writeSecret(userUUID, secretName string,
+	secretValue []byte, opts *WriteSecretOptions) {
+
+	now := time.Now().UTC()
+
+	secret, exists := r.Secrets[secretName]
+	if !exists {
+		secret = &Secret{CreatedAt: now}
+		r.Secrets[secretName] = secret
+	}
+
+	version := 1
+	if len(secret.Versions) > 0 {
+		version = secret.Versions[len(secret.Versions)-1].Version + 1
+	}
+	secretVersion := &SecretVersion{Version: version, Value: secretValue}
+	if opts != nil {
+		secretVersion.NotBefore = opts.NotBefore
+		secretVersion.NotAfter = opts.NotAfter
+	}
+	secret.Versions = append(secret.Versions, secretVersion)
+
+	maxSecretVersions := r.maxSecretVersions
+	if maxSecretVersions <= 0 {
+		maxSecretVersions = DefaultMaxSecretVersions
+	}
+	for len(secret.Versions) > maxSecretVersions {
+		Zero(secret.Versions[0].Value)
+		secret.Versions = secret.Versions[1:]
+	}
+
+	secret.UpdatedAt = now
+	secret.UpdatedBy = userUUID
+	if opts != nil {
+		secret.Description = opts.Description
+		secret.Tags = append([]string{}, opts.Tags...)
+		secret.ContentType = opts.ContentType
+	}
+}
+
+// legacyRepository is the layout of repositories stored before secrets
+// carried metadata: a bare value per secret and, optionally, its history.
+type legacyRepository struct {
+	UUID           string
+	Label          string
+	UserAccounts   map[string]*UserAccount
+	Secrets        map[string][]byte
+	SecretVersions map[string][]*SecretVersion
+}
+
+func (lr *legacyRepository) migrate() *Repository {
+	repository := &Repository{
+		UUID:         lr.UUID,
+		Label:        lr.Label,
+		UserAccounts: lr.UserAccounts,
+		Secrets:      make(map[string]*Secret)}
+
+	for secretName, secretValue := range lr.Secrets {
+		secretVersions, exists := lr.SecretVersions[secretName]
+		if !exists {
+			secretVersions = []*SecretVersion{
+				{Version: 1, Value: secretValue}}
+		}
+		repository.Secrets[secretName] = &Secret{Versions: secretVersions}
+	}
+	return repository
+}
+
+// decodeRepository decodes a gob encoded repository, migrating it from the
+// legacy layout if needed.
+func decodeRepository(encodedRepo []byte) (*Repository, error) {
+	b := bytes.NewBuffer(encodedRepo)
+	defer b.Reset()
+	repository := &Repository{}
+
+	dec := gob.NewDecoder(b)
+	if err := dec.Decode(repository); err == nil {
+		repository.migratePolicies()
+		repository.compilePolicies()
+		return repository, nil
+	}
+
+	lb := bytes.NewBuffer(encodedRepo)
+	defer lb.Reset()
+	legacyRepo := &legacyRepository{}
+
+	ldec := gob.NewDecoder(lb)
+	if err := ldec.Decode(legacyRepo); err != nil {
+		return nil, err
+	}
+	defer Clear(legacyRepo)
+
+	repository = legacyRepo.migrate()
+	repository.migratePolicies()
+	repository.compilePolicies()
+	return repository, nil
+}
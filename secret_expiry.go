@@ -0,0 +1,81 @@
+package himitsu
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	AUDIT_OPERATION_LIST_EXPIRING_SECRETS string = "ListExpiringSecrets"
+)
+
+type ExpiringSecret struct {
+	Name     string    `json:"name"`
+	Version  int       `json:"version"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+type byNotAfter []*ExpiringSecret
+
+func (s byNotAfter) Len() int           { return len(s) }
+func (s byNotAfter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byNotAfter) Less(i, j int) bool { return s[i].NotAfter.Before(s[j].NotAfter) }
+
+// ListExpiringSecrets returns the secrets whose current version expires
+// within the given duration, already expired ones included, soonest first.
+func (h *Himitsu) ListExpiringSecrets(repoUUID, userUUID, userPwd string,
+	within time.Duration) (expiringSecrets []*ExpiringSecret, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_LIST_EXPIRING_SECRETS,
+		userUUID, repoUUID, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			expiringSecrets = nil
+		}
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	return repository.ListExpiringSecrets(userUUID, time.Now().Add(within))
+}
+
+func (r *Repository) ListExpiringSecrets(
+	userUUID string, deadline time.Time) ([]*ExpiringSecret, error) {
+
+	userAccount, err := r.findUserAccount(userUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	expiringSecrets := make([]*ExpiringSecret, 0)
+	for secretName, secret := range r.Secrets {
+		if len(secret.Versions) == 0 ||
+			!r.isAllowed(userAccount, CAPABILITY_LIST, secretName) {
+			continue
+		}
+		secretVersion := secret.Versions[len(secret.Versions)-1]
+		if secretVersion.NotAfter.IsZero() ||
+			secretVersion.NotAfter.After(deadline) {
+			continue
+		}
+		expiringSecrets = append(expiringSecrets, &ExpiringSecret{
+			Name:     secretName,
+			Version:  secretVersion.Version,
+			NotAfter: secretVersion.NotAfter})
+	}
+	sort.Sort(byNotAfter(expiringSecrets))
+
+	return expiringSecrets, nil
+}
@@ -0,0 +1,107 @@
+package himitsu
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+	Secret names are paths: '/' separates folders, as in db/prod/password.
+	Folders only exist through the secrets they hold.
+
+	The server routes the secret operations below the secret name, as in
+	db/prod/password/versions, so these segments cannot end a secret name.
+*/
+
+const (
+	SecretPathSeparator string = "/"
+)
+
+var reservedSecretNameSegments = map[string]bool{
+	"rename":   true,
+	"metadata": true,
+	"versions": true,
+	"rollback": true,
+}
+
+type ErrInvalidSecretName struct {
+	secretName string
+}
+
+func (e *ErrInvalidSecretName) Error() string {
+	return fmt.Sprintf("Invalid secret name '%s'", e.secretName)
+}
+
+// checkSecretPath rejects empty names, names with an empty segment, that is
+// a leading, trailing or doubled separator, and names with a "." or ".."
+// segment.
+func checkSecretPath(secretName string) error {
+	for _, segment := range strings.Split(secretName, SecretPathSeparator) {
+		if segment == "" || segment == "." || segment == ".." {
+			return &ErrInvalidSecretName{secretName: secretName}
+		}
+	}
+	return nil
+}
+
+// checkSecretName checks the path of a secret, whose last segment cannot be
+// reserved to the routes of the server.
+func checkSecretName(secretName string) error {
+	if err := checkSecretPath(secretName); err != nil {
+		return err
+	}
+
+	segments := strings.Split(secretName, SecretPathSeparator)
+	if reservedSecretNameSegments[segments[len(segments)-1]] {
+		return &ErrInvalidSecretName{secretName: secretName}
+	}
+	return nil
+}
+
+// normalizeSecretFolder turns a folder prefix into "" for the root folder or
+// a path ending with the separator.
+func normalizeSecretFolder(prefix string) string {
+	prefix = strings.Trim(prefix, SecretPathSeparator)
+	if prefix == "" {
+		return ""
+	}
+	return prefix + SecretPathSeparator
+}
+
+// listSecretPaths returns the sorted entries of the prefix folder. Entries
+// are full paths: secrets directly in the folder and, unless recursive, sub
+// folders ending with the separator. A recursive listing returns every
+// secret below the folder instead.
+func listSecretPaths(
+	secrets map[string]*Secret, prefix string, recursive bool) []string {
+
+	folder := normalizeSecretFolder(prefix)
+
+	entries := make(map[string]bool)
+	for secretName := range secrets {
+		if !strings.HasPrefix(secretName, folder) {
+			continue
+		}
+
+		if recursive {
+			entries[secretName] = true
+			continue
+		}
+
+		relativeName := secretName[len(folder):]
+		i := strings.Index(relativeName, SecretPathSeparator)
+		if i < 0 {
+			entries[secretName] = true
+		} else {
+			entries[folder+relativeName[:i+1]] = true
+		}
+	}
+
+	paths := make([]string, 0, len(entries))
+	for entry := range entries {
+		paths = append(paths, entry)
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,93 @@
+package himitsu
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCheckSecretName(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, secretName := range []string{"password", "db/prod/password",
+		"db/versions/password", "..password", "rollbacks"} {
+		assert.Nil(checkSecretName(secretName), secretName)
+	}
+
+	for _, secretName := range []string{"", "/password", "password/",
+		"db//password", ".", "..", "db/../password", "db/./password",
+		"password/..", "password/rename", "password/metadata",
+		"db/password/versions", "rollback"} {
+		assert.IsType(&ErrInvalidSecretName{}, checkSecretName(secretName),
+			secretName)
+	}
+}
+
+func TestWriteSecretRejectsInvalidNames(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+
+	err = h.WriteSecret(repoUUID, adminUUID, "password", "db/../hello",
+		[]byte("value"), nil)
+	assert.IsType(&ErrInvalidSecretName{}, err)
+	err = h.WriteSecret(repoUUID, adminUUID, "password", "hello/versions",
+		[]byte("value"), nil)
+	assert.IsType(&ErrInvalidSecretName{}, err)
+	err = h.RenameSecret(repoUUID, adminUUID, "password", "hello",
+		"hello/metadata")
+	assert.IsType(&ErrInvalidSecretName{}, err)
+
+	_, err = h.ReadSecret(repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+}
+
+func TestListSecretNames(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	for _, secretName := range []string{"db/password", "db/prod/password",
+		"db/prod/user", "dbx"} {
+		assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", secretName,
+			[]byte(secretName), nil))
+	}
+
+	listSecretNames := func(userUUID, userPwd, prefix string,
+		recursive bool) []string {
+
+		secretNames, err := h.ListSecretNames(
+			repoUUID, userUUID, userPwd, prefix, recursive)
+		assert.Nil(err)
+		return secretNames
+	}
+
+	assert.Equal([]string{"db/", "dbx", "hello"},
+		listSecretNames(adminUUID, "password", "", false))
+	assert.Equal([]string{"db/password", "db/prod/"},
+		listSecretNames(adminUUID, "password", "db", false))
+	assert.Equal([]string{"db/password", "db/prod/"},
+		listSecretNames(adminUUID, "password", "/db/", false))
+	assert.Equal([]string{"db/password", "db/prod/password", "db/prod/user"},
+		listSecretNames(adminUUID, "password", "db", true))
+	assert.Equal([]string{"db/password", "db/prod/password", "db/prod/user",
+		"dbx", "hello"}, listSecretNames(adminUUID, "password", "", true))
+	assert.Len(listSecretNames(adminUUID, "password", "unknown", true), 0)
+
+	// only the listable secrets show, folders included
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{})
+	assert.Nil(err)
+	assert.Nil(h.SetPolicy(repoUUID, adminUUID, "password", &Policy{
+		Name: "prod",
+		Rules: []*PolicyRule{{Effect: POLICY_EFFECT_ALLOW, Path: "db/prod/*",
+			Capabilities: []string{CAPABILITY_LIST}}}}))
+	assert.Nil(h.SetUserAccountPolicies(repoUUID, adminUUID, "password",
+		bobUUID, []string{"prod"}))
+	assert.Equal([]string{"db/"},
+		listSecretNames(bobUUID, "bob password", "", false))
+	assert.Equal([]string{"db/prod/password", "db/prod/user"},
+		listSecretNames(bobUUID, "bob password", "", true))
+}
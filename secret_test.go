@@ -0,0 +1,175 @@
+package himitsu
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestWriteSecretRejectsInvertedValidityWindow(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+
+	now := time.Now().UTC()
+	err = h.WriteSecret(repoUUID, adminUUID, "password", "hello",
+		[]byte("Bye"), &WriteSecretOptions{
+			NotBefore: now.Add(time.Hour), NotAfter: now})
+	assert.IsType(&ErrInvalidValidityWindow{}, err)
+	secret, err := h.ReadSecret(repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+	assert.Equal([]byte("Hello World !"), secret)
+
+	// either side may stay open
+	assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", "hello",
+		[]byte("Bye"), &WriteSecretOptions{NotAfter: now.Add(time.Hour)}))
+	assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", "hello",
+		[]byte("Bye"), &WriteSecretOptions{NotBefore: now.Add(-time.Hour)}))
+	assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", "hello",
+		[]byte("Bye"), &WriteSecretOptions{
+			NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour)}))
+}
+
+func TestSecretMetadata(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	created, err := h.ReadSecretMetadata(
+		repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+	assert.Equal(1, created.Version)
+	assert.Equal(adminUUID, created.UpdatedBy)
+
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{RIGHT_READ_SECRET, RIGHT_WRITE_SECRET})
+	assert.Nil(err)
+	assert.Nil(h.WriteSecret(repoUUID, bobUUID, "bob password", "hello",
+		[]byte("Bye"), &WriteSecretOptions{Description: "greeting",
+			Tags: []string{"demo"}, ContentType: "text/plain"}))
+
+	metadata, err := h.ReadSecretMetadata(
+		repoUUID, bobUUID, "bob password", "hello")
+	assert.Nil(err)
+	assert.Equal("hello", metadata.Name)
+	assert.Equal(2, metadata.Version)
+	assert.Equal(created.CreatedAt, metadata.CreatedAt)
+	assert.False(metadata.UpdatedAt.Before(created.UpdatedAt))
+	assert.Equal(bobUUID, metadata.UpdatedBy)
+	assert.Equal("greeting", metadata.Description)
+	assert.Equal([]string{"demo"}, metadata.Tags)
+	assert.Equal("text/plain", metadata.ContentType)
+
+	// nil options keep the metadata, empty ones clear it
+	assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", "hello",
+		[]byte("Hi"), nil))
+	metadata, err = h.ReadSecretMetadata(
+		repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+	assert.Equal(adminUUID, metadata.UpdatedBy)
+	assert.Equal("greeting", metadata.Description)
+	assert.Equal([]string{"demo"}, metadata.Tags)
+
+	assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", "hello",
+		[]byte("Hi"), &WriteSecretOptions{}))
+	metadata, err = h.ReadSecretMetadata(
+		repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+	assert.Equal("", metadata.Description)
+	assert.Len(metadata.Tags, 0)
+
+	_, err = h.ReadSecretMetadata(repoUUID, adminUUID, "password", "unknown")
+	assert.IsType(&ErrUnknownSecret{}, err)
+}
+
+func TestMigrateLegacyRepository(t *testing.T) {
+	assert := assert.New(t)
+
+	// repositories stored before metadata had bare values per secret
+	var encodedRepo bytes.Buffer
+	assert.Nil(gob.NewEncoder(&encodedRepo).Encode(&legacyRepository{
+		UUID:  "repo",
+		Label: "legacy",
+		UserAccounts: map[string]*UserAccount{
+			"admin": {UUID: "admin", CanReadSecret: true}},
+		Secrets: map[string][]byte{
+			"bare":      []byte("bare value"),
+			"versioned": []byte("second value")},
+		SecretVersions: map[string][]*SecretVersion{
+			"versioned": {
+				{Version: 1, Value: []byte("first value")},
+				{Version: 2, Value: []byte("second value")}}}}))
+
+	repository, err := decodeRepository(encodedRepo.Bytes())
+	assert.Nil(err)
+	assert.Equal("repo", repository.UUID)
+	assert.Equal("legacy", repository.Label)
+	assert.Len(repository.Secrets, 2)
+
+	bare := repository.Secrets["bare"]
+	assert.Len(bare.Versions, 1)
+	assert.Equal(1, bare.Versions[0].Version)
+	assert.Equal([]byte("bare value"), bare.value())
+
+	versioned := repository.Secrets["versioned"]
+	assert.Len(versioned.Versions, 2)
+	assert.Equal([]byte("first value"), versioned.Versions[0].Value)
+	assert.Equal([]byte("second value"), versioned.value())
+
+	// the migrated user accounts keep their rights
+	secret, err := repository.ReadSecret("admin", "bare")
+	assert.Nil(err)
+	assert.Equal([]byte("bare value"), secret)
+}
+
+func TestSecretValidityWindow(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+
+	now := time.Now().UTC()
+	assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", "expired",
+		[]byte("old"), &WriteSecretOptions{NotAfter: now.Add(-time.Hour)}))
+	assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", "future",
+		[]byte("new"), &WriteSecretOptions{NotBefore: now.Add(time.Hour)}))
+	assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", "soon",
+		[]byte("soon"), &WriteSecretOptions{NotAfter: now.Add(time.Hour)}))
+	assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", "later",
+		[]byte("later"), &WriteSecretOptions{NotAfter: now.Add(48 * time.Hour)}))
+
+	for _, secretName := range []string{"expired", "future"} {
+		_, err = h.ReadSecret(repoUUID, adminUUID, "password", secretName)
+		assert.IsType(&ErrSecretOutsideValidity{}, err, secretName)
+	}
+	secret, err := h.ReadSecret(repoUUID, adminUUID, "password", "soon")
+	assert.Nil(err)
+	assert.Equal([]byte("soon"), secret)
+
+	// the window only applies to the written version
+	assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", "expired",
+		[]byte("renewed"), nil))
+	secret, err = h.ReadSecret(repoUUID, adminUUID, "password", "expired")
+	assert.Nil(err)
+	assert.Equal([]byte("renewed"), secret)
+	_, err = h.ReadSecretVersion(repoUUID, adminUUID, "password", "expired", 1)
+	assert.IsType(&ErrSecretOutsideValidity{}, err)
+
+	assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", "gone",
+		[]byte("gone"), &WriteSecretOptions{NotAfter: now.Add(-time.Minute)}))
+	expiringSecrets, err := h.ListExpiringSecrets(
+		repoUUID, adminUUID, "password", 24*time.Hour)
+	assert.Nil(err)
+	names := make([]string, 0, len(expiringSecrets))
+	for _, expiringSecret := range expiringSecrets {
+		names = append(names, expiringSecret.Name)
+	}
+	assert.Equal([]string{"gone", "soon"}, names)
+	assert.Equal(1, expiringSecrets[1].Version)
+}
@@ -0,0 +1,237 @@
+package himitsu
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultMaxSecretVersions int = 10
+
+	AUDIT_OPERATION_READ_SECRET_VERSION  string = "ReadSecretVersion"
+	AUDIT_OPERATION_ROLLBACK_SECRET      string = "RollbackSecret"
+	AUDIT_OPERATION_LIST_SECRET_VERSIONS string = "ListSecretVersions"
+)
+
+// SecretVersion is a value of a secret. A non zero NotBefore or NotAfter
+// restricts the window in which the value can be read.
+type SecretVersion struct {
+	Version   int       `json:"version"`
+	Value     []byte    `json:"value"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+type ErrSecretOutsideValidity struct {
+	secretName string
+	version    int
+}
+
+func (e *ErrSecretOutsideValidity) Error() string {
+	return fmt.Sprintf("Secret '%s' version %d is outside its validity window",
+		e.secretName, e.version)
+}
+
+func (sv *SecretVersion) checkValidity(secretName string, now time.Time) error {
+	if (!sv.NotBefore.IsZero() && now.Before(sv.NotBefore)) ||
+		(!sv.NotAfter.IsZero() && now.After(sv.NotAfter)) {
+		return &ErrSecretOutsideValidity{
+			secretName: secretName, version: sv.Version}
+	}
+	return nil
+}
+
+type ErrUnknownSecretVersion struct {
+	secretName string
+	version    int
+}
+
+func (e *ErrUnknownSecretVersion) Error() string {
+	return fmt.Sprintf("Secret '%s' has no version %d",
+		e.secretName, e.version)
+}
+
+func (h *Himitsu) ReadSecretVersion(repoUUID, userUUID, userPwd,
+	secretName string, version int) (secretValue []byte, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_READ_SECRET_VERSION,
+		userUUID, repoUUID, secretName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			secretValue = nil
+		}
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	return repository.ReadSecretVersion(userUUID, secretName, version)
+}
+
+func (h *Himitsu) ListSecretVersions(repoUUID, userUUID, userPwd,
+	secretName string) (versions []int, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_LIST_SECRET_VERSIONS,
+		userUUID, repoUUID, secretName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			versions = nil
+		}
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	return repository.ListSecretVersions(userUUID, secretName)
+}
+
+// RollbackSecret writes the value of a previous version of the secret as a
+// new version, so the history is kept.
+func (h *Himitsu) RollbackSecret(repoUUID, userUUID, userPwd,
+	secretName string, version int) (err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_ROLLBACK_SECRET,
+		userUUID, repoUUID, secretName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if err := repository.RollbackSecret(
+		userUUID, secretName, version); err != nil {
+		return err
+	}
+
+	return record.saveRepository(repository, repoKey)
+}
+
+func (r *Repository) findSecretVersion(
+	secretName string, version int) (*SecretVersion, error) {
+
+	secret, exists := r.Secrets[secretName]
+	if !exists {
+		return nil, &ErrUnknownSecret{secretName: secretName}
+	}
+
+	for _, secretVersion := range secret.Versions {
+		if secretVersion.Version == version {
+			return secretVersion, nil
+		}
+	}
+	return nil, &ErrUnknownSecretVersion{
+		secretName: secretName, version: version}
+}
+
+func (r *Repository) ReadSecretVersion(
+	userUUID, secretName string, version int) ([]byte, error) {
+
+	userAccount, err := r.findUserAccount(userUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.checkRight(
+		userAccount, RIGHT_READ_SECRET, secretName); err != nil {
+		return nil, err
+	}
+
+	secretVersion, err := r.findSecretVersion(secretName, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := secretVersion.checkValidity(
+		secretName, time.Now()); err != nil {
+		return nil, err
+	}
+	return secretVersion.Value, nil
+}
+
+func (r *Repository) ListSecretVersions(
+	userUUID, secretName string) ([]int, error) {
+
+	userAccount, err := r.findUserAccount(userUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.checkRight(
+		userAccount, RIGHT_READ_SECRET, secretName); err != nil {
+		return nil, err
+	}
+
+	secret, exists := r.Secrets[secretName]
+	if !exists {
+		return nil, &ErrUnknownSecret{secretName: secretName}
+	}
+
+	versions := make([]int, 0, len(secret.Versions))
+	for _, secretVersion := range secret.Versions {
+		versions = append(versions, secretVersion.Version)
+	}
+	return versions, nil
+}
+
+func (r *Repository) RollbackSecret(
+	userUUID, secretName string, version int) error {
+
+	userAccount, err := r.findUserAccount(userUUID)
+	if err != nil {
+		return err
+	}
+
+	if err := r.checkRight(
+		userAccount, RIGHT_WRITE_SECRET, secretName); err != nil {
+		return err
+	}
+
+	secretVersion, err := r.findSecretVersion(secretName, version)
+	if err != nil {
+		return err
+	}
+
+	secretValue := make([]byte, len(secretVersion.Value))
+	copy(secretValue, secretVersion.Value)
+	r.writeSecret(userUUID, secretName, secretValue, nil)
+
+	secret := r.Secrets[secretName]
+	rolledBackVersion := secret.Versions[len(secret.Versions)-1]
+	rolledBackVersion.NotBefore = secretVersion.NotBefore
+	rolledBackVersion.NotAfter = secretVersion.NotAfter
+
+	return nil
+}
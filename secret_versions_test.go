@@ -0,0 +1,57 @@
+package himitsu
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSecretVersionDepthAndRollback(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+	h.SetMaxSecretVersions(3)
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	for version := 2; version <= 5; version++ {
+		assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", "hello",
+			[]byte(fmt.Sprintf("value %d", version)), nil))
+	}
+
+	// only the last versions are kept
+	versions, err := h.ListSecretVersions(
+		repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+	assert.Equal([]int{3, 4, 5}, versions)
+	_, err = h.ReadSecretVersion(repoUUID, adminUUID, "password", "hello", 2)
+	assert.IsType(&ErrUnknownSecretVersion{}, err)
+	assert.IsType(&ErrNotFound{}, ClassifyError(err))
+
+	secret, err := h.ReadSecretVersion(
+		repoUUID, adminUUID, "password", "hello", 3)
+	assert.Nil(err)
+	assert.Equal([]byte("value 3"), secret)
+
+	// a rollback adds the old value as a new version
+	assert.Nil(h.RollbackSecret(repoUUID, adminUUID, "password", "hello", 3))
+	secret, err = h.ReadSecret(repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+	assert.Equal([]byte("value 3"), secret)
+	versions, err = h.ListSecretVersions(
+		repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+	assert.Equal([]int{4, 5, 6}, versions)
+
+	err = h.RollbackSecret(repoUUID, adminUUID, "password", "hello", 3)
+	assert.IsType(&ErrUnknownSecretVersion{}, err)
+
+	// reading older versions takes the read right, rolling back the write one
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{RIGHT_READ_SECRET})
+	assert.Nil(err)
+	secret, err = h.ReadSecretVersion(
+		repoUUID, bobUUID, "bob password", "hello", 4)
+	assert.Nil(err)
+	assert.Equal([]byte("value 4"), secret)
+	err = h.RollbackSecret(repoUUID, bobUUID, "bob password", "hello", 4)
+	assert.IsType(&ErrUserAccountHasNoRight{}, err)
+}
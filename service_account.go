@@ -0,0 +1,430 @@
+package himitsu
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/pagedegeek/himitsu/data_access"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	Service accounts are user accounts for machines. They have no password:
+	they authenticate with API keys, passed as userPwd, which an admin
+	creates for them.
+
+	An API key is a random secret, long enough not to need the password
+	derivation: the repository key is wrapped under a plain HMAC of it. The
+	wrapped key is stored as the key of a user account would be, with the
+	API key ID in place of the user account UUID, along with a key pair, so
+	that key rotations reach it as well, see RotateRepositoryKey.
+
+	The scope and expiry of an API key are kept in the repository, so that
+	they cannot be changed without the repository key. An API key never
+	grants more than the rights of its service account: it may restrict them
+	to reading, and to the secrets below a path prefix, and never allows
+	administering user accounts.
+*/
+
+const (
+	AUDIT_OPERATION_CREATE_API_KEY string = "CreateAPIKey"
+	AUDIT_OPERATION_REVOKE_API_KEY string = "RevokeAPIKey"
+	AUDIT_OPERATION_LIST_API_KEYS  string = "ListAPIKeys"
+)
+
+const apiKeyPrefix = "hmk"
+
+type APIKey struct {
+	ID                 string    `json:"id"`
+	ServiceAccountUUID string    `json:"service_account_uuid"`
+	Label              string    `json:"label"`
+	ReadOnly           bool      `json:"read_only"`
+	PathPrefix         string    `json:"path_prefix,omitempty"`
+	CreatedAt          time.Time `json:"created_at"`
+	ExpiresAt          time.Time `json:"expires_at"`
+}
+
+type ErrInvalidAPIKey struct {
+	reason string
+}
+
+func (e *ErrInvalidAPIKey) Error() string {
+	return fmt.Sprintf("Invalid API key: %s", e.reason)
+}
+
+type ErrUnknownAPIKey struct {
+	apiKeyID string
+}
+
+func (e *ErrUnknownAPIKey) Error() string {
+	return fmt.Sprintf("API key '%s' not found", e.apiKeyID)
+}
+
+type ErrNotServiceAccount struct {
+	userUUID string
+}
+
+func (e *ErrNotServiceAccount) Error() string {
+	return fmt.Sprintf("UserAccount '%s' is not a service account", e.userUUID)
+}
+
+type ErrServiceAccountAdmin struct {
+	userUUID string
+}
+
+func (e *ErrServiceAccountAdmin) Error() string {
+	return fmt.Sprintf(
+		"Service account '%s' cannot administer user accounts", e.userUUID)
+}
+
+func formatAPIKey(apiKeyID string, secret []byte) string {
+	return apiKeyPrefix + "_" + apiKeyID + "_" +
+		base64.RawURLEncoding.EncodeToString(secret)
+}
+
+// parseAPIKey splits an API key into its ID and secret, ok being false when
+// userPwd is not an API key.
+func parseAPIKey(userPwd string) (apiKeyID string, secret []byte, ok bool) {
+	parts := strings.SplitN(userPwd, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyPrefix || parts[1] == "" {
+		return "", nil, false
+	}
+
+	secret, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(secret) == 0 {
+		return "", nil, false
+	}
+	return parts[1], secret, true
+}
+
+func deriveAPIKeySecret(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("himitsu API key"))
+	return mac.Sum(nil)
+}
+
+// allows tells whether the scope of the API key covers the capability on
+// the secret.
+func (ak *APIKey) allows(capability, secretName string) bool {
+	if ak.ReadOnly &&
+		capability != CAPABILITY_READ && capability != CAPABILITY_LIST {
+		return false
+	}
+
+	if ak.PathPrefix == "" {
+		return true
+	}
+	return secretName == ak.PathPrefix ||
+		strings.HasPrefix(secretName, normalizeSecretFolder(ak.PathPrefix))
+}
+
+// useAPIKey restricts the repository to the scope of the API key it was
+// opened with, after checking the key is live and belongs to the user
+// account.
+func (r *Repository) useAPIKey(userUUID, apiKeyID string) error {
+	apiKey, exists := r.APIKeys[apiKeyID]
+	if !exists || apiKey.ServiceAccountUUID != userUUID ||
+		!time.Now().Before(apiKey.ExpiresAt) {
+		return &ErrInvalidCredentials{userUUID: userUUID}
+	}
+
+	r.apiKey = apiKey
+	return nil
+}
+
+func (r *Repository) findServiceAccount(
+	userUUID string) (*UserAccount, error) {
+
+	userAccount, err := r.findUserAccount(userUUID)
+	if err != nil {
+		return nil, err
+	}
+	if !userAccount.ServiceAccount {
+		return nil, &ErrNotServiceAccount{userUUID: userUUID}
+	}
+	return userAccount, nil
+}
+
+func (r *Repository) AddAPIKey(userUUID string, apiKey *APIKey) error {
+	if err := r.checkAdminRight(userUUID); err != nil {
+		return err
+	}
+
+	if _, err := r.findServiceAccount(apiKey.ServiceAccountUUID); err != nil {
+		return err
+	}
+
+	if !apiKey.ExpiresAt.After(apiKey.CreatedAt) {
+		return &ErrInvalidAPIKey{reason: "expiry must be in the future"}
+	}
+
+	apiKey.PathPrefix = strings.Trim(apiKey.PathPrefix, SecretPathSeparator)
+	if apiKey.PathPrefix != "" {
+		if err := checkSecretPath(apiKey.PathPrefix); err != nil {
+			return &ErrInvalidAPIKey{reason: "invalid path prefix"}
+		}
+	}
+
+	if r.APIKeys == nil {
+		r.APIKeys = make(map[string]*APIKey)
+	}
+	r.APIKeys[apiKey.ID] = apiKey
+
+	return nil
+}
+
+func (r *Repository) RemoveAPIKey(userUUID, apiKeyID string) error {
+	if err := r.checkAdminRight(userUUID); err != nil {
+		return err
+	}
+
+	if _, exists := r.APIKeys[apiKeyID]; !exists {
+		return &ErrUnknownAPIKey{apiKeyID: apiKeyID}
+	}
+	delete(r.APIKeys, apiKeyID)
+
+	return nil
+}
+
+func (r *Repository) ListAPIKeys(userUUID string) ([]*APIKey, error) {
+	if err := r.checkAdminRight(userUUID); err != nil {
+		return nil, err
+	}
+
+	apiKeys := make([]*APIKey, 0, len(r.APIKeys))
+	for _, apiKey := range r.APIKeys {
+		apiKeyCopy := *apiKey
+		apiKeys = append(apiKeys, &apiKeyCopy)
+	}
+	sort.Sort(byAPIKeyCreatedAt(apiKeys))
+	return apiKeys, nil
+}
+
+// serviceAccountAPIKeyIDs returns the IDs of the API keys of the user
+// account.
+func (r *Repository) serviceAccountAPIKeyIDs(userUUID string) []string {
+	apiKeyIDs := make([]string, 0)
+	for apiKeyID, apiKey := range r.APIKeys {
+		if apiKey.ServiceAccountUUID == userUUID {
+			apiKeyIDs = append(apiKeyIDs, apiKeyID)
+		}
+	}
+	return apiKeyIDs
+}
+
+type byAPIKeyCreatedAt []*APIKey
+
+func (s byAPIKeyCreatedAt) Len() int      { return len(s) }
+func (s byAPIKeyCreatedAt) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byAPIKeyCreatedAt) Less(i, j int) bool {
+	if s[i].CreatedAt.Equal(s[j].CreatedAt) {
+		return s[i].ID < s[j].ID
+	}
+	return s[i].CreatedAt.Before(s[j].CreatedAt)
+}
+
+// loadRepositoryKeyWithAPIKey unwraps the repository key with the API key.
+// A revoked API key, or one of another repository, has no wrapped key and
+// gives ErrInvalidCredentials.
+func (h *Himitsu) loadRepositoryKeyWithAPIKey(userUUID, repoUUID,
+	apiKeyID string, secret []byte) ([]byte, error) {
+
+	cipherRepoKey, err := h.dataAccess.ReadCipherRepositoryKey(
+		apiKeyID, repoUUID)
+	_, isNotFound := err.(*data_access.ErrRepositoryKeyNotFound)
+	if isNotFound || (err == nil && cipherRepoKey == nil) {
+		return nil, &ErrInvalidCredentials{userUUID: userUUID}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	derivedSecret := deriveAPIKeySecret(secret)
+	defer Zero(derivedSecret)
+
+	repoKey, err := h.cryptoEngine.Decrypt(cipherRepoKey, derivedSecret)
+	if err != nil {
+		return nil, unwrapError(userUUID, err)
+	}
+
+	return h.completePendingRepositoryKeys(
+		apiKeyID, repoUUID, repoKey, derivedSecret)
+}
+
+// AddServiceAccount adds a user account without password to the repository.
+// It authenticates with the API keys created for it, see CreateAPIKey.
+func (h *Himitsu) AddServiceAccount(repoUUID, userUUID, userPwd,
+	label string, rights []string) (serviceAccountUUID string, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_ADD_USER_ACCOUNT,
+		userUUID, repoUUID, serviceAccountUUID)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			serviceAccountUUID = ""
+		}
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return "", err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	serviceAccount := &UserAccount{
+		UUID:           h.uuidGenerator.Call(),
+		Label:          label,
+		ServiceAccount: true}
+
+	if err := repository.AddUserAccount(
+		userUUID, serviceAccount, rights); err != nil {
+		return "", err
+	}
+
+	if err := record.saveRepository(repository, repoKey); err != nil {
+		return "", err
+	}
+
+	return serviceAccount.UUID, nil
+}
+
+// CreateAPIKey creates an API key for the service account, scoped as
+// apiKey tells. It returns the API key itself, which is not kept and
+// cannot be shown again.
+func (h *Himitsu) CreateAPIKey(repoUUID, userUUID, userPwd string,
+	apiKey *APIKey) (key string, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_CREATE_API_KEY,
+		userUUID, repoUUID, "")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			key = ""
+		}
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return "", err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	apiKey.ID = h.uuidGenerator.Call()
+	apiKey.CreatedAt = time.Now().UTC()
+	if err := repository.AddAPIKey(userUUID, apiKey); err != nil {
+		return "", err
+	}
+
+	secret, err := h.saltGenerator.Call(32)
+	if err != nil {
+		return "", err
+	}
+	defer Zero(secret)
+
+	derivedSecret := deriveAPIKeySecret(secret)
+	defer Zero(derivedSecret)
+
+	cipherRepoKey, err := h.wrapRepositoryKey(repoKey, derivedSecret)
+	if err != nil {
+		return "", err
+	}
+
+	batch := h.dataAccess.NewBatch()
+	batch.SaveCipherRepositoryKey(apiKey.ID, repoUUID, cipherRepoKey)
+	if err := h.batchSaveNewKeyPair(
+		batch, apiKey.ID, derivedSecret); err != nil {
+		return "", err
+	}
+	if err := h.batchSaveRepository(batch, repository, repoKey); err != nil {
+		return "", err
+	}
+
+	if err := record.commit(batch); err != nil {
+		return "", err
+	}
+
+	return formatAPIKey(apiKey.ID, secret), nil
+}
+
+// RevokeAPIKey removes the API key from the repository, which is enough to
+// refuse it, then its wrapped repository key and key pair.
+func (h *Himitsu) RevokeAPIKey(
+	repoUUID, userUUID, userPwd, apiKeyID string) (err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_REVOKE_API_KEY,
+		userUUID, repoUUID, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if err := repository.RemoveAPIKey(userUUID, apiKeyID); err != nil {
+		return err
+	}
+
+	batch := h.dataAccess.NewBatch()
+	if err := h.batchSaveRepository(batch, repository, repoKey); err != nil {
+		return err
+	}
+	batch.DeleteCipherRepositoryKey(apiKeyID, repoUUID)
+	batch.DeleteKeyPair(apiKeyID)
+
+	return record.commit(batch)
+}
+
+func (h *Himitsu) ListAPIKeys(repoUUID, userUUID, userPwd string) (
+	apiKeys []*APIKey, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_LIST_API_KEYS,
+		userUUID, repoUUID, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			apiKeys = nil
+		}
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	return repository.ListAPIKeys(userUUID)
+}
@@ -0,0 +1,115 @@
+package himitsu
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAPIKeyScope(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	assert.Nil(h.WriteSecret(repoUUID, adminUUID, "password", "ci/token",
+		[]byte("t0k3n"), nil))
+	ciUUID, err := h.AddServiceAccount(repoUUID, adminUUID, "password", "ci",
+		[]string{RIGHT_READ_SECRET, RIGHT_WRITE_SECRET})
+	assert.Nil(err)
+
+	_, err = h.AddServiceAccount(repoUUID, adminUUID, "password", "root",
+		[]string{RIGHT_ADMIN_USER_ACCOUNTS})
+	assert.IsType(&ErrServiceAccountAdmin{}, err)
+	_, err = h.CreateAPIKey(repoUUID, adminUUID, "password",
+		&APIKey{ServiceAccountUUID: adminUUID,
+			ExpiresAt: time.Now().Add(time.Hour)})
+	assert.IsType(&ErrNotServiceAccount{}, err)
+	_, err = h.CreateAPIKey(repoUUID, adminUUID, "password",
+		&APIKey{ServiceAccountUUID: ciUUID,
+			ExpiresAt: time.Now().Add(-time.Hour)})
+	assert.IsType(&ErrInvalidAPIKey{}, err)
+
+	fullKey, err := h.CreateAPIKey(repoUUID, adminUUID, "password",
+		&APIKey{ServiceAccountUUID: ciUUID, Label: "full",
+			ExpiresAt: time.Now().Add(time.Hour)})
+	assert.Nil(err)
+	readOnlyKey, err := h.CreateAPIKey(repoUUID, adminUUID, "password",
+		&APIKey{ServiceAccountUUID: ciUUID, Label: "read only",
+			ReadOnly: true, ExpiresAt: time.Now().Add(time.Hour)})
+	assert.Nil(err)
+	prefixKey, err := h.CreateAPIKey(repoUUID, adminUUID, "password",
+		&APIKey{ServiceAccountUUID: ciUUID, Label: "ci",
+			PathPrefix: "/ci/", ExpiresAt: time.Now().Add(time.Hour)})
+	assert.Nil(err)
+
+	// the key grants the rights of its service account, within its scope
+	assert.Nil(h.WriteSecret(repoUUID, ciUUID, fullKey, "hello",
+		[]byte("Bye"), nil))
+	secret, err := h.ReadSecret(repoUUID, ciUUID, readOnlyKey, "hello")
+	assert.Nil(err)
+	assert.Equal([]byte("Bye"), secret)
+	err = h.WriteSecret(repoUUID, ciUUID, readOnlyKey, "hello",
+		[]byte("Hi"), nil)
+	assert.IsType(&ErrUserAccountHasNoRight{}, err)
+
+	assert.Nil(h.WriteSecret(repoUUID, ciUUID, prefixKey, "ci/token",
+		[]byte("n3w t0k3n"), nil))
+	_, err = h.ReadSecret(repoUUID, ciUUID, prefixKey, "hello")
+	assert.IsType(&ErrUserAccountHasNoRight{}, err)
+	_, err = h.ReadSecret(repoUUID, ciUUID, prefixKey, "cicd")
+	assert.IsType(&ErrUserAccountHasNoRight{}, err)
+
+	// a key is bound to its service account, which has no password
+	_, err = h.ReadSecret(repoUUID, adminUUID, fullKey, "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	_, err = h.ReadSecret(repoUUID, ciUUID, "password", "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	_, err = h.ListUserAccounts(repoUUID, ciUUID, fullKey)
+	assert.IsType(&ErrForbidden{}, ClassifyError(err))
+
+	apiKeys, err := h.ListAPIKeys(repoUUID, adminUUID, "password")
+	assert.Nil(err)
+	assert.Len(apiKeys, 3)
+	for _, apiKey := range apiKeys {
+		if apiKey.Label == "ci" {
+			assert.Equal("ci", apiKey.PathPrefix)
+		}
+	}
+}
+
+func TestAPIKeyExpiryAndRevocation(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	ciUUID, err := h.AddServiceAccount(repoUUID, adminUUID, "password", "ci",
+		[]string{RIGHT_READ_SECRET})
+	assert.Nil(err)
+
+	shortKey, err := h.CreateAPIKey(repoUUID, adminUUID, "password",
+		&APIKey{ServiceAccountUUID: ciUUID,
+			ExpiresAt: time.Now().Add(100 * time.Millisecond)})
+	assert.Nil(err)
+	apiKey := &APIKey{ServiceAccountUUID: ciUUID,
+		ExpiresAt: time.Now().Add(time.Hour)}
+	key, err := h.CreateAPIKey(repoUUID, adminUUID, "password", apiKey)
+	assert.Nil(err)
+
+	_, err = h.ReadSecret(repoUUID, ciUUID, shortKey, "hello")
+	assert.Nil(err)
+	time.Sleep(150 * time.Millisecond)
+	_, err = h.ReadSecret(repoUUID, ciUUID, shortKey, "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+
+	// key rotations reach the API keys
+	assert.Nil(h.RotateRepositoryKey(repoUUID, adminUUID, "password"))
+	_, err = h.ReadSecret(repoUUID, ciUUID, key, "hello")
+	assert.Nil(err)
+
+	assert.Nil(h.RevokeAPIKey(repoUUID, adminUUID, "password", apiKey.ID))
+	_, err = h.ReadSecret(repoUUID, ciUUID, key, "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	err = h.RevokeAPIKey(repoUUID, adminUUID, "password", apiKey.ID)
+	assert.IsType(&ErrUnknownAPIKey{}, err)
+}
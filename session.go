@@ -0,0 +1,336 @@
+package himitsu
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	A session holds the repository key of a user account, unwrapped once at
+	Login, so that later operations skip the password derivation. Its
+	token stands for the password of the user account in the repository it
+	was opened on: passed as userPwd, it opens the repository with the
+	session key, see loadRepositoryKey. Anything else that needs the
+	password, such as ChangeUserPassword, still requires it, along with a
+	TOTP code for a user account enrolled to TOTP, for which sessions are
+	the way into its repositories, see EnrollTOTP.
+
+	Sessions only live in memory, the keys in protected buffers, see
+	allocateProtected. Only a hash of the token is kept. Sessions are
+	dropped when they expire, are revoked, or their key becomes stale:
+	rotating the repository key revokes the sessions of the repository,
+	changing a password or removing a user account the sessions of the user
+	account.
+*/
+
+// DefaultSessionTTL is how long a session lasts unless set otherwise, see
+// SetSessionTTL.
+const DefaultSessionTTL = 15 * time.Minute
+
+const (
+	AUDIT_OPERATION_LOGIN          string = "Login"
+	AUDIT_OPERATION_REVOKE_SESSION string = "RevokeSession"
+	AUDIT_OPERATION_LIST_SESSIONS  string = "ListSessions"
+)
+
+type SessionInfo struct {
+	ID             string    `json:"id"`
+	UserUUID       string    `json:"user_uuid"`
+	RepositoryUUID string    `json:"repository_uuid"`
+	CreatedAt      time.Time `json:"created_at"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+type ErrUnknownSession struct {
+	sessionID string
+}
+
+func (e *ErrUnknownSession) Error() string {
+	return fmt.Sprintf("Session '%s' not found", e.sessionID)
+}
+
+type session struct {
+	info      SessionInfo
+	tokenHash []byte
+	repoKey   []byte
+}
+
+type sessionStore struct {
+	mutex    sync.Mutex
+	sessions map[string]*session
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]*session)}
+}
+
+func hashSessionToken(token string) []byte {
+	tokenHash := sha256.Sum256([]byte(token))
+	return tokenHash[:]
+}
+
+func (ss *sessionStore) add(s *session) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	ss.sessions[s.info.ID] = s
+}
+
+// lookup returns the live session of the token, dropping expired sessions
+// on the way.
+func (ss *sessionStore) lookup(token string) *session {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	return ss.lookupLocked(token)
+}
+
+func (ss *sessionStore) lookupLocked(token string) *session {
+	ss.purgeExpired()
+
+	tokenHash := hashSessionToken(token)
+	for _, s := range ss.sessions {
+		if subtle.ConstantTimeCompare(s.tokenHash, tokenHash) == 1 {
+			return s
+		}
+	}
+	return nil
+}
+
+// repositoryKey returns a copy of the key of the token's session, or nil
+// when the token opens no session of the user account on the repository.
+func (ss *sessionStore) repositoryKey(
+	userUUID, repoUUID, token string) []byte {
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	s := ss.lookupLocked(token)
+	if s == nil || s.info.UserUUID != userUUID ||
+		s.info.RepositoryUUID != repoUUID {
+		return nil
+	}
+
+	repoKey := make([]byte, len(s.repoKey))
+	copy(repoKey, s.repoKey)
+	return repoKey
+}
+
+// list returns the live sessions of the repository, of the user account
+// only unless userUUID is empty.
+func (ss *sessionStore) list(repoUUID, userUUID string) []*SessionInfo {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	ss.purgeExpired()
+
+	sessions := make([]*SessionInfo, 0)
+	for _, s := range ss.sessions {
+		if s.info.RepositoryUUID != repoUUID ||
+			(userUUID != "" && s.info.UserUUID != userUUID) {
+			continue
+		}
+		info := s.info
+		sessions = append(sessions, &info)
+	}
+	sort.Sort(byCreatedAt(sessions))
+	return sessions
+}
+
+// revoke drops the sessions the filter matches.
+func (ss *sessionStore) revoke(filter func(info *SessionInfo) bool) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	for id, s := range ss.sessions {
+		if filter(&s.info) {
+			ss.drop(id, s)
+		}
+	}
+}
+
+func (ss *sessionStore) purgeExpired() {
+	now := time.Now()
+	for id, s := range ss.sessions {
+		if !now.Before(s.info.ExpiresAt) {
+			ss.drop(id, s)
+		}
+	}
+}
+
+func (ss *sessionStore) drop(id string, s *session) {
+	freeProtected(s.repoKey)
+	s.repoKey = nil
+	delete(ss.sessions, id)
+}
+
+type byCreatedAt []*SessionInfo
+
+func (s byCreatedAt) Len() int      { return len(s) }
+func (s byCreatedAt) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byCreatedAt) Less(i, j int) bool {
+	if s[i].CreatedAt.Equal(s[j].CreatedAt) {
+		return s[i].ID < s[j].ID
+	}
+	return s[i].CreatedAt.Before(s[j].CreatedAt)
+}
+
+// SetSessionTTL sets how long the sessions opened from now on last.
+func (h *Himitsu) SetSessionTTL(sessionTTL time.Duration) {
+	h.sessionTTL = sessionTTL
+}
+
+// Login unwraps the repository key of the user account and keeps it in a
+// new session. It returns the session token, to be passed as userPwd on the
+// repository until the session ends. Opening a session takes the password,
+// not the token of another session, and a TOTP code when the user account
+// is enrolled, see EnrollTOTP. totpCode is ignored otherwise.
+func (h *Himitsu) Login(repoUUID, userUUID, userPwd, totpCode string) (
+	token string, info *SessionInfo, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_LOGIN, userUUID, repoUUID, "")
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			token, info = "", nil
+		}
+	}()
+
+	repository, repoKey, err := h.openRepositoryWithTOTP(
+		repoUUID, userUUID, userPwd, totpCode)
+	if err != nil {
+		return "", nil, err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	rawToken, err := h.saltGenerator.Call(32)
+	if err != nil {
+		return "", nil, err
+	}
+	token = base64.RawURLEncoding.EncodeToString(rawToken)
+	Zero(rawToken)
+
+	protectedRepoKey, err := allocateProtected(len(repoKey))
+	if err != nil {
+		return "", nil, err
+	}
+	copy(protectedRepoKey, repoKey)
+
+	now := time.Now().UTC()
+	s := &session{
+		info: SessionInfo{
+			ID:             h.uuidGenerator.Call(),
+			UserUUID:       userUUID,
+			RepositoryUUID: repoUUID,
+			CreatedAt:      now,
+			ExpiresAt:      now.Add(h.sessionTTL)},
+		tokenHash: hashSessionToken(token),
+		repoKey:   protectedRepoKey}
+	h.sessions.add(s)
+
+	sessionInfo := s.info
+	return token, &sessionInfo, nil
+}
+
+// ResolveSession returns the session of the token, or ErrInvalidCredentials
+// when it has ended.
+func (h *Himitsu) ResolveSession(token string) (*SessionInfo, error) {
+	s := h.sessions.lookup(token)
+	if s == nil {
+		return nil, &ErrInvalidCredentials{}
+	}
+	info := s.info
+	return &info, nil
+}
+
+// ListSessions returns the sessions of the user account on the repository,
+// or all of them to its user account admins.
+func (h *Himitsu) ListSessions(repoUUID, userUUID, userPwd string) (
+	sessions []*SessionInfo, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_LIST_SESSIONS,
+		userUUID, repoUUID, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			sessions = nil
+		}
+	}()
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	if _, err := repository.findUserAccount(userUUID); err != nil {
+		return nil, err
+	}
+
+	if repository.checkAdminRight(userUUID) == nil {
+		return h.sessions.list(repoUUID, ""), nil
+	}
+	return h.sessions.list(repoUUID, userUUID), nil
+}
+
+// RevokeSession ends a session of the user account on the repository, or of
+// any user account for its user account admins.
+func (h *Himitsu) RevokeSession(
+	repoUUID, userUUID, userPwd, sessionID string) (err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_REVOKE_SESSION,
+		userUUID, repoUUID, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	sessions, err := h.ListSessions(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range sessions {
+		if info.ID == sessionID {
+			h.sessions.revoke(func(other *SessionInfo) bool {
+				return other.ID == sessionID
+			})
+			return nil
+		}
+	}
+	return &ErrUnknownSession{sessionID: sessionID}
+}
+
+func (h *Himitsu) revokeRepositorySessions(repoUUID string) {
+	h.sessions.revoke(func(info *SessionInfo) bool {
+		return info.RepositoryUUID == repoUUID
+	})
+}
+
+func (h *Himitsu) revokeUserAccountSessions(repoUUID, userUUID string) {
+	h.sessions.revoke(func(info *SessionInfo) bool {
+		return info.UserUUID == userUUID &&
+			(repoUUID == "" || info.RepositoryUUID == repoUUID)
+	})
+}
@@ -0,0 +1,112 @@
+package himitsu
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	otherRepoUUID, bobUUID, err := h.CreateRepository(
+		"other", "bob", "bob password")
+	assert.Nil(err)
+	assert.Nil(h.InviteUserAccount(repoUUID, adminUUID, "password",
+		bobUUID, "bob", []string{RIGHT_READ_SECRET}))
+	assert.Nil(h.AcceptInvitation(repoUUID, bobUUID, "bob password", ""))
+
+	token, info, err := h.Login(repoUUID, bobUUID, "bob password", "")
+	assert.Nil(err)
+	assert.Equal(bobUUID, info.UserUUID)
+	assert.Equal(repoUUID, info.RepositoryUUID)
+	assert.True(info.ExpiresAt.After(time.Now()))
+
+	resolved, err := h.ResolveSession(token)
+	assert.Nil(err)
+	assert.Equal(info.ID, resolved.ID)
+
+	// the token stands for the password on its repository only
+	secret, err := h.ReadSecret(repoUUID, bobUUID, token, "hello")
+	assert.Nil(err)
+	assert.Equal([]byte("Hello World !"), secret)
+	_, err = h.ReadSecret(otherRepoUUID, bobUUID, token, "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	_, err = h.ReadSecret(repoUUID, adminUUID, token, "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	_, _, err = h.Login(repoUUID, bobUUID, token, "")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+
+	// a user account only sees and revokes its own sessions, unless admin
+	adminToken, adminInfo, err := h.Login(repoUUID, adminUUID, "password", "")
+	assert.Nil(err)
+	sessions, err := h.ListSessions(repoUUID, bobUUID, token)
+	assert.Nil(err)
+	assert.Len(sessions, 1)
+	assert.Equal(info.ID, sessions[0].ID)
+	sessions, err = h.ListSessions(repoUUID, adminUUID, adminToken)
+	assert.Nil(err)
+	assert.Len(sessions, 2)
+
+	err = h.RevokeSession(repoUUID, bobUUID, "bob password", adminInfo.ID)
+	assert.IsType(&ErrUnknownSession{}, err)
+	assert.IsType(&ErrNotFound{}, ClassifyError(err))
+	assert.Nil(h.RevokeSession(repoUUID, adminUUID, "password", info.ID))
+
+	_, err = h.ResolveSession(token)
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	_, err = h.ReadSecret(repoUUID, bobUUID, token, "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	_, err = h.ReadSecret(repoUUID, adminUUID, adminToken, "hello")
+	assert.Nil(err)
+}
+
+func TestSessionExpiry(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+
+	h.SetSessionTTL(50 * time.Millisecond)
+	token, _, err := h.Login(repoUUID, adminUUID, "password", "")
+	assert.Nil(err)
+	_, err = h.ReadSecret(repoUUID, adminUUID, token, "hello")
+	assert.Nil(err)
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = h.ResolveSession(token)
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	_, err = h.ReadSecret(repoUUID, adminUUID, token, "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	sessions, err := h.ListSessions(repoUUID, adminUUID, "password")
+	assert.Nil(err)
+	assert.Len(sessions, 0)
+}
+
+func TestSessionsAreRevokedWithTheirKey(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	bobUUID, err := h.AddUserAccount(repoUUID, adminUUID, "password",
+		"bob", "bob password", []string{RIGHT_READ_SECRET})
+	assert.Nil(err)
+
+	bobToken, _, err := h.Login(repoUUID, bobUUID, "bob password", "")
+	assert.Nil(err)
+	assert.Nil(h.RemoveUserAccount(repoUUID, adminUUID, "password", bobUUID))
+	_, err = h.ResolveSession(bobToken)
+	assert.IsType(&ErrInvalidCredentials{}, err)
+
+	adminToken, _, err := h.Login(repoUUID, adminUUID, "password", "")
+	assert.Nil(err)
+	assert.Nil(h.RotateRepositoryKey(repoUUID, adminUUID, "password"))
+	_, err = h.ResolveSession(adminToken)
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	_, err = h.ReadSecret(repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+}
@@ -0,0 +1,426 @@
+package himitsu
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"github.com/pagedegeek/himitsu/data_access"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+	TOTP (RFC 6238) second factor.
+
+	A user account enrolls once for all its repositories, as its password
+	is the same on each of them: its seed, recovery codes and the last time
+	step used are kept in a record of its own, encrypted under a key derived
+	from its derived password. Once enrolled, its password alone is refused
+	wherever it is checked: opening a repository takes a Login with a code,
+	or one of its recovery codes, and then the session token, while listing
+	its repositories, accepting an invitation or changing its password take
+	the code along with the password. API keys and client certificates are
+	not affected, being second factors of their own.
+
+	A code is only accepted once, and not before a code already used: the
+	last time step used is saved on each use, unless another use saved the
+	record in between, in which case the code is checked again.
+
+	The record is not kept inside the repositories: some of the operations
+	it guards open no repository, and copies of it in each repository would
+	each have their own last time step, letting a code used on one
+	repository be used again on another.
+*/
+
+const (
+	AUDIT_OPERATION_ENROLL_TOTP  string = "EnrollTOTP"
+	AUDIT_OPERATION_CONFIRM_TOTP string = "ConfirmTOTP"
+	AUDIT_OPERATION_DISABLE_TOTP string = "DisableTOTP"
+)
+
+const (
+	totpPeriod            = 30
+	totpDigits            = 6
+	totpSkew              = 1
+	totpSeedSize          = 20
+	totpRecoveryCodes     = 10
+	totpRecoveryCodeBytes = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type TOTP struct {
+	Seed      []byte
+	Confirmed bool
+	LastStep  int64
+	// RecoveryCodes holds the SHA-256 of the unused recovery codes.
+	RecoveryCodes [][]byte
+}
+
+// TOTPEnrollment is what the user account needs to set up its
+// authenticator. It is only shown once.
+type TOTPEnrollment struct {
+	Secret        string   `json:"secret"`
+	URI           string   `json:"uri"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type ErrTOTPState struct {
+	userUUID string
+	reason   string
+}
+
+func (e *ErrTOTPState) Error() string {
+	return fmt.Sprintf("UserAccount '%s' %s", e.userUUID, e.reason)
+}
+
+// totpCode computes the HOTP (RFC 4226) code of the time step.
+func totpCode(seed []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, seed)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
+
+func hashRecoveryCode(code string) []byte {
+	normalized := strings.ToUpper(strings.Replace(
+		strings.TrimSpace(code), "-", "", -1))
+	recoveryCodeHash := sha256.Sum256([]byte(normalized))
+	return recoveryCodeHash[:]
+}
+
+// verify accepts a code of the current time step, or of the steps next to
+// it, newer than the last one used, or else an unused recovery code, which
+// it then drops.
+func (t *TOTP) verify(code string, now time.Time) bool {
+	currentStep := now.Unix() / totpPeriod
+	for step := currentStep - totpSkew; step <= currentStep+totpSkew; step++ {
+		if step <= t.LastStep {
+			continue
+		}
+		if hmac.Equal([]byte(code), []byte(totpCode(t.Seed, step))) {
+			t.LastStep = step
+			return true
+		}
+	}
+
+	codeHash := hashRecoveryCode(code)
+	for i, recoveryCodeHash := range t.RecoveryCodes {
+		if hmac.Equal(codeHash, recoveryCodeHash) {
+			t.RecoveryCodes = append(
+				t.RecoveryCodes[:i], t.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// totpKey derives the key the TOTP record of the user account is encrypted
+// under from its derived password.
+func totpKey(derivedUserPwd []byte) []byte {
+	mac := hmac.New(sha256.New, derivedUserPwd)
+	mac.Write([]byte("himitsu TOTP"))
+	return mac.Sum(nil)
+}
+
+// readTOTP returns the TOTP record of the user account along with its
+// cipher form, or nils if it has none. The derived password is expected to
+// be checked already, so that a failure to decrypt is an integrity one.
+func (h *Himitsu) readTOTP(
+	userUUID string, derivedUserPwd []byte) (*TOTP, []byte, error) {
+
+	cipherTOTP, err := h.dataAccess.ReadTOTP(userUUID)
+	if err != nil || cipherTOTP == nil {
+		return nil, nil, err
+	}
+
+	encryptionKey := totpKey(derivedUserPwd)
+	defer Zero(encryptionKey)
+
+	encodedTOTP, err := h.cryptoEngine.Decrypt(cipherTOTP, encryptionKey)
+	if err != nil {
+		return nil, nil, &ErrIntegrity{err: err}
+	}
+	defer Zero(encodedTOTP)
+
+	totp := &TOTP{}
+	if err := gob.NewDecoder(
+		bytes.NewReader(encodedTOTP)).Decode(totp); err != nil {
+		return nil, nil, &ErrIntegrity{err: err}
+	}
+	return totp, cipherTOTP, nil
+}
+
+func (h *Himitsu) encryptTOTP(
+	totp *TOTP, derivedUserPwd []byte) ([]byte, error) {
+
+	var encodedTOTP bytes.Buffer
+	if err := gob.NewEncoder(&encodedTOTP).Encode(totp); err != nil {
+		return nil, err
+	}
+	defer Zero(encodedTOTP.Bytes())
+
+	encryptionKey := totpKey(derivedUserPwd)
+	defer Zero(encryptionKey)
+
+	iv, err := h.saltGenerator.Call(16)
+	if err != nil {
+		return nil, err
+	}
+	return h.cryptoEngine.Encrypt(encodedTOTP.Bytes(), encryptionKey, iv)
+}
+
+// checkTOTP verifies the TOTP code of the user account, once its password
+// is checked, when it is enrolled, saving the record so that the code
+// cannot be used again. totpCode is ignored otherwise.
+func (h *Himitsu) checkTOTP(
+	userUUID string, derivedUserPwd []byte, totpCode string) error {
+
+	for retry := 0; ; retry++ {
+		totp, cipherTOTP, err := h.readTOTP(userUUID, derivedUserPwd)
+		if err != nil {
+			return err
+		}
+		if totp == nil || !totp.Confirmed {
+			return nil
+		}
+		// a missing code fails as a wrong one does, not to tell that the
+		// password is right
+		if totpCode == "" || !totp.verify(totpCode, time.Now()) {
+			return h.failedUnwrap(lockoutSubjectUserAccount+userUUID,
+				&ErrInvalidCredentials{userUUID: userUUID})
+		}
+
+		newCipherTOTP, err := h.encryptTOTP(totp, derivedUserPwd)
+		if err != nil {
+			return err
+		}
+		err = h.dataAccess.SaveTOTPIfUnchanged(
+			userUUID, newCipherTOTP, cipherTOTP)
+		if _, changed := err.(*data_access.ErrTOTPChanged); !changed ||
+			retry == MaxConflictRetries {
+			return err
+		}
+	}
+}
+
+// batchRewrapTOTP adds the TOTP record of the user account, if any,
+// re-encrypted under the new derived password to the batch.
+func (h *Himitsu) batchRewrapTOTP(batch data_access.Batch, userUUID string,
+	derivedUserPwd, newDerivedUserPwd []byte) error {
+
+	totp, cipherTOTP, err := h.readTOTP(userUUID, derivedUserPwd)
+	if err != nil || totp == nil {
+		return err
+	}
+
+	newCipherTOTP, err := h.encryptTOTP(totp, newDerivedUserPwd)
+	if err != nil {
+		return err
+	}
+	batch.SaveTOTPIfUnchanged(userUUID, newCipherTOTP, cipherTOTP)
+	return nil
+}
+
+// openRepositoryWithTOTP opens the repository with the password and, when
+// the user account is enrolled, the TOTP code.
+func (h *Himitsu) openRepositoryWithTOTP(repoUUID, userUUID, userPwd,
+	totpCode string) (*Repository, []byte, error) {
+
+	repoKey, err := h.loadRepositoryKeyWithPassword(
+		userUUID, repoUUID, userPwd, totpCode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	repository, err := h.loadRepository(repoUUID, repoKey)
+	if err == nil {
+		_, err = repository.findUserAccount(userUUID)
+	}
+	if err == nil {
+		err = h.clearFailedUnwraps(lockoutSubjectUserAccount + userUUID)
+	}
+	if err != nil {
+		Zero(repoKey)
+		Clear(repository)
+		return nil, nil, err
+	}
+	return repository, repoKey, nil
+}
+
+// EnrollTOTP generates a TOTP seed and recovery codes for the user account,
+// which only take effect once confirmed with a code, see ConfirmTOTP.
+// Enrolling again before confirming replaces them; once confirmed, the
+// TOTP has to be disabled first.
+func (h *Himitsu) EnrollTOTP(
+	userUUID, userPwd string) (enrollment *TOTPEnrollment, err error) {
+
+	record, err := h.beginAudit(AUDIT_OPERATION_ENROLL_TOTP, userUUID, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = record.end(err)
+		if err != nil {
+			enrollment = nil
+		}
+	}()
+
+	derivedUserPwd, err := h.authenticateUserAccountPassword(
+		userUUID, userPwd)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(derivedUserPwd)
+
+	previousTOTP, previousCipherTOTP, err := h.readTOTP(
+		userUUID, derivedUserPwd)
+	if err != nil {
+		return nil, err
+	}
+	if previousTOTP != nil && previousTOTP.Confirmed {
+		return nil, &ErrTOTPState{userUUID: userUUID,
+			reason: "is already enrolled"}
+	}
+
+	seed, err := h.saltGenerator.Call(totpSeedSize)
+	if err != nil {
+		return nil, err
+	}
+
+	totp := &TOTP{Seed: seed}
+	enrollment = &TOTPEnrollment{
+		Secret:        totpEncoding.EncodeToString(seed),
+		RecoveryCodes: make([]string, 0, totpRecoveryCodes)}
+	for i := 0; i < totpRecoveryCodes; i++ {
+		rawCode, err := h.saltGenerator.Call(totpRecoveryCodeBytes)
+		if err != nil {
+			return nil, err
+		}
+		code := totpEncoding.EncodeToString(rawCode)
+		Zero(rawCode)
+		enrollment.RecoveryCodes = append(enrollment.RecoveryCodes,
+			code[:len(code)/2]+"-"+code[len(code)/2:])
+		totp.RecoveryCodes = append(totp.RecoveryCodes,
+			hashRecoveryCode(code))
+	}
+
+	enrollment.URI = (&url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/himitsu:" + userUUID,
+		RawQuery: url.Values{
+			"secret": {enrollment.Secret},
+			"issuer": {"himitsu"},
+		}.Encode()}).String()
+
+	cipherTOTP, err := h.encryptTOTP(totp, derivedUserPwd)
+	if err != nil {
+		return nil, err
+	}
+	batch := h.dataAccess.NewBatch()
+	batch.SaveTOTPIfUnchanged(userUUID, cipherTOTP, previousCipherTOTP)
+	if err := record.commit(batch); err != nil {
+		return nil, err
+	}
+	return enrollment, nil
+}
+
+// ConfirmTOTP turns on the TOTP second factor of the user account once it
+// proves its authenticator is set up.
+func (h *Himitsu) ConfirmTOTP(userUUID, userPwd, totpCode string) (err error) {
+	record, err := h.beginAudit(AUDIT_OPERATION_CONFIRM_TOTP, userUUID, "", "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	derivedUserPwd, err := h.authenticateUserAccountPassword(
+		userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(derivedUserPwd)
+
+	totp, cipherTOTP, err := h.readTOTP(userUUID, derivedUserPwd)
+	if err != nil {
+		return err
+	}
+	if totp == nil || totp.Confirmed {
+		return &ErrTOTPState{userUUID: userUUID,
+			reason: "has no TOTP to confirm"}
+	}
+
+	// recovery codes only stand for a confirmed authenticator
+	recoveryCodes := totp.RecoveryCodes
+	totp.RecoveryCodes = nil
+	verified := totp.verify(totpCode, time.Now())
+	totp.RecoveryCodes = recoveryCodes
+	if !verified {
+		return h.failedUnwrap(lockoutSubjectUserAccount+userUUID,
+			&ErrInvalidCredentials{userUUID: userUUID})
+	}
+	totp.Confirmed = true
+
+	newCipherTOTP, err := h.encryptTOTP(totp, derivedUserPwd)
+	if err != nil {
+		return err
+	}
+	batch := h.dataAccess.NewBatch()
+	batch.SaveTOTPIfUnchanged(userUUID, newCipherTOTP, cipherTOTP)
+	return record.commit(batch)
+}
+
+// DisableTOTP turns off the TOTP second factor of the user account, given
+// one of its codes.
+func (h *Himitsu) DisableTOTP(userUUID, userPwd, totpCode string) (err error) {
+	record, err := h.beginAudit(AUDIT_OPERATION_DISABLE_TOTP, userUUID, "", "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = record.end(err)
+	}()
+
+	derivedUserPwd, err := h.authenticateUserAccountPassword(
+		userUUID, userPwd)
+	if err != nil {
+		return err
+	}
+	defer Zero(derivedUserPwd)
+
+	totp, cipherTOTP, err := h.readTOTP(userUUID, derivedUserPwd)
+	if err != nil {
+		return err
+	}
+	if totp == nil || !totp.Confirmed {
+		return &ErrTOTPState{userUUID: userUUID, reason: "is not enrolled"}
+	}
+	if !totp.verify(totpCode, time.Now()) {
+		return h.failedUnwrap(lockoutSubjectUserAccount+userUUID,
+			&ErrInvalidCredentials{userUUID: userUUID})
+	}
+
+	batch := h.dataAccess.NewBatch()
+	batch.SaveTOTPIfUnchanged(userUUID, nil, cipherTOTP)
+	return record.commit(batch)
+}
@@ -0,0 +1,147 @@
+package himitsu
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enrollTOTP enrolls the user account and confirms it with the code of the
+// previous time step, leaving the current and next ones to the test.
+func enrollTOTP(assert *assert.Assertions, h *Himitsu, userUUID,
+	userPwd string) (seed []byte, step int64, recoveryCodes []string) {
+
+	enrollment, err := h.EnrollTOTP(userUUID, userPwd)
+	assert.Nil(err)
+	seed, err = totpEncoding.DecodeString(enrollment.Secret)
+	assert.Nil(err)
+
+	step = time.Now().Unix() / totpPeriod
+	assert.Nil(h.ConfirmTOTP(userUUID, userPwd, totpCode(seed, step-1)))
+	return seed, step, enrollment.RecoveryCodes
+}
+
+func TestTOTPRefusesPasswordAlone(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	otherRepoUUID, bobUUID, err := h.CreateRepository(
+		"other", "bob", "bob password")
+	assert.Nil(err)
+	assert.Nil(h.InviteUserAccount(repoUUID, adminUUID, "password",
+		bobUUID, "bob", []string{RIGHT_READ_SECRET}))
+
+	seed, step, _ := enrollTOTP(assert, h, bobUUID, "bob password")
+
+	// the enrollment covers every repository of bob and every password path
+	_, err = h.ReadSecret(otherRepoUUID, bobUUID, "bob password", "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	_, err = h.ListRepositoriesForUser(bobUUID, "bob password", "")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	err = h.AcceptInvitation(repoUUID, bobUUID, "bob password", "")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	err = h.ChangeUserPassword(
+		bobUUID, "bob password", "new bob password", "")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	_, err = h.EnrollTOTP(bobUUID, "bob password")
+	assert.IsType(&ErrTOTPState{}, err)
+
+	assert.Nil(h.AcceptInvitation(repoUUID, bobUUID, "bob password",
+		totpCode(seed, step)))
+	_, err = h.ReadSecret(repoUUID, bobUUID, "bob password", "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+
+	token, _, err := h.Login(repoUUID, bobUUID, "bob password",
+		totpCode(seed, step+1))
+	assert.Nil(err)
+	_, err = h.ReadSecret(repoUUID, bobUUID, token, "hello")
+	assert.Nil(err)
+
+	// admin is not enrolled
+	_, err = h.ReadSecret(repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+}
+
+func TestTOTPCodeIsSingleUse(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	seed, step, _ := enrollTOTP(assert, h, adminUUID, "password")
+
+	_, _, err = h.Login(repoUUID, adminUUID, "password", totpCode(seed, step))
+	assert.Nil(err)
+
+	// neither the same code, nor one older than it
+	_, _, err = h.Login(repoUUID, adminUUID, "password", totpCode(seed, step))
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	_, err = h.ListRepositoriesForUser(
+		adminUUID, "password", totpCode(seed, step-1))
+	assert.IsType(&ErrInvalidCredentials{}, err)
+
+	// nor a valid code with the wrong password
+	_, _, err = h.Login(repoUUID, adminUUID, "wrong password",
+		totpCode(seed, step+1))
+	assert.IsType(&ErrInvalidCredentials{}, err)
+
+	repositories, err := h.ListRepositoriesForUser(
+		adminUUID, "password", totpCode(seed, step+1))
+	assert.Nil(err)
+	assert.Len(repositories, 1)
+}
+
+func TestTOTPRecoveryCodeIsSingleUse(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	_, _, recoveryCodes := enrollTOTP(assert, h, adminUUID, "password")
+	assert.Len(recoveryCodes, totpRecoveryCodes)
+
+	_, _, err = h.Login(repoUUID, adminUUID, "password", recoveryCodes[0])
+	assert.Nil(err)
+	_, _, err = h.Login(repoUUID, adminUUID, "password", recoveryCodes[0])
+	assert.IsType(&ErrInvalidCredentials{}, err)
+
+	// recovery codes are normalized
+	_, _, err = h.Login(repoUUID, adminUUID, "password",
+		" "+strings.ToLower(recoveryCodes[1])+" ")
+	assert.Nil(err)
+
+	assert.Nil(h.DisableTOTP(adminUUID, "password", recoveryCodes[2]))
+	_, err = h.ReadSecret(repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+}
+
+func TestChangeUserPasswordKeepsTOTP(t *testing.T) {
+	assert, h, _, _, dataAccess, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	seed, step, _ := enrollTOTP(assert, h, adminUUID, "password")
+	cipherTOTP, err := dataAccess.ReadTOTP(adminUUID)
+	assert.Nil(err)
+
+	assert.Nil(h.ChangeUserPassword(adminUUID, "password", "new password",
+		totpCode(seed, step)))
+
+	newCipherTOTP, err := dataAccess.ReadTOTP(adminUUID)
+	assert.Nil(err)
+	assert.NotEqual(cipherTOTP, newCipherTOTP)
+	_, err = h.ReadSecret(repoUUID, adminUUID, "new password", "hello")
+	assert.IsType(&ErrInvalidCredentials{}, err)
+
+	// the record kept the code used to change the password
+	_, _, err = h.Login(repoUUID, adminUUID, "new password",
+		totpCode(seed, step))
+	assert.IsType(&ErrInvalidCredentials{}, err)
+	_, _, err = h.Login(repoUUID, adminUUID, "new password",
+		totpCode(seed, step+1))
+	assert.Nil(err)
+}
@@ -0,0 +1,145 @@
+package himitsu
+
+// RepositoryTx gives access to the secrets of a repository within Update.
+// Changes made through it are saved together when the update function
+// returns nil, and dropped otherwise.
+type RepositoryTx struct {
+	repository *Repository
+	userUUID   string
+	operations []*txOperation
+	// written tells whether a change was made, without which there is
+	// nothing to save.
+	written bool
+	// committed tells whether the audit entries of the operations were
+	// saved along with the changes.
+	committed bool
+}
+
+type txOperation struct {
+	operation  string
+	secretName string
+	err        error
+}
+
+func (tx *RepositoryTx) record(operation, secretName string, err error) error {
+	tx.operations = append(tx.operations, &txOperation{
+		operation:  operation,
+		secretName: secretName,
+		err:        err})
+	return err
+}
+
+func (tx *RepositoryTx) ReadSecret(secretName string) ([]byte, error) {
+	secretValue, err := tx.repository.ReadSecret(tx.userUUID, secretName)
+	return secretValue, tx.record(AUDIT_OPERATION_READ_SECRET, secretName, err)
+}
+
+// wrote records a change made through tx, if it succeeded.
+func (tx *RepositoryTx) wrote(err error) error {
+	if err == nil {
+		tx.written = true
+	}
+	return err
+}
+
+func (tx *RepositoryTx) WriteSecret(secretName string, secretValue []byte,
+	opts *WriteSecretOptions) error {
+	return tx.record(AUDIT_OPERATION_WRITE_SECRET, secretName, tx.wrote(
+		tx.repository.WriteSecret(tx.userUUID, secretName, secretValue, opts)))
+}
+
+func (tx *RepositoryTx) DeleteSecret(secretName string) error {
+	return tx.record(AUDIT_OPERATION_DELETE_SECRET, secretName, tx.wrote(
+		tx.repository.DeleteSecret(tx.userUUID, secretName)))
+}
+
+func (tx *RepositoryTx) RenameSecret(secretName, newSecretName string) error {
+	return tx.record(AUDIT_OPERATION_RENAME_SECRET, secretName, tx.wrote(
+		tx.repository.RenameSecret(tx.userUUID, secretName, newSecretName)))
+}
+
+func (tx *RepositoryTx) ListSecretNames(
+	prefix string, recursive bool) ([]string, error) {
+	secretNames, err := tx.repository.ListSecretNames(
+		tx.userUUID, prefix, recursive)
+	return secretNames, tx.record(AUDIT_OPERATION_LIST_SECRET_NAMES, prefix, err)
+}
+
+// Update runs fn against the repository and saves every change it made at
+// once, or none if fn returns an error. An update which changed nothing
+// saves nothing. As WriteSecret, it starts over when
+// another writer saved the repository in between, so fn may run more than
+// once and should only act through tx.
+//
+// Audited operations made through tx are reported with the outcome of the
+// whole update.
+func (h *Himitsu) Update(repoUUID, userUUID, userPwd string,
+	fn func(tx *RepositoryTx) error) error {
+
+	if err := h.checkAuditKey(); err != nil {
+		return err
+	}
+
+	for retry := 0; ; retry++ {
+		tx, err := h.update(repoUUID, userUUID, userPwd, fn)
+		if _, isConflict := err.(*ErrConflict); isConflict &&
+			retry < MaxConflictRetries {
+			continue
+		}
+
+		if tx == nil {
+			return h.audit(AUDIT_OPERATION_UPDATE, userUUID, repoUUID, "", err)
+		}
+		if tx.committed {
+			return nil
+		}
+		for _, op := range tx.operations {
+			opErr := op.err
+			if opErr == nil {
+				opErr = err
+			}
+			if auditErr := h.audit(op.operation, userUUID, repoUUID,
+				op.secretName, opErr); auditErr != nil && err == nil {
+				err = auditErr
+			}
+		}
+		return err
+	}
+}
+
+func (h *Himitsu) update(repoUUID, userUUID, userPwd string,
+	fn func(tx *RepositoryTx) error) (*RepositoryTx, error) {
+
+	repository, repoKey, err := h.openRepository(repoUUID, userUUID, userPwd)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(repoKey)
+	defer func() {
+		Clear(repository)
+		repository = nil
+	}()
+
+	tx := &RepositoryTx{repository: repository, userUUID: userUUID}
+	if err := fn(tx); err != nil {
+		return tx, err
+	}
+	if !tx.written {
+		return tx, nil
+	}
+
+	batch := h.dataAccess.NewBatch()
+	if err := h.batchSaveRepository(batch, repository, repoKey); err != nil {
+		return tx, err
+	}
+	entries := make([]*AuditEntry, 0, len(tx.operations))
+	for _, op := range tx.operations {
+		entries = append(entries, newAuditEntry(
+			op.operation, userUUID, repoUUID, op.secretName, op.err))
+	}
+	if err := h.commitAudited(batch, repoUUID, entries...); err != nil {
+		return tx, err
+	}
+	tx.committed = true
+	return tx, nil
+}
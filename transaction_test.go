@@ -0,0 +1,78 @@
+package himitsu
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	_, revision, err := h.ReadSecretWithRevision(
+		repoUUID, adminUUID, "password", "hello")
+	assert.Nil(err)
+
+	binaryValue := []byte{0x00, 0xff, 0xfe, 0x80}
+	assert.Nil(h.Update(repoUUID, adminUUID, "password",
+		func(tx *RepositoryTx) error {
+			if err := tx.WriteSecret("binary", binaryValue, nil); err != nil {
+				return err
+			}
+			return tx.RenameSecret("hello", "greeting")
+		}))
+
+	secret, newRevision, err := h.ReadSecretWithRevision(
+		repoUUID, adminUUID, "password", "binary")
+	assert.Nil(err)
+	assert.Equal(binaryValue, secret)
+	assert.Equal(revision+1, newRevision)
+	_, err = h.ReadSecret(repoUUID, adminUUID, "password", "hello")
+	assert.IsType(&ErrUnknownSecret{}, err)
+}
+
+func TestUpdateSavesNothingOnFailure(t *testing.T) {
+	assert, h, _, _, _, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+
+	failure := errors.New("failure")
+	err = h.Update(repoUUID, adminUUID, "password",
+		func(tx *RepositoryTx) error {
+			if err := tx.WriteSecret("first", []byte("1"), nil); err != nil {
+				return err
+			}
+			return failure
+		})
+	assert.Equal(failure, err)
+
+	_, err = h.ReadSecret(repoUUID, adminUUID, "password", "first")
+	assert.IsType(&ErrUnknownSecret{}, err)
+}
+
+func TestUpdateWithoutWritesSavesNothing(t *testing.T) {
+	assert, h, _, _, dataAccess, teardown := setupHimitsu(t)
+	defer teardown()
+
+	repoUUID, adminUUID, err := h.CreateRepository("repo", "admin", "password")
+	assert.Nil(err)
+	cipherRepo, err := dataAccess.ReadCipherRepository(repoUUID)
+	assert.Nil(err)
+
+	var secret []byte
+	assert.Nil(h.Update(repoUUID, adminUUID, "password",
+		func(tx *RepositoryTx) error {
+			var err error
+			secret, err = tx.ReadSecret("hello")
+			return err
+		}))
+	assert.Equal([]byte("Hello World !"), secret)
+
+	storedCipherRepo, err := dataAccess.ReadCipherRepository(repoUUID)
+	assert.Nil(err)
+	assert.Equal(cipherRepo, storedCipherRepo)
+}